@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+// globalFlags are shared by every command that talks to an agent
+type globalFlags struct {
+	addr          *string
+	key_path      *string
+	tls           *bool
+	ca_path       *string
+	format        *string
+	retries       *int
+	retry_delay   *time.Duration
+	timeout       *time.Duration
+	write_timeout *time.Duration
+	log_path      *string
+	log_level     *string
+	log_format    *string
+}
+
+func addGlobalFlags(flags *flag.FlagSet) *globalFlags {
+	return &globalFlags{
+		addr:          flags.String("addr", "", "Address of remote server: -addr <domain or ip>:port"),
+		key_path:      flags.String("key", defaultKeyPath(), "private key used to sign requests: -key c:\\keys\\build01.key"),
+		tls:           flags.Bool("tls", false, "connect to the agent over TLS"),
+		ca_path:       flags.String("ca", "", "PEM certificate the agent's certificate is checked against instead of the system roots, implies -tls"),
+		format:        flags.String("output", "text", "output format, json writes one event per line: -output json"),
+		retries:       flags.Int("retries", 5, "times to reconnect to an agent that cannot be reached or drops the connection"),
+		retry_delay:   flags.Duration("retry-delay", time.Second, "delay before the first reconnect, it doubles on each attempt: -retry-delay 2s"),
+		timeout:       flags.Duration("timeout", 30*time.Second, "how long an agent may stay silent before it is taken to be down: -timeout 1m"),
+		write_timeout: flags.Duration("write-timeout", 10*time.Second, "how long a write to an agent may block: -write-timeout 30s"),
+		log_path:      flags.String("log", "", "write a diagnostic log to a file, or to stderr with -: -log deploy.log"),
+		log_level:     flags.String("log-level", "info", "lowest level written to -log: debug, info, warn or error"),
+		log_format:    flags.String("log-format", common.LOG_TEXT, "format of -log: text or json"),
+	}
+}
+
+// setOutput applies -output and -log, it is called as soon as the flags are
+// parsed so that later errors are reported in the chosen format
+func (global *globalFlags) setOutput() {
+	if *global.format != "text" && *global.format != "json" {
+		output = NewOutput("text")
+		validationError("invalid output format: %s", *global.format)
+	}
+	output = NewOutput(*global.format)
+	if len(*global.log_path) == 0 {
+		return
+	}
+	level, err := common.ParseLevel(*global.log_level)
+	if err == nil {
+		err = common.ValidateLogFormat(*global.log_format)
+	}
+	if err != nil {
+		validationError("%v", err)
+	}
+	var handler common.LogHandler = common.NewWriterHandler(os.Stderr, *global.log_format)
+	if *global.log_path != "-" {
+		if handler, err = common.NewRotatingFileHandler(*global.log_path, *global.log_format, LOG_MAX_SIZE, LOG_MAX_FILES); err != nil {
+			fatalError(false, "failed to open log: %v", err)
+		}
+	}
+	logger = common.NewLogger(level, handler)
+}
+
+// agents loads the key and TLS settings once for all of the addresses
+func (global *globalFlags) agents(addrs []string) []*Agent {
+	if *global.retries < 0 {
+		validationError("invalid retries: %d", *global.retries)
+	}
+	if *global.timeout <= 0 || *global.write_timeout <= 0 {
+		validationError("timeouts must be positive")
+	}
+	key, err := common.LoadPrivateKey(*global.key_path)
+	if err != nil {
+		fatalError(false, "failed to load signing key, create one with 'keygen': %v", err)
+	}
+	var tls_config *tls.Config
+	if *global.tls || len(*global.ca_path) > 0 {
+		tls_config = &tls.Config{MinVersion: tls.VersionTLS12}
+		if len(*global.ca_path) > 0 {
+			pem, err := os.ReadFile(*global.ca_path)
+			if err != nil {
+				fatalError(false, "failed to read ca: %v", err)
+			}
+			tls_config.RootCAs = x509.NewCertPool()
+			if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+				fatalError(false, "no certificates found in %s", *global.ca_path)
+			}
+		}
+	}
+	agents := make([]*Agent, len(addrs))
+	for i, addr := range addrs {
+		agents[i] = &Agent{addr: addr, key: key, tls: tls_config, retries: *global.retries, retry_delay: *global.retry_delay, timeout: *global.timeout, write_timeout: *global.write_timeout}
+	}
+	return agents
+}
+
+// agent is the agent given by -addr, which is required
+func (global *globalFlags) agent() *Agent {
+	if len(*global.addr) == 0 {
+		fatalError(true, "addr is required")
+	}
+	return global.agents([]string{*global.addr})[0]
+}
+
+// Agent is a Deploy Agent the client signs its requests to
+type Agent struct {
+	addr          string
+	key           ed25519.PrivateKey
+	tls           *tls.Config // nil for plain connections
+	retries       int
+	retry_delay   time.Duration
+	timeout       time.Duration
+	write_timeout time.Duration
+}
+
+// MAX_RETRY_DELAY caps the backoff between reconnects
+const MAX_RETRY_DELAY = 30 * time.Second
+
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoff is the delay before a reconnect, it doubles with each attempt and
+// is jittered so that clients cut off together do not return together
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		delay = MAX_RETRY_DELAY
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// retry waits before another attempt at reaching the agent, it returns false
+// once the retries are used up
+func (agent *Agent) retry(attempt int, err error) bool {
+	if attempt >= agent.retries {
+		return false
+	}
+	delay := backoff(agent.retry_delay, attempt)
+	output.Phase("reconnecting", fmt.Sprintf("to %s in %s, attempt %d of %d: %v", agent.addr, delay.Round(time.Millisecond), attempt+1, agent.retries, err))
+	logger.Warn("reconnecting", "agent", agent.addr, "attempt", attempt+1, "delay", delay, "err", err)
+	time.Sleep(delay)
+	return true
+}
+
+func (agent *Agent) url(scheme string, path string, query url.Values) url.URL {
+	if agent.tls != nil {
+		scheme += "s"
+	}
+	return url.URL{Scheme: scheme, Host: agent.addr, Path: path, RawQuery: query.Encode()}
+}
+
+// Dial opens a signed WebSocket to the agent, retrying while the agent cannot
+// be reached, and exits when it is refused
+func (agent *Agent) Dial(path string, compress bool) *Conn {
+	uri := agent.url("ws", path, nil)
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = agent.timeout
+	dialer.EnableCompression = compress
+	dialer.TLSClientConfig = agent.tls
+	for attempt := 0; ; attempt++ {
+		// signed on each attempt as the signature carries a timestamp
+		header := http.Header{}
+		common.SignRequest(header, http.MethodGet, uri.RequestURI(), nil, agent.key)
+		logger.Debug("connecting", "agent", agent.addr, "path", path)
+		conn, response, err := dialer.Dial(uri.String(), header)
+		if err == nil {
+			return newConn(conn, agent.addr, agent.timeout, agent.write_timeout)
+		}
+		if response != nil && response.StatusCode == http.StatusUnauthorized {
+			output.Fail(EXIT_AUTH, "agent rejected the request", err)
+		}
+		if response != nil && response.StatusCode < 500 || !agent.retry(attempt, err) {
+			output.Fail(EXIT_CONNECT, "failed to connect to "+agent.addr, err)
+		}
+	}
+}
+
+// Request sends a signed request to one of the agent's HTTP endpoints,
+// retrying while the agent cannot be reached or is unavailable, and exits
+// when the agent refuses it. Only a GET is sent again once it may have
+// reached the agent, see retryable.
+func (agent *Agent) Request(method string, path string, query url.Values) *http.Response {
+	return agent.Send(method, path, query, nil, nil)
+}
+
+// Send is Request with headers and a body, the body is sent again on each
+// retry
+func (agent *Agent) Send(method string, path string, query url.Values, header http.Header, body []byte) *http.Response {
+	uri := agent.url("http", path, query)
+	client := http.Client{Transport: agent.transport()}
+	var response *http.Response
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest(method, uri.String(), bytes.NewReader(body))
+		if err != nil {
+			output.Fail(EXIT_USAGE, "invalid request", err)
+		}
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		common.SignRequest(request.Header, method, uri.RequestURI(), body, agent.key)
+		response, err = client.Do(request)
+		if err == nil {
+			logger.Debug("request", "agent", agent.addr, "method", method, "path", path, "status", response.StatusCode)
+		}
+		if err == nil && !unavailable(response.StatusCode) {
+			break
+		}
+		if err == nil {
+			response.Body.Close()
+			err = errors.New(response.Status)
+		}
+		if !retryable(method, err) || !agent.retry(attempt, err) {
+			output.Fail(EXIT_CONNECT, "failed to connect to "+agent.addr, err)
+		}
+	}
+	if response.StatusCode >= 400 {
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		code := EXIT_TRANSFER
+		switch response.StatusCode {
+		case http.StatusUnauthorized:
+			code = EXIT_AUTH
+		case http.StatusConflict:
+			code = EXIT_BUSY
+		}
+		output.Fail(code, fmt.Sprintf("%s %s", response.Status, strings.TrimSpace(string(body))), nil)
+	}
+	return response
+}
+
+// retryable reports whether a failed request may be sent again. One the
+// agent never received, because the connection could not be made, always
+// may. A PUT, POST or DELETE that timed out or was answered by a proxy may
+// have been carried out already, so only a GET is retried after that.
+func retryable(method string, err error) bool {
+	if method == http.MethodGet {
+		return true
+	}
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// transport bounds connecting and waiting for an answer by -timeout. There is
+// no limit on a whole request, a download or upload runs as long as it keeps
+// moving, and it is the connection's idle deadlines that notice an agent that
+// has stopped.
+func (agent *Agent) transport() *http.Transport {
+	dialer := net.Dialer{Timeout: agent.timeout, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       agent.tls,
+		TLSHandshakeTimeout:   agent.timeout,
+		ResponseHeaderTimeout: agent.timeout,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &idleConn{Conn: conn, read_timeout: agent.timeout, write_timeout: agent.write_timeout}, nil
+		},
+	}
+}
+
+// idleConn moves its deadlines on with each read and write, so a transfer
+// fails once no data has moved for the timeout rather than after a fixed time
+type idleConn struct {
+	net.Conn
+	read_timeout  time.Duration
+	write_timeout time.Duration
+}
+
+func (conn *idleConn) Read(b []byte) (int, error) {
+	if err := conn.Conn.SetReadDeadline(time.Now().Add(conn.read_timeout)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *idleConn) Write(b []byte) (int, error) {
+	if err := conn.Conn.SetWriteDeadline(time.Now().Add(conn.write_timeout)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(b)
+}
+
+// unavailable reports the statuses a proxy in front of an agent answers with
+// while the agent restarts
+func unavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// Get decodes the JSON an endpoint answers with into value
+func (agent *Agent) Get(path string, query url.Values, value any) {
+	decodeResponse(agent.Request(http.MethodGet, path, query), value)
+}
+
+// Post sends body as JSON and decodes the JSON answer into value
+func (agent *Agent) Post(path string, body any, value any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		output.Fail(EXIT_USAGE, "invalid request", err)
+	}
+	decodeResponse(agent.Send(http.MethodPost, path, nil, http.Header{"Content-Type": {"application/json"}}, data), value)
+}
+
+func decodeResponse(response *http.Response, value any) {
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+		output.Fail(EXIT_TRANSFER, "invalid response", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAgent is an Agent for the server at addr that retries quickly
+func testAgent(t *testing.T, addr string, retries int) *Agent {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Agent{addr: addr, key: key, retries: retries, retry_delay: time.Millisecond, timeout: time.Second, write_timeout: time.Second}
+}
+
+// statusServer answers every request with status and counts the requests
+func statusServer(t *testing.T, status int) (*httptest.Server, *int32) {
+	requests := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		http.Error(w, http.StatusText(status), status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// refusedAddr is an address nothing listens on
+func refusedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestSendExitCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		method   string
+		code     int
+		requests int32
+	}{
+		{"refused key", http.StatusUnauthorized, http.MethodGet, EXIT_AUTH, 1},
+		{"forbidden", http.StatusForbidden, http.MethodGet, EXIT_TRANSFER, 1},
+		{"not found", http.StatusNotFound, http.MethodDelete, EXIT_TRANSFER, 1},
+		{"destination busy", http.StatusConflict, http.MethodDelete, EXIT_BUSY, 1},
+		{"unavailable get is retried", http.StatusServiceUnavailable, http.MethodGet, EXIT_CONNECT, 3},
+		// the agent may have carried out a request a proxy answered for
+		{"unavailable put is not retried", http.StatusBadGateway, http.MethodPut, EXIT_CONNECT, 1},
+		{"unavailable delete is not retried", http.StatusGatewayTimeout, http.MethodDelete, EXIT_CONNECT, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := statusServer(t, test.status)
+			agent := testAgent(t, server.Listener.Addr().String(), 2)
+			_, code := runClient(t, func() {
+				agent.Send(test.method, "/secrets", nil, nil, []byte("value"))
+			})
+			if code != test.code {
+				t.Errorf("exited with %d, want %d", code, test.code)
+			}
+			if got := atomic.LoadInt32(requests); got != test.requests {
+				t.Errorf("%d requests were made, want %d", got, test.requests)
+			}
+		})
+	}
+}
+
+func TestSendRefusedConnection(t *testing.T) {
+	agent := testAgent(t, refusedAddr(t), 2)
+	events, code := runClient(t, func() {
+		agent.Send(http.MethodPut, "/secrets", nil, nil, []byte("value"))
+	})
+	if code != EXIT_CONNECT {
+		t.Errorf("exited with %d, want %d", code, EXIT_CONNECT)
+	}
+	// a request that never reached the agent is sent again, whatever its method
+	reconnects := 0
+	for _, event := range events {
+		if event["phase"] == "reconnecting" {
+			reconnects++
+		}
+	}
+	if reconnects != 2 {
+		t.Errorf("reconnected %d times, want 2", reconnects)
+	}
+}
+
+func TestDialExitCodes(t *testing.T) {
+	unauthorized, _ := statusServer(t, http.StatusUnauthorized)
+	missing, _ := statusServer(t, http.StatusNotFound)
+	tests := []struct {
+		name string
+		addr string
+		code int
+	}{
+		{"refused key", unauthorized.Listener.Addr().String(), EXIT_AUTH},
+		{"not an agent", missing.Listener.Addr().String(), EXIT_CONNECT},
+		{"nothing listening", refusedAddr(t), EXIT_CONNECT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := testAgent(t, test.addr, 1)
+			_, code := runClient(t, func() {
+				agent.Dial("/rfd", false)
+			})
+			if code != test.code {
+				t.Errorf("exited with %d, want %d", code, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// Command is one subcommand of the client, Args is what follows the name in
+// its usage line
+type Command struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     func(args []string)
+}
+
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{"deploy", "[environment] [flags]", "deploy a folder or package, to an environment of deploy.yaml when one is named", deployCommand},
+		{"status", "[flags]", "show what an agent is deploying and the last deploy to each destination", statusCommand},
+		{"history", "[flags]", "list the deploys an agent has made, newest first", historyCommand},
+		{"rollback", "[flags]", "deploy the package a destination had before its current one again", rollbackCommand},
+		{"ls", "[flags]", "list a directory on an agent", listFiles},
+		{"stat", "[flags]", "describe a file or directory on an agent", statFile},
+		{"get", "[flags]", "download a file or directory from an agent", getFiles},
+		{"rm", "[flags]", "delete a file or directory on an agent", deleteFiles},
+		{"exec", "[flags]", "run a command from an agent's allow-list", execCommand},
+		{"ping", "[flags]", "check an agent is reachable and accepts the key, and show its version and capabilities", pingCommand},
+		{"prune", "[flags]", "remove the staged packages an agent's retention settings no longer keep", pruneCommand},
+		{"secret", "set|get|list|rm [flags]", "manage the encrypted secrets an agent's templates and commands refer to", secretCommand},
+		{"ui", "[flags]", "print a one-time login link to an agent's dashboard", uiCommand},
+		{"update", "[flags]", "send an agent a new executable of itself and wait for it to restart into it", updateCommand},
+		{"agents", "[flags]", "list the agents registered with a coordinator", agentsCommand},
+		{"submit", "[flags]", "deploy a folder through a coordinator to every agent a label selector matches", submitCommand},
+		{"jobs", "[flags]", "list a coordinator's jobs, or show one with -id", jobsCommand},
+		{"keygen", "[flags]", "create a signing key pair", keygen},
+		{"keys", "[flags]", "list the signing keys", listKeys},
+		{"version", "", "show the client's version", versionCommand},
+		{"help", "[command]", "show the flags of a command", helpCommand},
+	}
+}
+
+func program() string {
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+}
+
+func findCommand(name string) *Command {
+	for _, command := range commands {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", program())
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", command.Name, command.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s help <command>' for the flags of a command.\n", program())
+}
+
+// newCommandFlags makes the flag set of a command with its own help, usage
+// errors reported through fatalError show it too
+func newCommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		command := findCommand(name)
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n\n%s\n\nflags:\n", program(), command.Name, command.Args, command.Summary)
+		flags.PrintDefaults()
+	}
+	flag.Usage = flags.Usage
+	return flags
+}
+
+func helpCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	command := findCommand(args[0])
+	if command == nil {
+		printUsage()
+		os.Exit(EXIT_USAGE)
+	}
+	command.Run([]string{"-h"})
+}
+
+func versionCommand(args []string) {
+	flags := newCommandFlags("version")
+	format := flags.String("output", "text", "output format: -output json")
+	flags.Parse(args)
+	output = NewOutput(*format)
+	if output.json {
+		output.emitValue(map[string]string{"version": common.VERSION, "go": runtime.Version(), "os": runtime.GOOS + "/" + runtime.GOARCH})
+		return
+	}
+	fmt.Printf("%s %s %s %s/%s\n", program(), common.VERSION, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// deployCommand deploys with the flags given, or with an environment of the
+// deploy file whose settings the flags override
+func deployCommand(args []string) {
+	flags := newCommandFlags("deploy")
+	deploy_flags := newDeployFlags(flags)
+	file := flags.String("f", DEPLOY_FILE, "deploy file that describes the environments")
+	environment := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		environment, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	deploy_flags.global.setOutput()
+
+	if len(environment) > 0 {
+		deploy_file, err := LoadDeployFile(*file)
+		if err != nil {
+			fatalError(false, "%v", err)
+		}
+		env, err := deploy_file.Environment(environment)
+		if err != nil {
+			fatalError(false, "%v", err)
+		}
+		deploy_flags.apply(deploy_file, env)
+	}
+	deploy(deploy_flags.options())
+}
+
+// AgentPing is the result of ping, the agent's own report and how it looks
+// from the client
+type AgentPing struct {
+	common.AgentInfo
+	Addr        string `json:"addr"`
+	RoundTripMs int64  `json:"round_trip_ms"`
+	ClockOffset string `json:"clock_offset"`
+}
+
+func pingCommand(args []string) {
+	flags := newCommandFlags("ping")
+	global := addGlobalFlags(flags)
+	flags.Parse(args)
+	global.setOutput()
+	agent := global.agent()
+
+	started := time.Now()
+	var info common.AgentInfo
+	agent.Get(common.PING_PATH, nil, &info)
+	round_trip := time.Since(started)
+	// the agent's clock is compared with the middle of the round trip
+	offset := info.Time.Sub(started.Add(round_trip / 2)).Round(time.Second)
+	ping := AgentPing{AgentInfo: info, Addr: agent.addr, RoundTripMs: round_trip.Milliseconds(), ClockOffset: offset.String()}
+	if output.json {
+		output.emitValue(ping)
+		return
+	}
+	fmt.Printf("agent: %s version %s on %s (%s)\n", agent.addr, info.Version, info.Hostname, info.OS)
+	fmt.Printf("capabilities: %s\n", strings.Join(info.Capabilities, ", "))
+	fmt.Printf("round trip: %s, clock offset: %s\n", round_trip.Round(time.Millisecond), offset)
+	if offset > common.AUTH_WINDOW/2 || offset < -common.AUTH_WINDOW/2 {
+		fmt.Printf("warning: requests are refused when the clocks are %s apart\n", common.AUTH_WINDOW)
+	}
+}
+
+// pruneCommand applies the agent's retention settings to its staged packages
+// now rather than at the janitor's next run, -dry-run shows what would go
+func pruneCommand(args []string) {
+	flags := newCommandFlags("prune")
+	global := addGlobalFlags(flags)
+	dry_run := flags.Bool("dry-run", false, "only show what would be removed and how much it would free")
+	flags.Parse(args)
+	global.setOutput()
+	agent := global.agent()
+
+	var result common.PruneResult
+	method := http.MethodPost
+	if *dry_run {
+		method = http.MethodGet
+	}
+	decodeResponse(agent.Request(method, common.PRUNE_PATH, nil), &result)
+	if output.json {
+		output.emitValue(result)
+		return
+	}
+	for _, item := range result.Removed {
+		name := item.Name
+		if len(item.Digest) > 12 {
+			name = item.Digest[:12]
+		}
+		release := item.Release
+		if len(release) == 0 {
+			release = "-"
+		}
+		fmt.Printf("%-12s %-12s %10s  %s\n", name, release, common.FormatBytes(item.Size), item.Reason)
+		if len(item.Error) > 0 {
+			fmt.Printf("  not removed: %s\n", item.Error)
+		}
+	}
+	action := "removed"
+	if result.DryRun {
+		action = "would remove"
+	}
+	fmt.Printf("%s %d staged files freeing %s, %d packages kept using %s\n", action, len(result.Removed), common.FormatBytes(result.Freed), result.Kept, common.FormatBytes(result.KeptBytes))
+}
+
+// updateCommand sends an agent a new executable signed with the key, which
+// must be one of the agent's update keys. The agent restarts into it and
+// restores the previous executable if the new one does not start, the
+// command follows the agent's status until one or the other is running.
+func updateCommand(args []string) {
+	flags := newCommandFlags("update")
+	global := addGlobalFlags(flags)
+	exe := flags.String("exe", "", "the new agent executable, required: -exe build\\agent.exe")
+	wait := flags.Duration("wait", 3*time.Minute, "how long to wait for the agent to restart: -wait 5m")
+	flags.Parse(args)
+	global.setOutput()
+	if len(*exe) == 0 {
+		fatalError(true, "exe is required")
+	}
+	data, err := os.ReadFile(*exe)
+	if err != nil {
+		fatalError(false, "failed to read %s: %v", *exe, err)
+	}
+	agent := global.agent()
+
+	var info common.AgentInfo
+	agent.Get(common.PING_PATH, nil, &info)
+	if !hasCapability(info, common.CAP_UPDATE) {
+		output.Fail(EXIT_USAGE, fmt.Sprintf("agent %s version %s cannot update itself", agent.addr, info.Version), nil)
+	}
+	digest := common.Digest(data)
+	signature := common.FormatSignature(agent.key.Public().(ed25519.PublicKey), common.SignDigest(agent.key, digest))
+	output.Phase("uploading", fmt.Sprintf("%s (%s) to %s", filepath.Base(*exe), common.FormatBytes(len(data)), agent.addr))
+	var update common.AgentUpdate
+	decodeResponse(agent.Send(http.MethodPut, common.UPDATE_PATH, nil, http.Header{common.SIGNATURE_HEADER: {signature}}, data), &update)
+	output.Phase("restarting", fmt.Sprintf("from version %s to %s", update.From, update.To))
+
+	// the agent is unreachable while it restarts, and for the update timeout
+	// if the new executable fails and the previous one is restored
+	if agent.retries < 10 {
+		agent.retries = 10
+	}
+	deadline := time.Now().Add(*wait)
+	for {
+		time.Sleep(time.Second)
+		var status common.AgentStatus
+		agent.Get(common.STATUS_PATH, nil, &status)
+		current := status.Update
+		if current != nil && current.Digest == update.Digest && current.Started.Equal(update.Started) && current.Finished != nil {
+			if output.json {
+				output.emitValue(current)
+			}
+			if current.Status != common.UPDATE_HEALTHY {
+				output.FailRemote(common.FormatError(common.ERROR_EXEC, fmt.Errorf("update to %s failed, the agent is back on %s: %s", current.To, status.Version, current.Error)))
+			}
+			if !output.json {
+				fmt.Printf("agent: %s updated from version %s to %s\n", agent.addr, current.From, status.Version)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			output.Fail(EXIT_CONNECT, fmt.Sprintf("agent %s did not finish the update within %s", agent.addr, *wait), nil)
+		}
+	}
+}
+
+func hasCapability(info common.AgentInfo, capability string) bool {
+	for _, c := range info.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// uiCommand signs a link that logs a browser in to the agent's dashboard, the
+// agent takes it once and within the auth window
+func uiCommand(args []string) {
+	flags := newCommandFlags("ui")
+	global := addGlobalFlags(flags)
+	flags.Parse(args)
+	global.setOutput()
+	agent := global.agent()
+
+	link := agent.url("http", common.UI_LOGIN_PATH, common.SignLogin(agent.key))
+	if output.json {
+		output.emitValue(map[string]string{"url": link.String(), "expires": time.Now().Add(common.AUTH_WINDOW).UTC().Format(time.RFC3339)})
+		return
+	}
+	fmt.Println(link.String())
+	fmt.Fprintf(os.Stderr, "open the link within %s, it logs in once\n", common.AUTH_WINDOW)
+}
+
+func statusCommand(args []string) {
+	flags := newCommandFlags("status")
+	global := addGlobalFlags(flags)
+	flags.Parse(args)
+	global.setOutput()
+	agent := global.agent()
+
+	var status common.AgentStatus
+	agent.Get(common.STATUS_PATH, nil, &status)
+	if output.json {
+		output.emitValue(status)
+		return
+	}
+	fmt.Printf("agent: %s version %s\n", agent.addr, status.Version)
+	active := "none"
+	if len(status.Active) > 0 {
+		active = strings.Join(status.Active, ", ")
+	}
+	fmt.Printf("deploying to: %s, %d waiting\n", active, status.Waiting)
+	for _, entry := range status.Destinations {
+		printHistoryEntry(entry)
+	}
+}
+
+func historyCommand(args []string) {
+	flags := newCommandFlags("history")
+	global := addGlobalFlags(flags)
+	destination := flags.String("dst", "", "only deploys to this destination: -dst c:\\sites\\app")
+	limit := flags.Int("limit", 20, "number of deploys to list")
+	flags.Parse(args)
+	global.setOutput()
+	agent := global.agent()
+
+	var entries []common.HistoryEntry
+	agent.Get(common.HISTORY_PATH, url.Values{"dst": {*destination}, "limit": {strconv.Itoa(*limit)}}, &entries)
+	if output.json {
+		output.emitValue(entries)
+		return
+	}
+	for _, entry := range entries {
+		printHistoryEntry(entry)
+	}
+}
+
+func printHistoryEntry(entry common.HistoryEntry) {
+	digest := entry.Digest
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	release := entry.Release
+	if len(release) == 0 {
+		release = "-"
+	}
+	fmt.Printf("%s  %-6s %-8s %-12s %-12s %10s  %-10s %s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Status, entry.Kind, release, digest, common.FormatBytes(entry.Size), entry.Signer, entry.Destination)
+	if len(entry.Error) > 0 {
+		fmt.Printf("  %s\n", entry.Error)
+	}
+}
+
+// rollbackCommand redeploys a package the agent still has staged, by default
+// the one each destination had before its current one
+func rollbackCommand(args []string) {
+	flags := newCommandFlags("rollback")
+	global := addGlobalFlags(flags)
+	var destinations Destinations
+	flags.Var(&destinations, "dst", "destination to roll back, multiple can be specified: -dst c:\\sites\\app")
+	to := flags.String("to", "", "digest, or the start of one, of the package to roll back to instead of the previous one")
+	wait := flags.Bool("wait", false, "wait in the agent's queue when a destination is busy instead of failing")
+	flags.Parse(args)
+	global.setOutput()
+	if len(destinations) == 0 {
+		fatalError(true, "dst is required")
+	}
+	agent := global.agent()
+
+	bytes_sent, items := 0, 0
+	for _, destination := range destinations {
+		release := findRelease(agent, destination, strings.ToLower(*to))
+		digest, _ := hex.DecodeString(release.Digest)
+		// a rollback goes back to an older release on purpose
+		meta := common.DeployMeta{Destinations: []string{destination}, Digest: release.Digest, Wait: *wait, Release: release.Release, Vars: release.Vars, Force: true}
+		deployTo(agent, DeployOptions{meta: meta}, meta, nil, bytes.NewBuffer(nil), digest)
+		bytes_sent += release.Size
+		items += release.Items
+	}
+	output.Summary(bytes_sent, items, len(destinations))
+}
+
+// findRelease picks the release to roll back to from the destination's
+// history, the latest one with a different package than the current one
+// unless a digest is given
+func findRelease(agent *Agent, destination string, to string) common.HistoryEntry {
+	var entries []common.HistoryEntry
+	agent.Get(common.HISTORY_PATH, url.Values{"dst": {destination}, "limit": {"0"}}, &entries)
+	current := ""
+	for _, entry := range entries {
+		if entry.Status != "ok" {
+			continue
+		}
+		if len(to) > 0 {
+			if strings.HasPrefix(entry.Digest, to) {
+				return entry
+			}
+			continue
+		}
+		if len(current) == 0 {
+			current = entry.Digest
+		} else if entry.Digest != current {
+			return entry
+		}
+	}
+	if len(to) == 64 {
+		return common.HistoryEntry{Digest: to}
+	}
+	if len(to) > 0 {
+		output.Fail(EXIT_USAGE, fmt.Sprintf("no deploy of %s to %s in the history", to, destination), nil)
+	}
+	output.Fail(EXIT_USAGE, "no earlier release of "+destination+" to roll back to", nil)
+	return common.HistoryEntry{}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a WebSocket to an agent with a deadline on every read and write.
+// Both sides ping, and each ping or pong pushes the read deadline back, so a
+// long quiet extraction is fine but an agent that goes away is noticed.
+type Conn struct {
+	*websocket.Conn
+	addr          string
+	timeout       time.Duration
+	write_timeout time.Duration
+	stop          chan struct{}
+	stop_once     sync.Once
+}
+
+func newConn(conn *websocket.Conn, addr string, timeout time.Duration, write_timeout time.Duration) *Conn {
+	c := &Conn{Conn: conn, addr: addr, timeout: timeout, write_timeout: write_timeout, stop: make(chan struct{})}
+	conn.SetPingHandler(func(data string) error {
+		c.extend()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(write_timeout))
+		if net_err, ok := err.(net.Error); err == websocket.ErrCloseSent || ok && net_err.Timeout() {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(string) error {
+		c.extend()
+		return nil
+	})
+	go c.heartbeat()
+	return c
+}
+
+func (c *Conn) extend() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+}
+
+// heartbeat pings three times per timeout so one lost pong is not fatal
+func (c *Conn) heartbeat() {
+	ticker := time.NewTicker(c.timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.write_timeout)); err != nil {
+				return
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// ReadMessage waits at most the timeout for the agent, a timeout is reported
+// as the agent having gone away rather than as an i/o error
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	c.extend()
+	message_type, data, err := c.Conn.ReadMessage()
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		err = fmt.Errorf("no answer from %s for %s, the agent or the network is down", c.addr, c.timeout)
+	}
+	return message_type, data, err
+}
+
+func (c *Conn) WriteMessage(message_type int, data []byte) error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(c.write_timeout))
+	err := c.Conn.WriteMessage(message_type, data)
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		err = fmt.Errorf("%s stopped accepting data for %s, the agent or the network is down", c.addr, c.write_timeout)
+	}
+	return err
+}
+
+func (c *Conn) Close() error {
+	c.stop_once.Do(func() { close(c.stop) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+// Params are the -arg name=value pairs for a command's argument templates
+type Params map[string]string
+
+func (p Params) String() string {
+	return "command arguments"
+}
+
+func (p Params) Set(value string) error {
+	name, arg, ok := strings.Cut(value, "=")
+	if !ok || len(name) == 0 {
+		return fmt.Errorf("expected name=value: %s", value)
+	}
+	p[name] = arg
+	return nil
+}
+
+// execCommand runs one of the agent's allowed commands, printing its output as
+// it arrives. A command that fails exits with EXIT_EXEC and reports its code.
+func execCommand(args []string) {
+	flags := newCommandFlags("exec")
+	global := addGlobalFlags(flags)
+	name := flags.String("cmd", "", "command from the agent's allow-list: -cmd recycle")
+	dir := flags.String("dir", "", "directory to run the command in: -dir c:\\sites\\app")
+	params := Params{}
+	flags.Var(params, "arg", "value for the command's arguments, multiple can be specified: -arg pool=app")
+	flags.Parse(args)
+
+	global.setOutput()
+	if len(*name) == 0 {
+		fatalError(true, "cmd is required")
+	}
+	if len(*dir) == 0 {
+		fatalError(true, "dir is required")
+	}
+	agent := global.agent()
+
+	code := runRemoteCommand(agent, common.ExecRequest{Command: *name, Dir: *dir, Params: params})
+	output.Exit(*name, code)
+}
+
+// runRemoteCommand runs the request on the agent, passing its output on as
+// it arrives, and returns the command's exit code
+func runRemoteCommand(agent *Agent, request common.ExecRequest) int {
+	conn := agent.Dial(common.EXEC_PATH, false)
+	defer conn.Close()
+
+	message, err := common.FormatExec(request)
+	if err == nil {
+		err = conn.WriteMessage(websocket.TextMessage, []byte(message))
+	}
+	if err != nil {
+		output.Fail(EXIT_TRANSFER, "failed to write command to web socket", err)
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			output.Fail(EXIT_TRANSFER, "connection closed before the command finished", err)
+		}
+		switch text := string(message); {
+		case strings.HasPrefix(text, common.STDOUT_BAR):
+			output.Stream("stdout", os.Stdout, text[len(common.STDOUT_BAR):])
+		case strings.HasPrefix(text, common.STDERR_BAR):
+			output.Stream("stderr", os.Stderr, text[len(common.STDERR_BAR):])
+		case strings.HasPrefix(text, common.ERROR_BAR):
+			output.FailRemote(text)
+		case strings.HasPrefix(text, common.EXIT_BAR):
+			code, err := strconv.Atoi(text[len(common.EXIT_BAR):])
+			if err != nil {
+				output.Fail(EXIT_TRANSFER, "agent sent an invalid exit code", err)
+			}
+			logger.Info("command exited", "agent", agent.addr, "command", request.Command, "dir", request.Dir, "code", code)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return code
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"remote_deploy/common"
+)
+
+// fileFlags are shared by the ls, stat, get and rm subcommands
+type fileFlags struct {
+	flags  *flag.FlagSet
+	global *globalFlags
+	path   *string
+}
+
+func newFileFlags(name string, usage string) *fileFlags {
+	flags := newCommandFlags(name)
+	return &fileFlags{
+		flags:  flags,
+		global: addGlobalFlags(flags),
+		path:   flags.String("path", "", usage),
+	}
+}
+
+func (file_flags *fileFlags) parse(args []string) *Agent {
+	file_flags.flags.Parse(args)
+	file_flags.global.setOutput()
+	if len(*file_flags.path) == 0 {
+		fatalError(true, "path is required")
+	}
+	return file_flags.global.agent()
+}
+
+func pathQuery(remote_path string) url.Values {
+	return url.Values{"path": {remote_path}}
+}
+
+func listFiles(args []string) {
+	file_flags := newFileFlags("ls", "directory to list: -path c:\\sites\\app")
+	agent := file_flags.parse(args)
+
+	var entries []common.FileEntry
+	agent.Get(common.FS_LIST, pathQuery(*file_flags.path), &entries)
+	if output.json {
+		output.emitValue(entries)
+		return
+	}
+	for _, entry := range entries {
+		printFileEntry(entry)
+	}
+}
+
+func statFile(args []string) {
+	file_flags := newFileFlags("stat", "file or directory to describe: -path c:\\sites\\app\\web.config")
+	agent := file_flags.parse(args)
+
+	var entry common.FileEntry
+	agent.Get(common.FS_STAT, pathQuery(*file_flags.path), &entry)
+	if output.json {
+		output.emitValue(entry)
+		return
+	}
+	printFileEntry(entry)
+}
+
+func printFileEntry(entry common.FileEntry) {
+	size := common.FormatBytes(int(entry.Size))
+	if entry.Dir {
+		size = "-"
+	}
+	fmt.Printf("%s %12s %s %s\n", entry.Mode, size, entry.ModTime.Format("2006-01-02 15:04:05"), entry.Name)
+}
+
+// getFiles downloads a file or directory as a tar.gz, or extracts it into a
+// local directory with -extract
+func getFiles(args []string) {
+	file_flags := newFileFlags("get", "file or directory to download: -path c:\\sites\\app\\logs")
+	out := file_flags.flags.String("out", "", "tar.gz file to save to, defaults to the remote name")
+	extract := file_flags.flags.String("extract", "", "directory to extract into instead of saving the tar.gz")
+	agent := file_flags.parse(args)
+
+	response := agent.Request(http.MethodGet, common.FS_GET, pathQuery(*file_flags.path))
+	defer response.Body.Close()
+
+	if len(*extract) > 0 {
+		output.Phase("extracting", *extract)
+		if err := common.Uncompress(response.Body, *extract, output.Progress("extract", common.ProgressEachValue)); err != nil {
+			output.Fail(EXIT_EXTRACT, "failed to extract to "+*extract, err)
+		}
+		return
+	}
+
+	if len(*out) == 0 {
+		*out = path.Base(strings.ReplaceAll(*file_flags.path, "\\", "/")) + ".tar.gz"
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		output.Fail(EXIT_USAGE, "failed to create "+*out, err)
+	}
+	defer file.Close()
+	output.Phase("downloading", *out)
+	count, err := io.Copy(file, response.Body)
+	if err != nil {
+		output.Fail(EXIT_TRANSFER, "failed to download "+*file_flags.path, err)
+	}
+	output.Phase("saved", fmt.Sprintf("%s %s", *out, common.FormatBytes(int(count))))
+}
+
+func deleteFiles(args []string) {
+	file_flags := newFileFlags("rm", "file or directory to delete: -path c:\\sites\\app\\old")
+	agent := file_flags.parse(args)
+
+	response := agent.Request(http.MethodDelete, common.FS_DELETE, pathQuery(*file_flags.path))
+	response.Body.Close()
+	output.Phase("deleted", *file_flags.path)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// JOB_POLL_INTERVAL is how often submit asks the coordinator how a job is going
+const JOB_POLL_INTERVAL = time.Second
+
+// the fleet commands talk to a coordinator rather than an agent, -addr is the
+// coordinator's address and the same keys sign the requests
+
+func agentsCommand(args []string) {
+	flags := newCommandFlags("agents")
+	global := addGlobalFlags(flags)
+	selector := flags.String("selector", "", "only the agents with these labels: -selector role=web,env=prod")
+	flags.Parse(args)
+	global.setOutput()
+	coordinator := global.agent()
+
+	query := url.Values{}
+	if len(*selector) > 0 {
+		if _, err := common.ParseSelector(*selector); err != nil {
+			validationError("%v", err)
+		}
+		query.Set("selector", *selector)
+	}
+	var agents []common.FleetAgent
+	coordinator.Get(common.COORD_AGENTS, query, &agents)
+	if output.json {
+		output.emitValue(agents)
+		return
+	}
+	if len(agents) == 0 {
+		fmt.Println("no agents")
+		return
+	}
+	for _, agent := range agents {
+		state := "online"
+		if !agent.Online {
+			state = "offline"
+		}
+		fmt.Printf("%-20s %-7s %-22s %-8s last seen %s ago\n", agent.Name, state, agent.Addr, agent.Version, time.Since(agent.LastSeen).Round(time.Second))
+		fmt.Printf("  labels: %s\n", common.Selector(agent.Labels))
+		if len(agent.Destinations) > 0 {
+			fmt.Printf("  destinations: %s\n", strings.Join(agent.Destinations, ", "))
+		}
+		if len(agent.Active) > 0 {
+			fmt.Printf("  deploying to: %s\n", strings.Join(agent.Active, ", "))
+		}
+	}
+}
+
+// submitCommand uploads a folder to the coordinator and deploys it to every
+// agent the selector matches, following the job until it finishes
+func submitCommand(args []string) {
+	flags := newCommandFlags("submit")
+	global := addGlobalFlags(flags)
+	src := flags.String("src", "", "source: folder to deploy is required; -src c:\\dir1\\dir2")
+	var destinations Destinations
+	flags.Var(&destinations, "dst", "destinations on each agent: multiple can be specified, one is required; -dst c:\\sites\\app")
+	selector := flags.String("selector", "", "labels of the agents to deploy to, required: -selector role=web,env=prod")
+	wait := flags.Bool("wait", false, "wait in each agent's queue when a destination is busy instead of failing")
+	mirror := flags.Bool("mirror", false, "delete files in the destinations that are not in the package")
+	parallel := flags.Int("parallel", 0, "agents deployed to at once, 0 for the coordinator's limit")
+	detach := flags.Bool("detach", false, "print the job and return without following it")
+	release := flags.String("release", "", "label the agents record for the deploy, the git commit of -src by default: -release v1.4.2")
+	force := flags.Bool("force", false, "deploy even when a destination is on a newer release")
+	var vars Vars
+	flags.Var(&vars, "var", "a value for the templates the agents render, multiple can be specified: -var db_host=sql01")
+	flags.Parse(args)
+	global.setOutput()
+	if len(*src) == 0 {
+		fatalError(true, "src is required")
+	}
+	if len(destinations) == 0 {
+		fatalError(true, "dst is required")
+	}
+	if _, err := common.ParseSelector(*selector); err != nil {
+		validationError("selector: %v", err)
+	}
+	if *parallel < 0 {
+		validationError("invalid parallel: %d", *parallel)
+	}
+	validate_dir_exists(*src)
+	if len(*release) == 0 {
+		*release = gitRelease(*src)
+	}
+	if strings.ContainsAny(*release, " \t\r\n") {
+		validationError("invalid release: %q", *release)
+	}
+	coordinator := global.agent()
+
+	output.Phase("compressing", *src)
+	buffer := new(bytes.Buffer)
+	manifest, err := common.Compress(*src, buffer, output.Progress("compress", common.ProgressEachRate))
+	if err != nil {
+		output.Fail(EXIT_USAGE, "failed to compress "+*src, err)
+	}
+	digest := common.Digest(buffer.Bytes())
+	signature := common.FormatSignature(coordinator.key.Public().(ed25519.PublicKey), common.SignDigest(coordinator.key, digest))
+
+	output.Phase("uploading", fmt.Sprintf("%s to %s", common.FormatBytes(buffer.Len()), coordinator.addr))
+	var stored common.PackageInfo
+	decodeResponse(coordinator.Send(http.MethodPut, common.COORD_PACKAGES, nil, http.Header{common.SIGNATURE_HEADER: {signature}}, buffer.Bytes()), &stored)
+
+	var job common.Job
+	coordinator.Post(common.COORD_JOBS, common.JobRequest{
+		Digest:       stored.Digest,
+		Selector:     *selector,
+		Destinations: destinations,
+		Wait:         *wait,
+		Mirror:       *mirror,
+		Parallel:     *parallel,
+		Release:      *release,
+		Force:        *force,
+		Vars:         vars,
+	}, &job)
+	logger.Info("job submitted", "job", job.ID, "digest", stored.Digest, "selector", job.Request.Selector)
+	output.Phase("submitted", fmt.Sprintf("job %s to %d agents matching %s", job.ID, len(job.Results), job.Request.Selector))
+	if *detach {
+		if output.json {
+			output.emitValue(job)
+		}
+		return
+	}
+
+	job = followJob(coordinator, job)
+	if output.json {
+		output.emitValue(job)
+	}
+	if job.Status != common.JOB_DONE {
+		failJob(job)
+	}
+	output.Summary(stored.Size, manifest.Items, countCompleted(job))
+}
+
+// followJob polls the job until it finishes, reporting each agent as its
+// status changes, or on a terminal with a line for each agent
+func followJob(coordinator *Agent, job common.Job) common.Job {
+	if output.tty && !output.json {
+		return followJobLines(coordinator, job)
+	}
+	reported := make(map[string]string)
+	for {
+		for _, result := range job.Results {
+			if reported[result.Agent] == result.Status {
+				continue
+			}
+			reported[result.Agent] = result.Status
+			message := result.Agent + " " + result.Status
+			if len(result.Error) > 0 {
+				message += ": " + result.Error
+			}
+			output.Phase("agent", message)
+		}
+		if job.Finished != nil {
+			return job
+		}
+		time.Sleep(JOB_POLL_INTERVAL)
+		coordinator.Get(common.COORD_JOBS, url.Values{"id": {job.ID}}, &job)
+	}
+}
+
+// followJobLines redraws a line for each agent with its status and how many
+// of the destinations it has deployed, while the job runs
+func followJobLines(coordinator *Agent, job common.Job) common.Job {
+	lines := common.NewMultiProgress(os.Stdout)
+	bars := make(map[string]*common.ProgressInfo)
+	for {
+		sort.Slice(job.Results, func(i, j int) bool { return job.Results[i].Agent < job.Results[j].Agent })
+		for _, result := range job.Results {
+			bar := bars[result.Agent]
+			if bar == nil {
+				bar = lines.Bar(common.ProgressEachValue)
+				bars[result.Agent] = bar
+			}
+			message := fmt.Sprintf("%-20s %-8s %s", result.Agent, result.Status, jobResultDetail(result))
+			if result.Status == common.JOB_PENDING || result.Status == common.JOB_RUNNING {
+				bar.Write(len(result.Completed), len(job.Request.Destinations), message)
+			} else {
+				bar.Writeln(len(result.Completed), len(job.Request.Destinations), message)
+			}
+		}
+		if job.Finished != nil {
+			return job
+		}
+		time.Sleep(JOB_POLL_INTERVAL)
+		coordinator.Get(common.COORD_JOBS, url.Values{"id": {job.ID}}, &job)
+	}
+}
+
+// failJob exits with the code of the first agent that failed
+func failJob(job common.Job) {
+	for _, result := range job.Results {
+		if result.Status == common.JOB_FAILED {
+			output.FailRemote(common.ERROR_BAR + result.Kind + ": " + fmt.Sprintf("job %s failed on %s: %s", job.ID, result.Agent, result.Error))
+		}
+	}
+	output.Fail(EXIT_TRANSFER, fmt.Sprintf("job %s deployed to no agent", job.ID), nil)
+}
+
+func countCompleted(job common.Job) int {
+	count := 0
+	for _, result := range job.Results {
+		count += len(result.Completed)
+	}
+	return count
+}
+
+// jobsCommand lists the coordinator's jobs, or shows one with -id
+func jobsCommand(args []string) {
+	flags := newCommandFlags("jobs")
+	global := addGlobalFlags(flags)
+	id := flags.String("id", "", "show this job and the result on each agent")
+	flags.Parse(args)
+	global.setOutput()
+	coordinator := global.agent()
+
+	if len(*id) > 0 {
+		var job common.Job
+		coordinator.Get(common.COORD_JOBS, url.Values{"id": {*id}}, &job)
+		if output.json {
+			output.emitValue(job)
+			return
+		}
+		printJob(job)
+		sort.Slice(job.Results, func(i, j int) bool { return job.Results[i].Agent < job.Results[j].Agent })
+		for _, result := range job.Results {
+			fmt.Printf("  %-20s %-8s %s\n", result.Agent, result.Status, jobResultDetail(result))
+		}
+		return
+	}
+	var jobs []common.Job
+	coordinator.Get(common.COORD_JOBS, nil, &jobs)
+	if output.json {
+		output.emitValue(jobs)
+		return
+	}
+	if len(jobs) == 0 {
+		fmt.Println("no jobs")
+	}
+	for _, job := range jobs {
+		printJob(job)
+	}
+}
+
+func printJob(job common.Job) {
+	counts := make(map[string]int)
+	for _, result := range job.Results {
+		counts[result.Status]++
+	}
+	fmt.Printf("%s  %-8s %s  %s to %s on %s, by %s: %d done, %d failed, %d skipped\n",
+		job.ID, job.Status, job.Created.Local().Format("2006-01-02 15:04:05"), job.Request.Digest[:12], strings.Join(job.Request.Destinations, ", "),
+		job.Request.Selector, job.Submitter, counts[common.JOB_DONE], counts[common.JOB_FAILED], counts[common.JOB_SKIPPED])
+}
+
+func jobResultDetail(result common.JobResult) string {
+	if len(result.Error) > 0 {
+		return result.Error
+	}
+	if result.Status == common.JOB_RUNNING {
+		return result.Progress
+	}
+	return strings.Join(result.Completed, ", ")
+}
@@ -7,3 +7,5 @@ require github.com/gorilla/websocket v1.5.0
 replace remote_deploy/common => ../common
 
 require remote_deploy/common v0.1.0
+
+require gopkg.in/yaml.v3 v3.0.1
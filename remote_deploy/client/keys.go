@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"remote_deploy/common"
+)
+
+func defaultKeyDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "remote_deploy", "keys")
+}
+
+func defaultKeyPath() string {
+	return filepath.Join(defaultKeyDir(), "default.key")
+}
+
+// keygen creates a new signing key pair, the .pub file is what gets appended
+// to the trusted_keys file on each Deploy Agent
+func keygen(args []string) {
+	flags := newCommandFlags("keygen")
+	name := flags.String("name", "default", "name of the key pair: -name build01")
+	dir := flags.String("dir", defaultKeyDir(), "directory to write the key pair to")
+	flags.Parse(args)
+
+	private_path, public_path, err := common.GenerateKeyPair(*dir, *name)
+	if err != nil {
+		fatalError(false, "%v", err)
+	}
+	key, err := common.LoadPrivateKey(private_path)
+	if err != nil {
+		fatalError(false, "%v", err)
+	}
+	fmt.Println("private key:", private_path)
+	fmt.Println("public key: ", public_path)
+	fmt.Println("fingerprint:", common.Fingerprint(key.Public().(ed25519.PublicKey)))
+}
+
+// listKeys prints every public key in the key directory with its fingerprint
+func listKeys(args []string) {
+	flags := newCommandFlags("keys")
+	dir := flags.String("dir", defaultKeyDir(), "directory to list key pairs from")
+	flags.Parse(args)
+
+	files, err := filepath.Glob(filepath.Join(*dir, "*.pub"))
+	if err != nil {
+		fatalError(false, "%v", err)
+	}
+	if len(files) == 0 {
+		fmt.Println("no keys found in", *dir)
+		return
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fatalError(false, "%v", err)
+		}
+		key, err := common.ParsePublicKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			continue
+		}
+		fmt.Printf("%-20s %s\n", strings.TrimSuffix(filepath.Base(file), ".pub"), common.Fingerprint(key.Key))
+	}
+}
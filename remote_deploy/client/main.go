@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,21 +31,165 @@ func (i *Destinations) Set(value string) error {
 	return nil
 }
 
-var destinations Destinations
+// Vars are the -var name=value flags, values for the templates of a package
+type Vars map[string]string
+
+func (vars *Vars) String() string {
+	return "template values"
+}
+
+func (vars *Vars) Set(value string) error {
+	name, value, found := strings.Cut(value, "=")
+	if !found {
+		return errors.New("a var is name=value")
+	}
+	if err := common.ValidateVarName(name); err != nil {
+		return err
+	}
+	if *vars == nil {
+		*vars = make(Vars)
+	}
+	(*vars)[name] = value
+	return nil
+}
 
 func main() {
-	addr := flag.String("addr", "", "Address of remote server: -addr <domain or ip>:port")
-	src := flag.String("src", "", "source: folder to deploy is required; -src c:\\dir1\\dir2")
-	flag.Var(&destinations, "dst", "destinations: multiple can be specified, one is required; -dst \\\\server1\\c$\\dir1\\dir2")
-	flag.Parse()
+	args := os.Args[1:]
+	// flags without a command are a deploy, as they were before commands
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" {
+		args = append([]string{"deploy"}, args...)
+	}
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(EXIT_USAGE)
+	}
+	command := findCommand(args[0])
+	if command == nil {
+		printUsage()
+		os.Exit(EXIT_USAGE)
+	}
+	command.Run(args[1:])
+}
+
+// deployFlags are the flags of a deploy, they can also be filled in from an
+// environment of deploy.yaml
+type deployFlags struct {
+	flags          *flag.FlagSet
+	global         *globalFlags
+	src            *string
+	destinations   Destinations
+	rate           *string
+	chunk          *string
+	ws_compress    *bool
+	wait           *bool
+	package_url    *string
+	package_digest *string
+	mirror         *bool
+	dry_run        *bool
+	release        *string
+	force          *bool
+	vars           Vars
+	agents         []string
+	filter         *common.Filter
+	hooks          Hooks
+	hooks_dir      string
+}
 
-	if len(*src) == 0 {
-		fatalError(true, "src is required")
+func newDeployFlags(flags *flag.FlagSet) *deployFlags {
+	deploy_flags := &deployFlags{flags: flags, global: addGlobalFlags(flags)}
+	deploy_flags.src = flags.String("src", "", "source: folder to deploy is required; -src c:\\dir1\\dir2")
+	flags.Var(&deploy_flags.destinations, "dst", "destinations: multiple can be specified, one is required; -dst \\\\server1\\c$\\dir1\\dir2")
+	deploy_flags.rate = flags.String("rate", "0", "upload bandwidth limit, 0 is unlimited: -rate 5MB/s")
+	deploy_flags.chunk = flags.String("chunk", "auto", "upload chunk size, auto tunes it from the round trip: -chunk 64KB")
+	deploy_flags.ws_compress = flags.Bool("ws-compress", false, "enable WebSocket per-message compression")
+	deploy_flags.wait = flags.Bool("wait", false, "wait in the agent's queue when a destination is busy instead of failing")
+	deploy_flags.package_url = flags.String("url", "", "pull deploy: the agent fetches the package instead of -src; -url https://artifacts/app.tar.gz or -url \\\\share\\app.tar.gz")
+	deploy_flags.package_digest = flags.String("digest", "", "sha256 of the -url package in hex, required with -url")
+	deploy_flags.mirror = flags.Bool("mirror", false, "delete files in the destinations that are not in the package")
+	deploy_flags.dry_run = flags.Bool("dry-run", false, "report what the deploy would create, overwrite and delete without writing anything")
+	deploy_flags.release = flags.String("release", "", "label the agents record for the deploy, the git commit of -src by default: -release v1.4.2")
+	deploy_flags.force = flags.Bool("force", false, "deploy even when a destination is on a newer release")
+	flags.Var(&deploy_flags.vars, "var", "a value for the templates the agents render, multiple can be specified: -var db_host=sql01")
+	return deploy_flags
+}
+
+// DeployOptions is a validated deploy, it is sent to each agent in turn
+type DeployOptions struct {
+	agents       []*Agent
+	src          string
+	destinations []string
+	send         SendOptions
+	ws_compress  bool
+	meta         common.DeployMeta
+	filter       *common.Filter
+	hooks        Hooks
+	hooks_dir    string
+}
+
+// options validates the flags, exiting on the first problem
+func (deploy_flags *deployFlags) options() DeployOptions {
+	deploy_flags.global.setOutput()
+
+	options := DeployOptions{
+		src:          *deploy_flags.src,
+		destinations: deploy_flags.destinations,
+		ws_compress:  *deploy_flags.ws_compress,
+		filter:       deploy_flags.filter,
+		hooks:        deploy_flags.hooks,
+		hooks_dir:    deploy_flags.hooks_dir,
+		meta:         common.DeployMeta{Destinations: deploy_flags.destinations, Wait: *deploy_flags.wait, Mirror: *deploy_flags.mirror, DryRun: *deploy_flags.dry_run, Release: *deploy_flags.release, Force: *deploy_flags.force, Vars: deploy_flags.vars},
+	}
+	addrs := deploy_flags.agents
+	if len(*deploy_flags.global.addr) > 0 {
+		addrs = []string{*deploy_flags.global.addr}
+	}
+	if len(addrs) == 0 {
+		fatalError(true, "addr is required")
+	}
+	if len(options.destinations) == 0 {
+		fatalError(true, "dst is required")
 	}
-	validate_dir_exists(*src)
 
-	remote_message_chan := make(chan struct{})
+	pull := len(*deploy_flags.package_url) > 0
+	if pull && options.meta.DryRun {
+		validationError("dry-run needs the package locally, use src instead of url")
+	}
+	if pull {
+		if digest, err := hex.DecodeString(*deploy_flags.package_digest); err != nil || len(digest) != 32 {
+			validationError("digest is required with url and must be a sha256 in hex")
+		}
+		options.meta.Source = *deploy_flags.package_url
+		options.meta.Digest = strings.ToLower(*deploy_flags.package_digest)
+	} else {
+		if len(options.src) == 0 {
+			fatalError(true, "src is required")
+		}
+		validate_dir_exists(options.src)
+		if len(options.meta.Release) == 0 {
+			options.meta.Release = gitRelease(options.src)
+		}
+	}
+	if strings.ContainsAny(options.meta.Release, " \t\r\n") {
+		validationError("invalid release: %q", options.meta.Release)
+	}
+
+	var err error
+	if options.send.rate, err = common.ParseBytes(*deploy_flags.rate); err != nil {
+		validationError("%v", err)
+	}
+	if *deploy_flags.chunk != "auto" {
+		if options.send.chunk_size, err = common.ParseBytes(*deploy_flags.chunk); err != nil || options.send.chunk_size == 0 {
+			validationError("invalid chunk size: %s", *deploy_flags.chunk)
+		}
+	}
 
+	options.agents = deploy_flags.global.agents(addrs)
+	return options
+}
+
+// deploy packages the source once and deploys it to each agent in turn,
+// stopping at the first agent that fails
+func deploy(options DeployOptions) {
 	interrupt_chan := make(chan os.Signal, 1)
 	signal.Notify(interrupt_chan, os.Interrupt)
 
@@ -50,47 +198,240 @@ func main() {
 		os.Exit(0)
 	}()
 
-	fmt.Println("compressing:", *src)
+	var hook_env []string
+	if !options.meta.DryRun && len(options.hooks.Before)+len(options.hooks.After) > 0 {
+		hook_env = hookEnv(options.agents[0], options.hooks.Secrets)
+	}
+	if !options.meta.DryRun {
+		runHooks(options.hooks.Before, options.hooks_dir, hook_env)
+	}
+
 	compress_buffer := bytes.NewBuffer(make([]byte, 0, 1024*1024))
-	compress_progress := common.BeginProgress(common.ProgressEachValue)
-	compress_count, _ := common.Compress(*src, compress_buffer, compress_progress)
+	manifest := new(common.Manifest)
+	meta := options.meta
+	var digest []byte
+	var err error
+	if meta.Fetched() {
+		digest, _ = hex.DecodeString(meta.Digest)
+	} else {
+		output.Phase("compressing", options.src)
+		compress_progress := output.Progress("compress", common.ProgressEachRate)
+		// a dry run only needs the manifest
+		var compress_writer io.Writer = compress_buffer
+		if meta.DryRun {
+			compress_writer = io.Discard
+		}
+		manifest, err = common.CompressFiltered(options.src, compress_writer, options.filter, compress_progress)
+		if err != nil {
+			output.Fail(EXIT_USAGE, "failed to compress "+options.src, err)
+		}
+		meta.Size = compress_buffer.Len()
+		meta.Count = manifest.Items
+		digest = common.Digest(compress_buffer.Bytes())
+	}
 
-	// initialize websocket connection
-	uri := url.URL{Scheme: "ws", Host: *addr, Path: "/rfd"}
-	websocket_conn, _, err := websocket.DefaultDialer.Dial(uri.String(), nil)
-	if err != nil {
-		log.Fatalln("Failed to connect with WebSocket!", err)
+	if len(meta.Release) > 0 {
+		output.Phase("release", meta.Release)
 	}
+	problems := false
+	for _, agent := range options.agents {
+		if deployTo(agent, options, meta, manifest, compress_buffer, digest) {
+			problems = true
+		}
+		if !meta.DryRun {
+			runExecHooks(agent, options.hooks.Exec)
+		}
+	}
+
+	if meta.DryRun {
+		if problems {
+			output.Fail(EXIT_EXTRACT, "the deploy would fail, see the problems above", nil)
+		}
+		return
+	}
+	runHooks(options.hooks.After, options.hooks_dir, hook_env)
+	output.Summary(compress_buffer.Len(), manifest.Items, len(options.agents)*len(options.destinations))
+}
+
+// deployTo sends the package to one agent and waits for it to finish, for a
+// dry run it reports whether the agent's plans have problems. A connection
+// that drops is reopened and the deploy resumed from what the agent has.
+func deployTo(agent *Agent, options DeployOptions, meta common.DeployMeta, manifest *common.Manifest, compress_buffer *bytes.Buffer, digest []byte) (problems bool) {
+	meta.ID = common.NewDeployID()
+	deploy_log := logger.With("deploy", meta.ID, "agent", agent.addr)
+	deploy_log.Info("deploy started", "destinations", strings.Join(meta.Destinations, ";"), "size", meta.Size, "source", meta.Source, "digest", meta.Digest, "dry_run", meta.DryRun)
+	output.Phase("connecting", agent.addr)
+	for attempt := 0; ; attempt++ {
+		// a dry run has nothing on the agent to resume and starts over
+		resume := attempt > 0 && !meta.DryRun
+		problems, err := deployAttempt(agent, options, meta, manifest, compress_buffer, digest, resume, deploy_log)
+		if err == nil {
+			deploy_log.Info("deploy finished", "problems", problems)
+			return problems
+		}
+		deploy_log.Warn("lost the connection", "err", err)
+		if !agent.retry(attempt, err) {
+			output.Fail(EXIT_TRANSFER, "lost the connection to "+agent.addr, err)
+		}
+	}
+}
+
+// deployAttempt runs a deploy over one connection, the error is returned when
+// the connection is lost so the deploy can be retried
+func deployAttempt(agent *Agent, options DeployOptions, meta common.DeployMeta, manifest *common.Manifest, compress_buffer *bytes.Buffer, digest []byte, resume bool, deploy_log *common.Logger) (bool, error) {
+	remote_message_chan := make(chan struct{})
+
+	// initialize websocket connection
+	websocket_conn := agent.Dial(common.DEPLOY_PATH, options.ws_compress)
 	defer websocket_conn.Close()
+	websocket_conn.EnableWriteCompression(options.ws_compress)
 
-	go remoteMessageLoop(websocket_conn, &remote_message_chan)
+	remote_state := &RemoteState{ready: make(chan struct{}), state: make(chan common.DeployState, 1), log: deploy_log}
+	go remoteMessageLoop(websocket_conn, &remote_message_chan, remote_state)
 
-	sendMetaData(websocket_conn, compress_buffer.Len(), compress_count, destinations)
+	pull := meta.Fetched()
+	offset := 0
+	if resume {
+		if err := sendResume(websocket_conn, meta.ID); err != nil {
+			return false, err
+		}
+		var state common.DeployState
+		select {
+		case state = <-remote_state.state:
+		case <-remote_message_chan:
+			return false, remote_state.lost()
+		}
+		deploy_log.Info("resuming", "status", state.Status, "received", state.Received)
+		switch state.Status {
+		case common.STATE_RECEIVING:
+			output.Phase("resuming", "from "+common.FormatBytes(state.Received))
+			offset = state.Received
+			close(remote_state.ready)
+		case common.STATE_DEPLOYING:
+			output.Phase("resuming", "the agent is deploying")
+			return false, waitDone(&remote_message_chan, remote_state)
+		case common.STATE_DONE:
+			for _, destination := range state.Completed {
+				output.Destination(destination, nil)
+			}
+			closeConnection(websocket_conn, &remote_message_chan)
+			return false, nil
+		case common.STATE_FAILED:
+			output.FailRemote(common.FormatError(state.Kind, errors.New(state.Error)))
+		default:
+			output.Phase("restarting", "the agent no longer has the deploy")
+			resume = false
+		}
+	}
 
-	sendData(websocket_conn, compress_buffer)
+	if !resume {
+		if !pull {
+			if err := sendManifest(websocket_conn, manifest); err != nil {
+				return false, err
+			}
+		}
+		if err := sendMetaData(websocket_conn, meta); err != nil {
+			return false, err
+		}
+	}
 
-	closeConnection(websocket_conn, &remote_message_chan)
+	if meta.DryRun {
+		<-remote_message_chan
+		if !remote_state.done {
+			return false, remote_state.lost()
+		}
+		return remote_state.problems, nil
+	}
 
+	// the agent answers READY once it holds the destination locks
+	select {
+	case <-remote_state.ready:
+	case <-remote_message_chan:
+		return false, remote_state.lost()
+	}
+
+	if err := sendSignature(websocket_conn, agent.key, digest); err != nil {
+		return false, err
+	}
+
+	var err error
+	if len(meta.Source) == 0 && pull {
+		output.Phase("rolling back", "to "+meta.Digest)
+		err = sendDataDone(websocket_conn)
+	} else if pull {
+		output.Phase("fetching", meta.Source)
+		err = sendDataDone(websocket_conn)
+	} else {
+		output.Phase("sending", common.FormatBytes(compress_buffer.Len()-offset))
+		err = sendData(websocket_conn, compress_buffer, offset, options.send)
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, waitDone(&remote_message_chan, remote_state)
+}
+
+// waitDone waits for the agent to finish extracting
+func waitDone(remote_message_chan *chan struct{}, remote_state *RemoteState) error {
 	// waits until remote message chan is triggered/closed
-	<-remote_message_chan
+	<-*remote_message_chan
+
+	if !remote_state.done {
+		return remote_state.lost()
+	}
+	return nil
 }
 
-func sendMetaData(conn *websocket.Conn, byte_size int, item_count int, destinations Destinations) {
-	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
-	buffer.WriteString(common.META_BAR)
-	buffer.WriteString(fmt.Sprintf("%d|%d|", byte_size, item_count))
-	buffer.WriteString(strings.Join(destinations, ","))
-	err := conn.WriteMessage(websocket.TextMessage, buffer.Bytes())
+// RemoteState is shared between deployTo and remoteMessageLoop, ready is closed
+// when the agent accepts the deploy and done is set when it finishes
+type RemoteState struct {
+	ready    chan struct{}
+	state    chan common.DeployState // the answer to a RESUME
+	done     bool
+	problems bool  // a dry run found something extraction would fail on
+	err      error // why the connection was lost
+	log      *common.Logger
+}
+
+// lost is why the connection closed before the deploy finished
+func (remote_state *RemoteState) lost() error {
+	if remote_state.err != nil {
+		return remote_state.err
+	}
+	return errUnexpectedClose
+}
+
+func sendManifest(conn *Conn, manifest *common.Manifest) error {
+	message, err := common.FormatManifest(manifest)
 	if err != nil {
-		log.Fatalln("Failed to write meta data to web socket!", err)
+		output.Fail(EXIT_TRANSFER, "failed to write manifest to web socket", err)
 	}
+	return conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+func sendMetaData(conn *Conn, meta common.DeployMeta) error {
+	return conn.WriteMessage(websocket.TextMessage, []byte(common.FormatMeta(meta)))
 }
 
-func sendData(conn *websocket.Conn, buffer *bytes.Buffer) {
+func sendResume(conn *Conn, id string) error {
+	return conn.WriteMessage(websocket.TextMessage, []byte(common.RESUME_BAR+id))
+}
+
+func sendSignature(conn *Conn, key ed25519.PrivateKey, digest []byte) error {
+	signature := common.SignDigest(key, digest)
+	message := common.FormatSignature(key.Public().(ed25519.PublicKey), signature)
+	return conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+// sendData sends the package from offset, the bytes the agent already has
+// when a deploy is resumed
+func sendData(conn *Conn, buffer *bytes.Buffer, offset int, options SendOptions) error {
 	data := buffer.Bytes()
-	chunk_size := 4096
-	progress := common.BeginProgress(common.ProgressBytesValue)
-	for low := 0; low < len(data); {
+	throttle := newThrottle(options.rate)
+	tuner := newChunkTuner(conn, options)
+	chunk_size := tuner.next(conn, 0)
+	progress := output.Progress("send", common.ProgressBytesRate)
+	for low := offset; low < len(data); {
 		progress.Write(low, len(data), "sending data")
 		high := low + chunk_size
 		if high > len(data) {
@@ -98,40 +439,68 @@ func sendData(conn *websocket.Conn, buffer *bytes.Buffer) {
 		}
 		err := conn.WriteMessage(websocket.BinaryMessage, data[low:high])
 		if err != nil {
-			fmt.Println()
-			log.Fatalln("Failed to write data to the web socket!", err)
+			return err
 		}
+		throttle.wait(high - low)
+		chunk_size = tuner.next(conn, high-low)
 		low = high
 	}
 	progress.Writeln(len(data), len(data), "all data sent")
-	conn.WriteMessage(websocket.TextMessage, []byte(common.DATA_DONE))
+	return sendDataDone(conn)
 }
 
-func remoteMessageLoop(conn *websocket.Conn, remote_message_chan *chan struct{}) {
+func sendDataDone(conn *Conn) error {
+	return conn.WriteMessage(websocket.TextMessage, []byte(common.DATA_DONE))
+}
+
+func remoteMessageLoop(conn *Conn, remote_message_chan *chan struct{}, remote_state *RemoteState) {
 	defer close(*remote_message_chan)
-	progress := common.BeginProgress(common.ProgressMessageValue)
+	progress := output.Progress("extract", common.ProgressMessageValue)
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Println("\nFailed to read from WebSocket!", err)
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				remote_state.err = err
 			}
 			return
 		}
 		switch {
-		case string(message[0:7]) == "ERROR: ":
-			log.Fatalln(string(message[7:]))
-		case string(message[0:10]) == "PROGRESS: ":
+		case strings.HasPrefix(string(message), common.ERROR_BAR):
+			remote_state.log.Error("agent reported an error", "message", string(message))
+			output.FailRemote(string(message))
+		case strings.HasPrefix(string(message), common.STATE_BAR):
+			state, err := common.ParseState(string(message))
+			if err != nil {
+				output.Fail(EXIT_TRANSFER, "invalid deploy state", err)
+			}
+			remote_state.state <- state
+		case string(message) == common.READY:
+			close(remote_state.ready)
+		case strings.HasPrefix(string(message), common.QUEUED_BAR):
+			position, _ := strconv.Atoi(string(message[len(common.QUEUED_BAR):]))
+			output.Queued(position)
+		case strings.HasPrefix(string(message), "PROGRESS: "):
 			progress.Write(1, 1, string(message[10:]))
-		case string(message[0:11]) == "PROG DONE: ":
-			progress.Writeln(1, 1, "[100%] "+strings.TrimSpace(string(message[11:])))
+		case strings.HasPrefix(string(message), "PROG DONE: "):
+			destination := strings.TrimSpace(string(message[11:]))
+			progress.Writeln(1, 1, "[100%] "+destination)
+			remote_state.log.Info("destination deployed", "destination", destination)
+			output.Destination(destination, nil)
+		case strings.HasPrefix(string(message), common.PLAN_BAR):
+			plan, err := common.ParsePlan(string(message))
+			if err != nil {
+				output.Fail(EXIT_TRANSFER, "invalid plan", err)
+			}
+			remote_state.problems = remote_state.problems || len(plan.Problems) > 0
+			output.Plan(plan)
 		case string(message) == "DONE":
+			remote_state.done = true
 			closeConnection(conn, remote_message_chan)
 		}
 	}
 }
 
-func closeConnection(conn *websocket.Conn, remote_message_chan *chan struct{}) {
+func closeConnection(conn *Conn, remote_message_chan *chan struct{}) {
 	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 
 	// hold off on returning out of the loop until the websocket is closed
@@ -147,6 +516,9 @@ func validationError(s string, arg ...any) {
 }
 
 func fatalError(show_usage bool, s string, arg ...any) {
+	if output.json {
+		output.Fail(EXIT_USAGE, fmt.Sprintf(s, arg...), nil)
+	}
 	fmt.Print("ERROR: ")
 	if len(arg) > 0 {
 		fmt.Printf(s, arg...)
@@ -157,7 +529,17 @@ func fatalError(show_usage bool, s string, arg ...any) {
 	if show_usage {
 		flag.Usage()
 	}
-	os.Exit(1)
+	os.Exit(EXIT_USAGE)
+}
+
+// gitRelease is the commit a source folder is checked out at, or nothing
+// when it is not in a git repository or git is not installed
+func gitRelease(src string) string {
+	out, err := exec.Command("git", "-C", src, "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
 }
 
 func validate_dir_exists(path string) {
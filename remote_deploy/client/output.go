@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// exit codes let scripts tell why a deploy failed without parsing output
+const EXIT_OK = 0
+const EXIT_USAGE = 1
+const EXIT_CONNECT = 2
+const EXIT_AUTH = 3
+const EXIT_TRANSFER = 4
+const EXIT_EXTRACT = 5
+const EXIT_BUSY = 6
+const EXIT_LIMIT = 7
+const EXIT_EXEC = 8
+const EXIT_HOOK = 9
+const EXIT_RELEASE = 10
+
+const JSON_PROGRESS_RATE = time.Second
+const LINE_PROGRESS_RATE = 5 * time.Second
+
+// Output writes everything the client reports, either as text for a person
+// or as newline delimited JSON events for CI
+type Output struct {
+	mutex   sync.Mutex
+	json    bool
+	tty     bool
+	started time.Time
+}
+
+// Event is one line of -output json, fields that do not apply to the event
+// are left out
+type Event struct {
+	Event        string  `json:"event"`
+	Time         string  `json:"time"`
+	Phase        string  `json:"phase,omitempty"`
+	Message      string  `json:"message,omitempty"`
+	Count        int     `json:"count,omitempty"`
+	Total        int     `json:"total,omitempty"`
+	Percent      float64 `json:"percent,omitempty"`
+	Rate         float64 `json:"rate,omitempty"`
+	ElapsedMs    int64   `json:"elapsed_ms,omitempty"`
+	EtaMs        int64   `json:"eta_ms,omitempty"`
+	Destination  string  `json:"destination,omitempty"`
+	Status       string  `json:"status,omitempty"`
+	Code         int     `json:"code,omitempty"`
+	Bytes        int     `json:"bytes,omitempty"`
+	Items        int     `json:"items,omitempty"`
+	Position     int     `json:"position,omitempty"`
+	Destinations int     `json:"destinations,omitempty"`
+}
+
+var output = NewOutput("text")
+
+// exit ends the client, tests replace it to learn the code a failure exits with
+var exit = os.Exit
+
+// logger is the diagnostic log written with -log, nil when there is none
+var logger *common.Logger
+
+// the -log file is rotated at this size
+const LOG_MAX_SIZE = 10 * 1024 * 1024
+const LOG_MAX_FILES = 3
+
+func NewOutput(format string) *Output {
+	info, err := os.Stdout.Stat()
+	tty := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return &Output{json: format == "json", tty: tty, started: time.Now()}
+}
+
+func (out *Output) emit(event Event) {
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	data, _ := json.Marshal(event)
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	fmt.Println(string(data))
+}
+
+// emitValue writes a command's result, such as a directory listing, as one
+// JSON line
+func (out *Output) emitValue(value any) {
+	data, _ := json.Marshal(value)
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	fmt.Println(string(data))
+}
+
+// Phase reports the start of a step of the deploy
+func (out *Output) Phase(phase string, message string) {
+	if out.json {
+		out.emit(Event{Event: "phase", Phase: phase, Message: message})
+	} else {
+		fmt.Println(phase+":", message)
+	}
+}
+
+// Progress returns a progress bar for the phase, JSON output emits progress
+// events and output that is not a terminal prints a line every few seconds
+func (out *Output) Progress(phase string, format common.ProgressFunc) *common.ProgressInfo {
+	if out.json {
+		progress := common.BeginProgressTo(format, &jsonProgressSink{out: out, phase: phase})
+		progress.SetRateLimit(JSON_PROGRESS_RATE)
+		return progress
+	}
+	if !out.tty {
+		progress := common.BeginProgressTo(format, common.NewWriterSink(os.Stdout))
+		progress.SetRateLimit(LINE_PROGRESS_RATE)
+		return progress
+	}
+	return common.BeginProgress(format)
+}
+
+type jsonProgressSink struct {
+	out   *Output
+	phase string
+}
+
+func (sink *jsonProgressSink) Progress(update common.ProgressUpdate) {
+	sink.out.emit(Event{
+		Event:     "progress",
+		Phase:     sink.phase,
+		Message:   update.Message,
+		Count:     update.Stats.Count,
+		Total:     update.Stats.Total,
+		Percent:   update.Stats.Percent(),
+		Rate:      update.Stats.Rate,
+		ElapsedMs: update.Stats.Elapsed.Milliseconds(),
+		EtaMs:     update.Stats.ETA.Milliseconds(),
+	})
+}
+
+// Queued reports the deploy's place in the agent's queue while it waits for
+// its destinations
+func (out *Output) Queued(position int) {
+	if out.json {
+		out.emit(Event{Event: "queued", Position: position})
+	} else {
+		fmt.Printf("queued: position %d\n", position)
+	}
+}
+
+// Destination reports the result of extracting to one destination
+func (out *Output) Destination(destination string, err error) {
+	status := "ok"
+	message := ""
+	if err != nil {
+		status = "failed"
+		message = err.Error()
+	}
+	if out.json {
+		out.emit(Event{Event: "destination", Destination: destination, Status: status, Message: message})
+	} else if err != nil {
+		fmt.Println("failed:", destination, message)
+	}
+}
+
+// Plan reports what a dry run would do to one destination, unchanged files
+// are only counted
+func (out *Output) Plan(plan *common.Plan) {
+	if out.json {
+		out.emitValue(plan)
+		return
+	}
+	fmt.Println("plan:", plan.Destination)
+	for _, entry := range plan.Entries {
+		if entry.Action != common.PLAN_UNCHANGED {
+			fmt.Printf("  %-9s %12s  %s\n", entry.Action, formatDelta(entry.Delta), entry.Path)
+		}
+	}
+	for _, problem := range plan.Problems {
+		fmt.Printf("  %-9s %12s  %s\n", "problem", "", problem)
+	}
+	fmt.Printf("  %d to create, %d to overwrite, %d unchanged, %d to delete, %s in total\n",
+		plan.Count(common.PLAN_CREATE), plan.Count(common.PLAN_OVERWRITE), plan.Count(common.PLAN_UNCHANGED), plan.Count(common.PLAN_DELETE), formatDelta(plan.Delta()))
+}
+
+// formatDelta is a size change with its sign
+func formatDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + common.FormatBytes(int(-delta))
+	}
+	return "+" + common.FormatBytes(int(delta))
+}
+
+// Summary reports the deploy as a whole once the agent is done
+func (out *Output) Summary(bytes int, items int, destinations int) {
+	elapsed := time.Since(out.started)
+	if out.json {
+		out.emit(Event{Event: "summary", Status: "ok", Bytes: bytes, Items: items, Destinations: destinations, ElapsedMs: elapsed.Milliseconds()})
+	} else {
+		fmt.Printf("deployed %d items (%s) to %d destinations in %s\n", items, common.FormatBytes(bytes), destinations, common.FormatDuration(elapsed))
+	}
+}
+
+// Stream passes on output of a remote command, JSON output wraps each piece
+// in an event for its stream
+func (out *Output) Stream(stream string, writer *os.File, text string) {
+	if out.json {
+		out.emit(Event{Event: stream, Message: text})
+		return
+	}
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	fmt.Fprint(writer, text)
+}
+
+// Exit reports the exit code of a remote command, a non zero code fails with
+// EXIT_EXEC
+func (out *Output) Exit(command string, code int) {
+	if code != 0 {
+		out.Fail(EXIT_EXEC, fmt.Sprintf("%s exited with code %d", command, code), nil)
+	}
+	if out.json {
+		out.emit(Event{Event: "summary", Status: "ok", ElapsedMs: time.Since(out.started).Milliseconds()})
+	}
+}
+
+// Fail reports the error and exits with the code for its category
+func (out *Output) Fail(code int, message string, err error) {
+	if err != nil && len(message) > 0 {
+		message = fmt.Sprintf("%s: %v", message, err)
+	} else if err != nil {
+		message = err.Error()
+	}
+	logger.Error(message, "code", code)
+	if out.json {
+		out.emit(Event{Event: "error", Code: code, Message: message})
+		out.emit(Event{Event: "summary", Status: "failed", Code: code, ElapsedMs: time.Since(out.started).Milliseconds()})
+	} else {
+		if out.tty {
+			fmt.Println()
+		}
+		fmt.Fprintln(os.Stderr, "ERROR:", message)
+	}
+	exit(code)
+}
+
+// FailRemote exits for an ERROR message sent by the agent
+func (out *Output) FailRemote(message string) {
+	kind, text := common.ParseError(message)
+	code := EXIT_TRANSFER
+	switch kind {
+	case common.ERROR_AUTH:
+		code = EXIT_AUTH
+	case common.ERROR_EXTRACT:
+		code = EXIT_EXTRACT
+	case common.ERROR_BUSY:
+		code = EXIT_BUSY
+	case common.ERROR_LIMIT:
+		code = EXIT_LIMIT
+	case common.ERROR_EXEC:
+		code = EXIT_EXEC
+	case common.ERROR_RELEASE:
+		code = EXIT_RELEASE
+	}
+	out.Fail(code, text, nil)
+}
+
+var errUnexpectedClose = errors.New("connection closed before the deploy finished")
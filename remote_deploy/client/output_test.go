@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// exited is what the replaced exit panics with, so runClient can stop the client
+// where it would have exited
+type exited int
+
+// runClient calls f with JSON output written to a pipe, and returns the events it
+// wrote and the code it exited with, -1 when it returned
+func runClient(t *testing.T, f func()) (events []map[string]any, code int) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output = NewOutput("json")
+	exit = func(code int) { panic(exited(code)) }
+	defer func() {
+		exit = os.Exit
+		output = NewOutput("text")
+	}()
+	read := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		read <- data
+	}()
+
+	code = -1
+	func() {
+		defer func() {
+			if value := recover(); value != nil {
+				exit_code, ok := value.(exited)
+				if !ok {
+					panic(value)
+				}
+				code = int(exit_code)
+			}
+		}()
+		f()
+	}()
+	os.Stdout = stdout
+	writer.Close()
+	for _, line := range bytes.Split(bytes.TrimSpace(<-read), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var event map[string]any
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("%q is not a JSON event: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events, code
+}
+
+// withoutTime drops the time of each event once it is checked
+func withoutTime(t *testing.T, events []map[string]any) []map[string]any {
+	t.Helper()
+	for _, event := range events {
+		if _, err := time.Parse(time.RFC3339Nano, event["time"].(string)); err != nil {
+			t.Errorf("event %v: %v", event, err)
+		}
+		delete(event, "time")
+		delete(event, "elapsed_ms")
+	}
+	return events
+}
+
+func TestOutputJSONEvents(t *testing.T) {
+	events, code := runClient(t, func() {
+		output.Phase("compressing", "src")
+		output.Queued(2)
+		output.Destination(`C:\sites\app`, nil)
+		output.Destination(`C:\sites\api`, errors.New("disk full"))
+		output.Stream("stdout", os.Stdout, "recycled\n")
+		output.Summary(2048, 12, 2)
+	})
+	if code != -1 {
+		t.Fatalf("exited with %d", code)
+	}
+	want := []map[string]any{
+		{"event": "phase", "phase": "compressing", "message": "src"},
+		{"event": "queued", "position": 2.0},
+		{"event": "destination", "destination": `C:\sites\app`, "status": "ok"},
+		{"event": "destination", "destination": `C:\sites\api`, "status": "failed", "message": "disk full"},
+		{"event": "stdout", "message": "recycled\n"},
+		{"event": "summary", "status": "ok", "bytes": 2048.0, "items": 12.0, "destinations": 2.0},
+	}
+	if events = withoutTime(t, events); !reflect.DeepEqual(events, want) {
+		t.Errorf("events =\n%v\nwant\n%v", events, want)
+	}
+}
+
+func TestOutputJSONProgress(t *testing.T) {
+	events, _ := runClient(t, func() {
+		progress := output.Progress("sending", common.ProgressBytesValue)
+		progress.Writeln(4096, 4096, "sent")
+	})
+	if len(events) != 1 {
+		t.Fatalf("events = %v, want the final progress", events)
+	}
+	event := events[0]
+	for key, value := range map[string]any{"event": "progress", "phase": "sending", "message": "sent", "count": 4096.0, "total": 4096.0, "percent": 100.0} {
+		if event[key] != value {
+			t.Errorf("%s = %v, want %v", key, event[key], value)
+		}
+	}
+	// the ETA of a finished transfer is zero and left out
+	if _, ok := event["eta_ms"]; ok {
+		t.Errorf("final progress has an ETA: %v", event)
+	}
+}
+
+func TestOutputFail(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    func()
+		code    int
+		message string
+	}{
+		{"local", func() { output.Fail(EXIT_LIMIT, "package is too large", errors.New("12 MB over")) }, EXIT_LIMIT, "package is too large: 12 MB over"},
+		{"remote busy", func() { output.FailRemote(common.FormatError(common.ERROR_BUSY, errors.New("destination is locked"))) }, EXIT_BUSY, "destination is locked"},
+		{"remote release", func() { output.FailRemote(common.FormatError(common.ERROR_RELEASE, errors.New("older release"))) }, EXIT_RELEASE, "older release"},
+		{"remote without a kind", func() { output.FailRemote(common.ERROR_BAR + "failed") }, EXIT_TRANSFER, "failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, code := runClient(t, test.fail)
+			if code != test.code {
+				t.Errorf("exited with %d, want %d", code, test.code)
+			}
+			want := []map[string]any{
+				{"event": "error", "code": float64(test.code), "message": test.message},
+				{"event": "summary", "status": "failed", "code": float64(test.code)},
+			}
+			if events = withoutTime(t, events); !reflect.DeepEqual(events, want) {
+				t.Errorf("events = %v, want %v", events, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"remote_deploy/common"
+)
+
+const DEPLOY_FILE = "deploy.yaml"
+
+// DeployFile is a project's deploy.yaml, it names the environments the
+// project deploys to:
+//
+//	environments:
+//	  prod:
+//	    agents: [web1:8081, web2:8081]
+//	    key: build01
+//	    src: bin/publish
+//	    destinations: ['c:\sites\app']
+//	    filter:
+//	      exclude: ['*.pdb', logs]
+//	    vars: {db_host: sql01}
+//	    hooks:
+//	      before: [dotnet publish -c Release -o bin/publish]
+//	      after: [notify.cmd]
+//	      secrets: {NOTIFY_TOKEN: notify_token}
+//	      exec:
+//	        - {cmd: recycle, dir: 'c:\sites\app', args: {pool: app}}
+type DeployFile struct {
+	Environments map[string]*Environment `yaml:"environments"`
+	dir          string
+}
+
+// Environment is one target of a deploy.yaml, flags given on the command line
+// override its settings. Relative paths are relative to the deploy.yaml.
+type Environment struct {
+	Agents       []string          `yaml:"agents"`
+	Key          string            `yaml:"key"` // a private key file, or the name of a key made by keygen
+	Src          string            `yaml:"src"`
+	Destinations []string          `yaml:"destinations"`
+	Filter       common.Filter     `yaml:"filter"`
+	Rate         string            `yaml:"rate"`
+	Chunk        string            `yaml:"chunk"`
+	Wait         bool              `yaml:"wait"`
+	Mirror       bool              `yaml:"mirror"`
+	Vars         map[string]string `yaml:"vars"` // values for the templates the agents render, -var overrides them one by one
+	Hooks        Hooks             `yaml:"hooks"`
+}
+
+// Hooks run around a deploy, Before and After are local shell commands run
+// in the folder of the deploy.yaml and Exec runs commands from each agent's
+// allow-list once that agent has the new files. Secrets names environment
+// variables of Before and After and the secrets of the first agent they are
+// set to, commands of the allow-list get theirs from the agent's config.
+type Hooks struct {
+	Before  []string          `yaml:"before"`
+	After   []string          `yaml:"after"`
+	Exec    []ExecHook        `yaml:"exec"`
+	Secrets map[string]string `yaml:"secrets"`
+}
+
+type ExecHook struct {
+	Cmd  string            `yaml:"cmd"`
+	Dir  string            `yaml:"dir"`
+	Args map[string]string `yaml:"args"`
+}
+
+var yaml_type_name = regexp.MustCompile(` in type [\w.]+`)
+
+// LoadDeployFile reads a deploy.yaml, keys it does not know are reported
+// rather than ignored so a typo does not silently change a deploy
+func LoadDeployFile(path string) (*DeployFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	deploy_file := new(DeployFile)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(deploy_file); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, yaml_type_name.ReplaceAllString(err.Error(), ""))
+	}
+	if deploy_file.dir, err = filepath.Abs(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	for name, env := range deploy_file.Environments {
+		if err := env.validate(); err != nil {
+			return nil, fmt.Errorf("%s: environments.%s: %v", path, name, err)
+		}
+	}
+	return deploy_file, nil
+}
+
+// Environment finds the environment by name, listing the ones there are when
+// it is not found
+func (deploy_file *DeployFile) Environment(name string) (*Environment, error) {
+	if env := deploy_file.Environments[name]; env != nil {
+		return env, nil
+	}
+	names := make([]string, 0, len(deploy_file.Environments))
+	for name := range deploy_file.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown environment %s, the environments are: %s", name, strings.Join(names, ", "))
+}
+
+func (env *Environment) validate() error {
+	if err := env.Filter.Validate(); err != nil {
+		return err
+	}
+	for name := range env.Vars {
+		if err := common.ValidateVarName(name); err != nil {
+			return fmt.Errorf("vars: %v", err)
+		}
+	}
+	for variable, name := range env.Hooks.Secrets {
+		if err := common.ValidateVarName(variable); err != nil {
+			return fmt.Errorf("hooks.secrets: %v", err)
+		}
+		if err := common.ValidateVarName(name); err != nil {
+			return fmt.Errorf("hooks.secrets.%s: %v", variable, err)
+		}
+	}
+	for i, hook := range env.Hooks.Exec {
+		if len(hook.Cmd) == 0 || len(hook.Dir) == 0 {
+			return fmt.Errorf("hooks.exec[%d]: cmd and dir are required", i)
+		}
+	}
+	return nil
+}
+
+// resolve makes a path from the deploy.yaml relative to its folder
+func (deploy_file *DeployFile) resolve(path string) string {
+	if len(path) == 0 || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(deploy_file.dir, path)
+}
+
+// key_path finds the private key an environment refers to, a bare name is a
+// key in the default key folder
+func (deploy_file *DeployFile) key_path(key string) string {
+	if len(key) > 0 && !strings.ContainsAny(key, "/\\") && filepath.Ext(key) == "" {
+		return filepath.Join(defaultKeyDir(), key+".key")
+	}
+	return deploy_file.resolve(key)
+}
+
+// apply fills in every flag that was not given on the command line from the
+// environment
+func (deploy_flags *deployFlags) apply(deploy_file *DeployFile, env *Environment) {
+	given := make(map[string]bool)
+	deploy_flags.flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	set := func(name string, values ...string) {
+		if given[name] {
+			return
+		}
+		for _, value := range values {
+			if len(value) > 0 {
+				deploy_flags.flags.Set(name, value)
+			}
+		}
+	}
+	set("src", deploy_file.resolve(env.Src))
+	set("dst", env.Destinations...)
+	set("key", deploy_file.key_path(env.Key))
+	set("rate", env.Rate)
+	set("chunk", env.Chunk)
+	set("wait", strconv.FormatBool(env.Wait))
+	set("mirror", strconv.FormatBool(env.Mirror))
+	for name, value := range env.Vars {
+		if _, given := deploy_flags.vars[name]; !given {
+			deploy_flags.vars.Set(name + "=" + value)
+		}
+	}
+	deploy_flags.agents = env.Agents
+	deploy_flags.filter = &env.Filter
+	deploy_flags.hooks = env.Hooks
+	deploy_flags.hooks_dir = deploy_file.dir
+}
+
+// hookEnv is the environment of the local hooks, with the secrets they name
+// read from the agent. The values are only ever put in the environment.
+func hookEnv(agent *Agent, secrets map[string]string) []string {
+	if len(secrets) == 0 {
+		return nil
+	}
+	variables := make([]string, 0, len(secrets))
+	for variable := range secrets {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	env := os.Environ()
+	for _, variable := range variables {
+		var secret common.Secret
+		logger.Info("reading hook secret", "agent", agent.addr, "name", secrets[variable])
+		agent.Get(common.SECRETS_PATH, url.Values{"name": {secrets[variable]}}, &secret)
+		env = append(env, variable+"="+secret.Value)
+	}
+	return env
+}
+
+// runHooks runs local commands through the shell, stopping at the first one
+// that fails. With JSON output their output goes to stderr to keep stdout to
+// events. A nil env is the client's own environment.
+func runHooks(commands []string, dir string, env []string) {
+	for _, command := range commands {
+		output.Phase("hook", command)
+		logger.Info("running hook", "command", command, "dir", dir)
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("sh", "-c", command)
+		}
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		if output.json {
+			cmd.Stdout = os.Stderr
+		}
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			output.Fail(EXIT_HOOK, "hook failed: "+command, err)
+		}
+	}
+}
+
+// runExecHooks runs the agent's allowed commands after a deploy to it
+func runExecHooks(agent *Agent, hooks []ExecHook) {
+	for _, hook := range hooks {
+		output.Phase("exec", hook.Cmd+" on "+agent.addr)
+		code := runRemoteCommand(agent, common.ExecRequest{Command: hook.Cmd, Dir: hook.Dir, Params: hook.Args})
+		if code != 0 {
+			output.Fail(EXIT_EXEC, "exec hook failed", fmt.Errorf("%s exited with code %d", hook.Cmd, code))
+		}
+	}
+}
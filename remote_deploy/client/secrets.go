@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"remote_deploy/common"
+)
+
+// secretCommand manages the encrypted secrets of an agent, which its
+// templates and commands refer to by name. A value is read from -file or
+// stdin rather than a flag, so it is not left in the shell's history.
+func secretCommand(args []string) {
+	flags := newCommandFlags("secret")
+	global := addGlobalFlags(flags)
+	name := flags.String("name", "", "the secret, required except to list: -name db_password")
+	file := flags.String("file", "", "set the secret from this file instead of stdin")
+	action := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	global.setOutput()
+	switch action {
+	case "set", "get", "rm":
+		if err := common.ValidateVarName(*name); err != nil {
+			validationError("name: %v", err)
+		}
+	case "list":
+	default:
+		fatalError(true, "set, get, list or rm is required")
+	}
+	agent := global.agent()
+	query := url.Values{"name": {*name}}
+
+	switch action {
+	case "set":
+		var value []byte
+		var err error
+		if len(*file) > 0 {
+			value, err = os.ReadFile(*file)
+		} else {
+			value, err = io.ReadAll(os.Stdin)
+			// a value piped with echo ends with a line break
+			value = []byte(strings.TrimRight(string(value), "\r\n"))
+		}
+		if err != nil {
+			output.Fail(EXIT_USAGE, "failed to read the secret", err)
+		}
+		agent.Send(http.MethodPut, common.SECRETS_PATH, query, nil, value).Body.Close()
+		output.Phase("secret", "set "+*name)
+	case "get":
+		var secret common.Secret
+		agent.Get(common.SECRETS_PATH, query, &secret)
+		if output.json {
+			output.emitValue(secret)
+			return
+		}
+		fmt.Println(secret.Value)
+	case "list":
+		var secrets []common.Secret
+		agent.Get(common.SECRETS_PATH, nil, &secrets)
+		if output.json {
+			output.emitValue(secrets)
+			return
+		}
+		if len(secrets) == 0 {
+			fmt.Println("no secrets")
+		}
+		for _, secret := range secrets {
+			fmt.Printf("%-30s set %s\n", secret.Name, secret.Updated.Local().Format("2006-01-02 15:04:05"))
+		}
+	case "rm":
+		agent.Request(http.MethodDelete, common.SECRETS_PATH, query).Body.Close()
+		output.Phase("secret", "removed "+*name)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const MIN_CHUNK_SIZE = 4 * 1024
+const MAX_CHUNK_SIZE = 1024 * 1024
+const PING_INTERVAL = time.Second
+
+// SendOptions controls how sendData paces the upload, a zero rate is
+// unlimited and a zero chunk size is tuned from the measured round trip
+type SendOptions struct {
+	rate       int
+	chunk_size int
+}
+
+// throttle sleeps just long enough to keep the average rate since the
+// transfer started at or below the limit
+type throttle struct {
+	rate  int
+	start time.Time
+	sent  int
+}
+
+func newThrottle(rate int) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+func (t *throttle) wait(n int) {
+	t.sent += n
+	if t.rate <= 0 {
+		return
+	}
+	expected := time.Duration(float64(t.sent) / float64(t.rate) * float64(time.Second))
+	if ahead := expected - time.Since(t.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// chunkTuner sizes chunks from the bandwidth delay product, the round trip is
+// measured by sending a ping carrying its send time and reading it back from
+// the pong, which is handled on the remoteMessageLoop goroutine
+type chunkTuner struct {
+	size      int
+	fixed     bool
+	rate      int
+	rtt       int64
+	last_ping time.Time
+	window    time.Time
+	sent      int
+}
+
+func newChunkTuner(conn *Conn, options SendOptions) *chunkTuner {
+	tuner := &chunkTuner{size: options.chunk_size, fixed: options.chunk_size > 0, rate: options.rate, window: time.Now()}
+	if tuner.fixed {
+		return tuner
+	}
+	tuner.size = MIN_CHUNK_SIZE
+	// the connection's own handler still runs to keep its heartbeat
+	heartbeat := conn.PongHandler()
+	conn.SetPongHandler(func(data string) error {
+		sent, err := strconv.ParseInt(data, 10, 64)
+		if err == nil {
+			atomic.StoreInt64(&tuner.rtt, int64(time.Since(time.Unix(0, sent))))
+		}
+		return heartbeat(data)
+	})
+	return tuner
+}
+
+func (tuner *chunkTuner) roundTrip() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tuner.rtt))
+}
+
+// next records the bytes just written and returns the size of the next chunk
+func (tuner *chunkTuner) next(conn *Conn, written int) int {
+	if tuner.fixed {
+		return tuner.size
+	}
+	tuner.sent += written
+	if time.Since(tuner.last_ping) < PING_INTERVAL {
+		return tuner.size
+	}
+	tuner.last_ping = time.Now()
+	payload := strconv.FormatInt(tuner.last_ping.UnixNano(), 10)
+	_ = conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(PING_INTERVAL))
+
+	throughput := float64(tuner.sent) / time.Since(tuner.window).Seconds()
+	tuner.sent = 0
+	tuner.window = time.Now()
+	if rtt := tuner.roundTrip(); rtt > 0 {
+		tuner.size = int(throughput * rtt.Seconds())
+	}
+	// keep at least ten chunks a second under a rate limit so the throttle
+	// does not stall the connection for long stretches
+	if tuner.rate > 0 && tuner.size > tuner.rate/10 {
+		tuner.size = tuner.rate / 10
+	}
+	if tuner.size < MIN_CHUNK_SIZE {
+		tuner.size = MIN_CHUNK_SIZE
+	} else if tuner.size > MAX_CHUNK_SIZE {
+		tuner.size = MAX_CHUNK_SIZE
+	}
+	return tuner.size
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"time"
+)
+
+const VERSION = "0.1.0"
+
+// DEPLOY_PATH is the agent's deploy WebSocket
+const DEPLOY_PATH = "/rfd"
+
+// agent endpoints that report on the agent and what it has deployed
+const PING_PATH = "/ping"
+const STATUS_PATH = "/status"
+const HISTORY_PATH = "/history"
+
+// PRUNE_PATH reports the staged packages the retention settings would remove
+// on GET and removes them on POST
+const PRUNE_PATH = "/prune"
+
+// SECRETS_PATH lists the agent's secrets on GET, or answers one with its
+// value given ?name=, sets one on PUT and removes one on DELETE
+const SECRETS_PATH = "/secrets"
+
+// UPDATE_PATH takes a new agent executable signed by one of the agent's
+// update keys, the agent restarts into it
+const UPDATE_PATH = "/agent/update"
+
+// the dashboard, UI_LOGIN_PATH takes a link made by SignLogin
+const UI_PATH = "/ui/"
+const UI_LOGIN_PATH = "/ui/login"
+
+// capabilities an agent reports from ping, a client can check for one before
+// using a feature older agents do not have
+const CAP_DEPLOY = "deploy"
+const CAP_PULL = "pull"
+const CAP_DRY_RUN = "dry-run"
+const CAP_MIRROR = "mirror"
+const CAP_EXEC = "exec"
+const CAP_FILES = "files"
+const CAP_HISTORY = "history"
+const CAP_ROLLBACK = "rollback"
+const CAP_UI = "ui"
+const CAP_UPDATE = "update"
+const CAP_PRUNE = "prune"
+const CAP_TEMPLATES = "templates"
+const CAP_SECRETS = "secrets"
+
+// Secret is one of the agent's secrets, Value is only sent when a single
+// secret is asked for
+type Secret struct {
+	Name    string    `json:"name"`
+	Value   string    `json:"value,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// AgentInfo is the agent's answer to a ping
+type AgentInfo struct {
+	Version      string    `json:"version"`
+	Hostname     string    `json:"hostname"`
+	OS           string    `json:"os"`
+	Time         time.Time `json:"time"`
+	Capabilities []string  `json:"capabilities"`
+}
+
+// kinds of deploy recorded in the history
+const DEPLOY_PUSH = "push"
+const DEPLOY_PULL = "pull"
+const DEPLOY_ROLLBACK = "rollback"
+
+// HistoryEntry records one deploy to one destination, Digest names the
+// package so it can be deployed again by a rollback
+type HistoryEntry struct {
+	Time        time.Time         `json:"time"`
+	Destination string            `json:"destination"`
+	Kind        string            `json:"kind"`
+	Digest      string            `json:"digest"`
+	Release     string            `json:"release,omitempty"`
+	Vars        map[string]string `json:"vars,omitempty"` // the deploy's template values, a rollback renders with them again
+	Size        int               `json:"size"`
+	Items       int               `json:"items"`
+	Signer      string            `json:"signer"`
+	Status      string            `json:"status"` // ok or failed
+	Error       string            `json:"error,omitempty"`
+}
+
+// AgentStatus is what the agent is doing now and the last deploy to each
+// destination it knows of
+type AgentStatus struct {
+	Version      string         `json:"version"`
+	Active       []string       `json:"active"`
+	Waiting      int            `json:"waiting"`
+	Destinations []HistoryEntry `json:"destinations"`
+	Update       *AgentUpdate   `json:"update,omitempty"` // the agent's last update of itself
+}
+
+// states of an agent update
+const UPDATE_PENDING = "pending" // the new executable is starting
+const UPDATE_HEALTHY = "healthy" // the new executable started and took over
+const UPDATE_FAILED = "failed"   // the previous executable was restored
+
+// AgentUpdate is an update of the agent to a new executable, it is Finished
+// once the new executable or the restored previous one is running
+type AgentUpdate struct {
+	From     string     `json:"from"` // the version that was replaced
+	To       string     `json:"to"`
+	Digest   string     `json:"digest"` // of the new executable
+	Signer   string     `json:"signer"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// PruneItem is a file in the agent's staging directory that retention
+// removes, Digest and Release are set for packages
+type PruneItem struct {
+	Name    string `json:"name"`
+	Digest  string `json:"digest,omitempty"`
+	Release string `json:"release,omitempty"`
+	Size    int    `json:"size"`
+	Reason  string `json:"reason"`
+	Error   string `json:"error,omitempty"` // why it could not be removed
+}
+
+// PruneResult is what a prune removed, or would remove on a dry run, and
+// what it kept
+type PruneResult struct {
+	DryRun    bool        `json:"dry_run"`
+	Removed   []PruneItem `json:"removed"`
+	Freed     int         `json:"freed"`
+	Kept      int         `json:"kept"` // staged packages left
+	KeptBytes int         `json:"kept_bytes"`
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AUTH_HEADER carries "<base64 public key>:<unix time>:<base64 signature>"
+// where the signature covers the method, request URI, time and the digest of
+// the body in AUTH_BODY_HEADER, requests are accepted within AUTH_WINDOW of
+// the agent's clock
+const AUTH_HEADER = "X-Deploy-Auth"
+const AUTH_WINDOW = 5 * time.Minute
+
+// AUTH_BODY_HEADER is the sha256 of the request body in hex, so a captured
+// auth header cannot be sent again with another body
+const AUTH_BODY_HEADER = "X-Deploy-Content-SHA256"
+
+// AUTH_BODY_BUFFER is the most of a body that is checked before the handler
+// runs, the rest of a larger body is checked as the handler reads it
+const AUTH_BODY_BUFFER = 1024 * 1024
+
+var errBodyDigest = errors.New("request body does not match its signed digest")
+
+func auth_payload(method string, uri string, timestamp string, body_digest string) []byte {
+	return []byte(method + "\n" + uri + "\n" + timestamp + "\n" + body_digest)
+}
+
+func body_digest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return hex.EncodeToString(digest[:])
+}
+
+// SignRequest adds the auth headers for a request to uri, which is the path
+// and query as the agent will see it, with body as it will be sent
+func SignRequest(header http.Header, method string, uri string, body []byte, key ed25519.PrivateKey) {
+	digest := body_digest(body)
+	header.Set(AUTH_BODY_HEADER, digest)
+	header.Set(AUTH_HEADER, auth_value(method, uri, digest, key))
+}
+
+func auth_value(method string, uri string, body_digest string, key ed25519.PrivateKey) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := ed25519.Sign(key, auth_payload(method, uri, timestamp, body_digest))
+	public_key := key.Public().(ed25519.PublicKey)
+	return base64.StdEncoding.EncodeToString(public_key) + ":" + timestamp + ":" + base64.StdEncoding.EncodeToString(signature)
+}
+
+// LOGIN_PARAM carries the same value as AUTH_HEADER in a dashboard login
+// link, since a browser following a link cannot add headers
+const LOGIN_PARAM = "auth"
+
+// SignLogin is the query of a dashboard login link, it is valid for
+// AUTH_WINDOW and the agent accepts it once
+func SignLogin(key ed25519.PrivateKey) url.Values {
+	return url.Values{LOGIN_PARAM: {auth_value(http.MethodGet, UI_LOGIN_PATH, body_digest(nil), key)}}
+}
+
+// VerifyLogin checks a dashboard login link against the trusted keys
+func VerifyLogin(request *http.Request, trusted []TrustedKey) (*TrustedKey, error) {
+	return verify_auth(request.URL.Query().Get(LOGIN_PARAM), request.Method, request.URL.Path, body_digest(nil), trusted)
+}
+
+// VerifyRequest checks the auth header of a request against the trusted keys
+// and the body against its signed digest. A body up to AUTH_BODY_BUFFER is
+// checked here, reading a larger one fails at its end if it does not match.
+func VerifyRequest(request *http.Request, trusted []TrustedKey) (*TrustedKey, error) {
+	digest := request.Header.Get(AUTH_BODY_HEADER)
+	key, err := verify_auth(request.Header.Get(AUTH_HEADER), request.Method, request.URL.RequestURI(), digest, trusted)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify_body(request, digest); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func verify_body(request *http.Request, digest string) error {
+	expected, err := hex.DecodeString(digest)
+	if err != nil || len(expected) != sha256.Size {
+		return errors.New("invalid body digest")
+	}
+	if request.Body == nil {
+		request.Body = http.NoBody
+	}
+	hash := sha256.New()
+	head, err := io.ReadAll(io.LimitReader(io.TeeReader(request.Body, hash), AUTH_BODY_BUFFER+1))
+	if err != nil {
+		return err
+	}
+	if len(head) <= AUTH_BODY_BUFFER {
+		if !bytes.Equal(hash.Sum(nil), expected) {
+			return errBodyDigest
+		}
+		request.Body = io.NopCloser(bytes.NewReader(head))
+		return nil
+	}
+	request.Body = &verified_body{
+		reader:   io.MultiReader(bytes.NewReader(head), io.TeeReader(request.Body, hash)),
+		closer:   request.Body,
+		hash:     hash,
+		expected: expected,
+	}
+	return nil
+}
+
+// verified_body fails the last read of a body that does not match its digest
+type verified_body struct {
+	reader   io.Reader
+	closer   io.Closer
+	hash     hash.Hash
+	expected []byte
+}
+
+func (body *verified_body) Read(p []byte) (int, error) {
+	n, err := body.reader.Read(p)
+	if err == io.EOF && !bytes.Equal(body.hash.Sum(nil), body.expected) {
+		return n, errBodyDigest
+	}
+	return n, err
+}
+
+func (body *verified_body) Close() error {
+	return body.closer.Close()
+}
+
+func verify_auth(value string, method string, uri string, body_digest string, trusted []TrustedKey) (*TrustedKey, error) {
+	if len(value) == 0 {
+		return nil, errors.New("request is not signed")
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid auth header")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid auth header key")
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid auth header time")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > AUTH_WINDOW || skew < -AUTH_WINDOW {
+		return nil, fmt.Errorf("request time is %s away from the agent's clock", skew.Round(time.Second))
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid auth header signature")
+	}
+	payload := auth_payload(method, uri, parts[1], body_digest)
+	return VerifyDigest(trusted, ed25519.PublicKey(key), payload, signature)
+}
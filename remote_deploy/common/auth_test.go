@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func signed_request(key ed25519.PrivateKey, signed []byte, sent []byte) *http.Request {
+	request := httptest.NewRequest(http.MethodPut, "/secrets?name=db", bytes.NewReader(sent))
+	SignRequest(request.Header, http.MethodPut, request.URL.RequestURI(), signed, key)
+	return request
+}
+
+func TestVerifyRequestBody(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []TrustedKey{{Key: public, Name: "test"}}
+	large := bytes.Repeat([]byte("x"), AUTH_BODY_BUFFER+10)
+	tampered := append(append([]byte{}, large[:len(large)-1]...), 'y')
+
+	tests := []struct {
+		name     string
+		signed   []byte
+		sent     []byte
+		refused  bool // by VerifyRequest
+		read_err bool // by reading the body to its end
+	}{
+		{"empty", nil, nil, false, false},
+		{"small", []byte("secret"), []byte("secret"), false, false},
+		{"small replayed with another body", []byte("secret"), []byte("other"), true, false},
+		{"large", large, large, false, false},
+		{"large replayed with another body", large, tampered, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := signed_request(key, test.signed, test.sent)
+			signer, err := VerifyRequest(request, trusted)
+			if test.refused {
+				if err == nil {
+					t.Fatal("VerifyRequest() accepted a body that does not match its digest")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyRequest() = %v", err)
+			}
+			if signer.Name != "test" {
+				t.Errorf("signer = %s, want test", signer.Name)
+			}
+			body, err := io.ReadAll(request.Body)
+			if test.read_err {
+				if err != errBodyDigest {
+					t.Errorf("reading the body = %v, want %v", err, errBodyDigest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading the body = %v", err)
+			}
+			if !bytes.Equal(body, test.sent) {
+				t.Errorf("body is %d bytes, want the %d sent", len(body), len(test.sent))
+			}
+		})
+	}
+}
+
+func TestVerifyRequestUnsignedDigest(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := signed_request(key, []byte("secret"), []byte("other"))
+	// a digest changed to match the new body no longer matches the signature
+	request.Header.Set(AUTH_BODY_HEADER, body_digest([]byte("other")))
+	if _, err := VerifyRequest(request, []TrustedKey{{Key: public, Name: "test"}}); err == nil {
+		t.Error("VerifyRequest() accepted a digest the signature does not cover")
+	}
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// endpoints of the coordinator, agents sign heartbeats with their own key and
+// clients sign everything else
+const COORD_HEARTBEAT = "/agents/heartbeat"
+const COORD_AGENTS = "/agents"
+const COORD_PACKAGES = "/packages"
+const COORD_JOBS = "/jobs"
+
+// AgentRegistration is what an agent tells the coordinator on every heartbeat
+type AgentRegistration struct {
+	Name         string            `json:"name"`
+	Addr         string            `json:"addr"` // where the coordinator reaches the agent
+	TLS          bool              `json:"tls"`
+	Version      string            `json:"version"`
+	Hostname     string            `json:"hostname"`
+	OS           string            `json:"os"`
+	Destinations []string          `json:"destinations"` // roots the agent deploys below, any when empty
+	Labels       map[string]string `json:"labels"`
+	Active       []string          `json:"active"`
+}
+
+// FleetAgent is an agent as the coordinator knows it
+type FleetAgent struct {
+	AgentRegistration
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+}
+
+// PackageInfo describes a package stored on the coordinator
+type PackageInfo struct {
+	Digest   string    `json:"digest"`
+	Size     int       `json:"size"`
+	Items    int       `json:"items"`
+	Signer   string    `json:"signer"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// JobRequest deploys a stored package to every agent the selector matches
+type JobRequest struct {
+	Digest       string            `json:"digest"`
+	Selector     string            `json:"selector"`
+	Destinations []string          `json:"destinations"`
+	Mirror       bool              `json:"mirror,omitempty"`
+	Wait         bool              `json:"wait,omitempty"`
+	Parallel     int               `json:"parallel,omitempty"` // agents deployed to at once, 0 for the coordinator's limit
+	Release      string            `json:"release,omitempty"`
+	Force        bool              `json:"force,omitempty"`
+	Vars         map[string]string `json:"vars,omitempty"` // template values sent to every agent
+}
+
+// statuses of a job and of each agent in it
+const JOB_PENDING = "pending"
+const JOB_RUNNING = "running"
+const JOB_DONE = "done"
+const JOB_FAILED = "failed"
+const JOB_SKIPPED = "skipped" // the agent does not serve the destinations
+
+// JobResult is one agent's part of a job, Kind is the error kind of a
+// failure
+type JobResult struct {
+	Agent     string   `json:"agent"`
+	Addr      string   `json:"addr"`
+	Status    string   `json:"status"`
+	Progress  string   `json:"progress,omitempty"`
+	Completed []string `json:"completed,omitempty"`
+	Kind      string   `json:"kind,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type Job struct {
+	ID        string      `json:"id"`
+	Request   JobRequest  `json:"request"`
+	Submitter string      `json:"submitter"`
+	Created   time.Time   `json:"created"`
+	Finished  *time.Time  `json:"finished,omitempty"`
+	Status    string      `json:"status"`
+	Results   []JobResult `json:"results"`
+}
+
+// Selector picks agents by their labels, every label in it must match
+type Selector map[string]string
+
+// ParseSelector reads a selector such as role=web,env=prod
+func ParseSelector(s string) (Selector, error) {
+	selector := make(Selector)
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || len(key) == 0 || len(value) == 0 {
+			return nil, fmt.Errorf("invalid selector term %q, terms are label=value", term)
+		}
+		if _, ok := selector[key]; ok {
+			return nil, fmt.Errorf("label %s is selected twice", key)
+		}
+		selector[key] = value
+	}
+	if len(selector) == 0 {
+		return nil, errors.New("selector is empty")
+	}
+	return selector, nil
+}
+
+func (selector Selector) Matches(labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (selector Selector) String() string {
+	terms := make([]string, 0, len(selector))
+	for key, value := range selector {
+		terms = append(terms, key+"="+value)
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
@@ -0,0 +1,242 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// PathStyle is how an OS writes and compares paths. Destinations are parsed
+// with the rules of the agent's OS rather than of whoever parses them, so a
+// coordinator on Linux checks a Windows agent's destinations as Windows would.
+type PathStyle struct {
+	Windows  bool // drive letters and UNC shares, either slash separates
+	FoldCase bool // names that differ only in case are the same file
+}
+
+// PathStyleOf is the style of an OS named as runtime.GOOS names it, macOS
+// folds case as its default file system does
+func PathStyleOf(goos string) PathStyle {
+	switch goos {
+	case "windows":
+		return PathStyle{Windows: true, FoldCase: true}
+	case "darwin", "ios":
+		return PathStyle{FoldCase: true}
+	}
+	return PathStyle{}
+}
+
+// key is the same for every spelling of name the OS treats as the same file,
+// it is how Key and Within both compare names
+func (style PathStyle) key(name string) string {
+	if style.FoldCase {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// LocalPathStyle is the style of the OS the program runs on
+var LocalPathStyle = PathStyleOf(runtime.GOOS)
+
+// Destination is an absolute path a package is extracted to, parsed and
+// normalised so two spellings of the same folder compare equal:
+//
+//	c:/sites/./app/         C:\sites\app
+//	\\?\C:\sites\app        C:\sites\app
+//	\\server1\c$\dir1\dir2  \\server1\c$\dir1\dir2
+//	//server1/c$/dir1/      \\server1\c$\dir1
+//	/srv//app/../www        /srv/www
+type Destination struct {
+	Style  PathStyle
+	Volume string   // C: or \\server\share on Windows, empty on POSIX
+	Names  []string // the folders below the volume or /, none for a root
+}
+
+// windows_reserved are device names Windows reserves in every folder, with
+// or without an extension
+var windows_reserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ParseDestination parses an absolute local, UNC or POSIX path by the rules
+// of style. Relative paths, paths relative to a drive's current folder, a
+// .. that climbs above the root and names the OS cannot create are refused.
+func ParseDestination(path string, style PathStyle) (Destination, error) {
+	destination := Destination{Style: style}
+	if len(path) == 0 {
+		return destination, errors.New("destination is empty")
+	}
+	if strings.ContainsRune(path, 0) {
+		return destination, fmt.Errorf("destination contains a NUL: %q", path)
+	}
+	rest := path
+	if style.Windows {
+		var err error
+		if destination.Volume, rest, err = windows_volume(path); err != nil {
+			return destination, err
+		}
+		rest = strings.ReplaceAll(rest, "\\", "/")
+	} else if !strings.HasPrefix(path, "/") {
+		return destination, fmt.Errorf("destination must be an absolute path: %s", path)
+	}
+	for _, name := range strings.Split(rest, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if len(destination.Names) == 0 {
+				return destination, fmt.Errorf("destination climbs above its root: %s", path)
+			}
+			destination.Names = destination.Names[:len(destination.Names)-1]
+		default:
+			if style.Windows {
+				if err := windows_name(name); err != nil {
+					return destination, fmt.Errorf("destination %s: %v", path, err)
+				}
+			}
+			destination.Names = append(destination.Names, name)
+		}
+	}
+	return destination, nil
+}
+
+// windows_volume splits the drive or share from the rest of a Windows path,
+// the \\?\ prefix of long paths is removed
+func windows_volume(path string) (volume string, rest string, err error) {
+	slashed := strings.ReplaceAll(path, "\\", "/")
+	switch {
+	case len(slashed) >= 8 && strings.EqualFold(slashed[:8], "//?/UNC/"):
+		return windows_volume("//" + slashed[8:])
+	case strings.HasPrefix(slashed, "//?/"):
+		return windows_volume(slashed[len("//?/"):])
+	case strings.HasPrefix(slashed, "//./"):
+		return "", "", fmt.Errorf("destination cannot be a device path: %s", path)
+	case strings.HasPrefix(slashed, "//"):
+		parts := strings.SplitN(slashed[2:], "/", 3)
+		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return "", "", fmt.Errorf("UNC destination needs a server and a share: %s", path)
+		}
+		for _, name := range parts[:2] {
+			if err := windows_name(name); err != nil {
+				return "", "", fmt.Errorf("destination %s: %v", path, err)
+			}
+		}
+		if len(parts) == 3 {
+			rest = parts[2]
+		}
+		return `\\` + parts[0] + `\` + parts[1], rest, nil
+	case len(slashed) >= 2 && slashed[1] == ':' && is_letter(slashed[0]):
+		if len(slashed) == 2 || slashed[2] != '/' {
+			return "", "", fmt.Errorf("destination must be an absolute path, not relative to a drive: %s", path)
+		}
+		return strings.ToUpper(slashed[:1]) + ":", slashed[3:], nil
+	}
+	return "", "", fmt.Errorf("destination must start with a drive or a UNC share: %s", path)
+}
+
+func is_letter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// windows_name refuses a file name Windows cannot create, or one it would
+// change, such as a trailing dot it silently drops
+func windows_name(name string) error {
+	if i := strings.IndexFunc(name, func(r rune) bool { return r < 32 || strings.ContainsRune(`<>:"|?*`, r) }); i >= 0 {
+		return fmt.Errorf("%q has a character Windows does not allow in names", name)
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return fmt.Errorf("%q ends with a dot or a space", name)
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if windows_reserved[strings.ToUpper(strings.TrimSpace(base))] {
+		return fmt.Errorf("%q is a device name", name)
+	}
+	return nil
+}
+
+// String is the normalised path as the OS writes it
+func (destination Destination) String() string {
+	if destination.Style.Windows {
+		return destination.Volume + `\` + strings.Join(destination.Names, `\`)
+	}
+	return "/" + strings.Join(destination.Names, "/")
+}
+
+// Key is the same for every destination the OS treats as the same folder
+func (destination Destination) Key() string {
+	return destination.Style.key(destination.String())
+}
+
+// IsRoot reports whether the destination is a drive, a share or /
+func (destination Destination) IsRoot() bool {
+	return len(destination.Names) == 0
+}
+
+// Within reports whether the destination is root or a folder below it
+func (destination Destination) Within(root Destination) bool {
+	if len(destination.Names) < len(root.Names) {
+		return false
+	}
+	same := func(a string, b string) bool {
+		return destination.Style.key(a) == destination.Style.key(b)
+	}
+	if !same(destination.Volume, root.Volume) {
+		return false
+	}
+	for i, name := range root.Names {
+		if !same(destination.Names[i], name) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveLinks is where a local destination leads once the links on the way
+// are followed. Folders that do not exist yet are not left as they are
+// written: the deepest one that exists is resolved and the rest appended to
+// it, so a new folder below a link out of a root is still outside the root.
+// A link that exists but cannot be followed is refused, as creating a folder
+// below it would follow it wherever it points.
+func ResolveLinks(destination Destination) (Destination, error) {
+	for exists := len(destination.Names); exists >= 0; exists-- {
+		ancestor := Destination{Style: destination.Style, Volume: destination.Volume, Names: destination.Names[:exists]}
+		if _, err := os.Lstat(ancestor.String()); err != nil {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(ancestor.String())
+		if err != nil {
+			return destination, fmt.Errorf("cannot follow the links of %s: %v", ancestor, err)
+		}
+		resolved, err := ParseDestination(target, destination.Style)
+		if err != nil {
+			return destination, err
+		}
+		resolved.Names = append(resolved.Names, destination.Names[exists:]...)
+		return resolved, nil
+	}
+	return destination, nil
+}
+
+// CheckDestination parses a destination and checks it is within one of the
+// roots. Without roots nothing is allowed, a caller that lets a destination go
+// anywhere has to decide so itself.
+func CheckDestination(path string, roots []string, style PathStyle) (Destination, error) {
+	destination, err := ParseDestination(path, style)
+	if err != nil {
+		return destination, err
+	}
+	if len(roots) == 0 {
+		return destination, fmt.Errorf("destination is outside the destination roots, there are none: %s", path)
+	}
+	for _, root := range roots {
+		parsed, err := ParseDestination(root, style)
+		if err == nil && destination.Within(parsed) {
+			return destination, nil
+		}
+	}
+	return destination, fmt.Errorf("destination is outside the destination roots: %s", path)
+}
@@ -0,0 +1,310 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var windows = PathStyleOf("windows")
+var linux = PathStyleOf("linux")
+var darwin = PathStyleOf("darwin")
+
+func TestPathStyleOf(t *testing.T) {
+	tests := []struct {
+		goos  string
+		style PathStyle
+	}{
+		{"windows", PathStyle{Windows: true, FoldCase: true}},
+		{"linux", PathStyle{}},
+		{"freebsd", PathStyle{}},
+		{"darwin", PathStyle{FoldCase: true}},
+	}
+	for _, test := range tests {
+		if style := PathStyleOf(test.goos); style != test.style {
+			t.Errorf("PathStyleOf(%q) = %+v, want %+v", test.goos, style, test.style)
+		}
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		style  PathStyle
+		want   string // the normalised path, empty when parsing fails
+		volume string
+		err    string // part of the error when parsing fails
+	}{
+		// drive paths
+		{"drive", `C:\sites\app`, windows, `C:\sites\app`, "C:", ""},
+		{"lower case drive", `c:\sites\app`, windows, `C:\sites\app`, "C:", ""},
+		{"forward slashes", `c:/sites/app`, windows, `C:\sites\app`, "C:", ""},
+		{"mixed slashes", `C:\sites/app\bin`, windows, `C:\sites\app\bin`, "C:", ""},
+		{"trailing separator", `C:\sites\app\`, windows, `C:\sites\app`, "C:", ""},
+		{"doubled separators", `C:\\sites\\\app`, windows, `C:\sites\app`, "C:", ""},
+		{"dot", `C:\sites\.\app`, windows, `C:\sites\app`, "C:", ""},
+		{"dot dot", `C:\sites\old\..\app`, windows, `C:\sites\app`, "C:", ""},
+		{"drive root", `D:\`, windows, `D:\`, "D:", ""},
+		{"case kept", `C:\Sites\App`, windows, `C:\Sites\App`, "C:", ""},
+		{"spaces inside names", `C:\Program Files\My App`, windows, `C:\Program Files\My App`, "C:", ""},
+		{"dots inside names", `C:\sites\app.v2\web.config.d`, windows, `C:\sites\app.v2\web.config.d`, "C:", ""},
+		{"long path prefix", `\\?\C:\sites\app`, windows, `C:\sites\app`, "C:", ""},
+		{"drive relative", `C:sites\app`, windows, "", "", "relative to a drive"},
+		{"bare drive", `C:`, windows, "", "", "relative to a drive"},
+		{"climbs above drive", `C:\..\windows`, windows, "", "", "climbs above its root"},
+		{"climbs above drive later", `C:\sites\..\..\windows`, windows, "", "", "climbs above its root"},
+		{"relative", `sites\app`, windows, "", "", "must start with a drive or a UNC share"},
+		{"rooted without drive", `\sites\app`, windows, "", "", "must start with a drive or a UNC share"},
+		{"posix on windows", `/srv/app`, windows, "", "", "must start with a drive or a UNC share"},
+		{"not a drive letter", `1:\sites`, windows, "", "", "must start with a drive or a UNC share"},
+		{"invalid character", `C:\sites\a<b`, windows, "", "", "does not allow"},
+		{"colon in a name", `C:\sites\app:stream`, windows, "", "", "does not allow"},
+		{"wildcard", `C:\sites\*`, windows, "", "", "does not allow"},
+		{"control character", "C:\\sites\\a\tb", windows, "", "", "does not allow"},
+		{"trailing dot", `C:\sites\app.`, windows, "", "", "ends with a dot or a space"},
+		{"trailing space", `C:\sites\app \bin`, windows, "", "", "ends with a dot or a space"},
+		{"device name", `C:\sites\con`, windows, "", "", "device name"},
+		{"device name with extension", `C:\sites\NUL.txt`, windows, "", "", "device name"},
+		{"device name prefix is fine", `C:\sites\console`, windows, `C:\sites\console`, "C:", ""},
+		{"device path", `\\.\PhysicalDrive0`, windows, "", "", "device path"},
+		{"empty", "", windows, "", "", "empty"},
+		{"nul", "C:\\sites\x00app", windows, "", "", "NUL"},
+
+		// UNC paths
+		{"unc", `\\server1\c$\dir1\dir2`, windows, `\\server1\c$\dir1\dir2`, `\\server1\c$`, ""},
+		{"unc forward slashes", `//server1/c$/dir1/dir2/`, windows, `\\server1\c$\dir1\dir2`, `\\server1\c$`, ""},
+		{"unc share root", `\\server1\share`, windows, `\\server1\share\`, `\\server1\share`, ""},
+		{"unc share root with separator", `\\server1\share\`, windows, `\\server1\share\`, `\\server1\share`, ""},
+		{"unc dot dot", `\\server1\share\a\..\b`, windows, `\\server1\share\b`, `\\server1\share`, ""},
+		{"unc long path prefix", `\\?\UNC\server1\share\app`, windows, `\\server1\share\app`, `\\server1\share`, ""},
+		{"unc long path prefix lower case", `\\?\unc\server1\share\app`, windows, `\\server1\share\app`, `\\server1\share`, ""},
+		{"unc without share", `\\server1`, windows, "", "", "needs a server and a share"},
+		{"unc with empty share", `\\server1\\app`, windows, "", "", "needs a server and a share"},
+		{"unc without server", `\\\share\app`, windows, "", "", "needs a server and a share"},
+		{"unc climbs above share", `\\server1\share\..\other`, windows, "", "", "climbs above its root"},
+		{"unc invalid server", `\\ser|ver\share`, windows, "", "", "does not allow"},
+
+		// POSIX paths
+		{"posix", "/srv/app", linux, "/srv/app", "", ""},
+		{"posix root", "/", linux, "/", "", ""},
+		{"posix trailing slash", "/srv/app/", linux, "/srv/app", "", ""},
+		{"posix doubled slashes", "//srv//app", linux, "/srv/app", "", ""},
+		{"posix dot dot", "/srv/app/../www", linux, "/srv/www", "", ""},
+		{"posix case kept", "/srv/App", linux, "/srv/App", "", ""},
+		{"posix allows backslashes", `/srv/a\b`, linux, `/srv/a\b`, "", ""},
+		{"posix allows windows characters", "/srv/a:b*c", linux, "/srv/a:b*c", "", ""},
+		{"posix allows device names", "/srv/con", linux, "/srv/con", "", ""},
+		{"posix relative", "srv/app", linux, "", "", "must be an absolute path"},
+		{"posix dot relative", "./srv", linux, "", "", "must be an absolute path"},
+		{"posix drive", `C:\sites`, linux, "", "", "must be an absolute path"},
+		{"posix unc", `\\server1\share`, linux, "", "", "must be an absolute path"},
+		{"posix climbs above root", "/../etc", linux, "", "", "climbs above its root"},
+		{"posix nul", "/srv/\x00", linux, "", "", "NUL"},
+		{"darwin", "/Users/ci/app/", darwin, "/Users/ci/app", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination, err := ParseDestination(test.path, test.style)
+			if len(test.err) > 0 {
+				if err == nil {
+					t.Fatalf("ParseDestination(%q) = %s, want an error with %q", test.path, destination, test.err)
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("ParseDestination(%q) error = %q, want it to contain %q", test.path, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDestination(%q) error = %v", test.path, err)
+			}
+			if got := destination.String(); got != test.want {
+				t.Errorf("ParseDestination(%q) = %s, want %s", test.path, got, test.want)
+			}
+			if destination.Volume != test.volume {
+				t.Errorf("ParseDestination(%q).Volume = %q, want %q", test.path, destination.Volume, test.volume)
+			}
+			// a normalised path parses to itself
+			again, err := ParseDestination(destination.String(), test.style)
+			if err != nil || again.String() != destination.String() {
+				t.Errorf("ParseDestination(%q) = %s, %v, want it unchanged", destination.String(), again, err)
+			}
+		})
+	}
+}
+
+func TestDestinationKey(t *testing.T) {
+	tests := []struct {
+		a     string
+		b     string
+		style PathStyle
+		same  bool
+	}{
+		{`C:\Sites\App`, `c:/sites/app/`, windows, true},
+		{`\\SERVER1\C$\App`, `//server1/c$/app`, windows, true},
+		{`\\?\C:\sites\app`, `C:\sites\app`, windows, true},
+		{`C:\sites\app`, `D:\sites\app`, windows, false},
+		{`C:\sites\app`, `C:\sites\app2`, windows, false},
+		{`\\server1\share\app`, `\\server2\share\app`, windows, false},
+		{"/srv/App", "/srv/app", linux, false},
+		{"/srv/app/", "//srv/./app", linux, true},
+		{"/Users/CI/App", "/users/ci/app", darwin, true},
+		// the long s folds to s but does not lower to it, Within must agree
+		{"C:\\\u017fites\\app", `C:\sites\app`, windows, false},
+	}
+	for _, test := range tests {
+		a, err := ParseDestination(test.a, test.style)
+		if err != nil {
+			t.Fatalf("ParseDestination(%q) error = %v", test.a, err)
+		}
+		b, err := ParseDestination(test.b, test.style)
+		if err != nil {
+			t.Fatalf("ParseDestination(%q) error = %v", test.b, err)
+		}
+		if same := a.Key() == b.Key(); same != test.same {
+			t.Errorf("%q and %q have the same key = %v, want %v", test.a, test.b, same, test.same)
+		}
+		// a folder is within another of the same key, so a queue and a check
+		// of the roots never disagree
+		if within := a.Within(b) && b.Within(a); within != test.same {
+			t.Errorf("%q and %q are within each other = %v, want %v", test.a, test.b, within, test.same)
+		}
+	}
+}
+
+func TestDestinationIsRoot(t *testing.T) {
+	tests := []struct {
+		path  string
+		style PathStyle
+		root  bool
+	}{
+		{`C:\`, windows, true},
+		{`C:\sites\..`, windows, true},
+		{`\\server1\share`, windows, true},
+		{`C:\sites`, windows, false},
+		{`\\server1\share\app`, windows, false},
+		{"/", linux, true},
+		{"/srv", linux, false},
+	}
+	for _, test := range tests {
+		destination, err := ParseDestination(test.path, test.style)
+		if err != nil {
+			t.Fatalf("ParseDestination(%q) error = %v", test.path, err)
+		}
+		if root := destination.IsRoot(); root != test.root {
+			t.Errorf("ParseDestination(%q).IsRoot() = %v, want %v", test.path, root, test.root)
+		}
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		roots []string
+		style PathStyle
+		want  string // the normalised path, empty when the check fails
+		err   string
+	}{
+		{"no roots allow nothing", `C:\anywhere`, nil, windows, "", "there are none"},
+		{"no roots still parse", `anywhere`, nil, windows, "", "must start with a drive"},
+		{"below a root", `C:\sites\app`, []string{`C:\sites`}, windows, `C:\sites\app`, ""},
+		{"the root itself", `C:\sites`, []string{`C:\sites`}, windows, `C:\sites`, ""},
+		{"root case differs", `c:\SITES\app`, []string{`C:\sites`}, windows, `C:\SITES\app`, ""},
+		{"root spelled differently", `C:\sites\app`, []string{`c:/sites/`}, windows, `C:\sites\app`, ""},
+		{"second root", `D:\www\app`, []string{`C:\sites`, `D:\www`}, windows, `D:\www\app`, ""},
+		{"outside the roots", `C:\windows\system32`, []string{`C:\sites`}, windows, "", "outside the destination roots"},
+		{"sibling with the root as prefix", `C:\sites2\app`, []string{`C:\sites`}, windows, "", "outside the destination roots"},
+		{"other drive", `D:\sites\app`, []string{`C:\sites`}, windows, "", "outside the destination roots"},
+		{"escapes with dot dot", `C:\sites\..\windows`, []string{`C:\sites`}, windows, "", "outside the destination roots"},
+		{"unc below a root", `\\server1\c$\dir1\dir2`, []string{`\\SERVER1\C$\dir1`}, windows, `\\server1\c$\dir1\dir2`, ""},
+		{"unc other share", `\\server1\d$\dir1`, []string{`\\server1\c$\dir1`}, windows, "", "outside the destination roots"},
+		{"unc root does not allow a drive", `C:\dir1`, []string{`\\server1\c$\dir1`}, windows, "", "outside the destination roots"},
+		{"long path prefix below a root", `\\?\C:\sites\app`, []string{`C:\sites`}, windows, `C:\sites\app`, ""},
+		{"drive root allows the drive", `C:\any\thing`, []string{`C:\`}, windows, `C:\any\thing`, ""},
+		{"invalid roots are skipped", `C:\sites\app`, []string{`sites`, `C:\sites`}, windows, `C:\sites\app`, ""},
+		{"posix below a root", "/srv/www/app", []string{"/srv/www"}, linux, "/srv/www/app", ""},
+		{"posix case differs", "/srv/WWW/app", []string{"/srv/www"}, linux, "", "outside the destination roots"},
+		{"posix sibling with the root as prefix", "/srv/www2", []string{"/srv/www"}, linux, "", "outside the destination roots"},
+		{"posix escapes with dot dot", "/srv/www/../../etc", []string{"/srv/www"}, linux, "", "outside the destination roots"},
+		{"posix root allows anything", "/etc", []string{"/"}, linux, "/etc", ""},
+		{"darwin case differs", "/Users/CI/app", []string{"/Users/ci"}, darwin, "/Users/CI/app", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination, err := CheckDestination(test.path, test.roots, test.style)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("CheckDestination(%q, %q) error = %v, want one with %q", test.path, test.roots, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckDestination(%q, %q) error = %v", test.path, test.roots, err)
+			}
+			if got := destination.String(); got != test.want {
+				t.Errorf("CheckDestination(%q, %q) = %s, want %s", test.path, test.roots, got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveLinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, path := range []string{filepath.Join(root, "app"), outside} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("links cannot be made here: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(path string) (Destination, error) {
+		destination, err := ParseDestination(path, LocalPathStyle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ResolveLinks(destination)
+	}
+	// the temporary folder may itself be below a link
+	resolved_root, err := resolve(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		within bool
+		err    bool
+	}{
+		{"existing folder", filepath.Join(root, "app"), true, false},
+		{"new folders", filepath.Join(root, "app", "new", "deeper"), true, false},
+		{"link out of the root", filepath.Join(root, "link"), false, false},
+		{"new folder below a link out of the root", filepath.Join(root, "link", "newdir"), false, false},
+		{"new folder below a dangling link", filepath.Join(root, "dangling", "newdir"), false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := resolve(test.path)
+			if test.err {
+				if err == nil {
+					t.Fatalf("ResolveLinks(%s) = %s, want an error", test.path, resolved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveLinks(%s) error = %v", test.path, err)
+			}
+			if within := resolved.Within(resolved_root); within != test.within {
+				t.Errorf("ResolveLinks(%s) = %s, within the root %v, want %v", test.path, resolved, within, test.within)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// the exec endpoint runs a command from the agent's allow-list, the client
+// sends EXEC| with an ExecRequest and the agent streams output back
+const EXEC_PATH = "/exec"
+const EXEC_BAR = "EXEC|"
+const STDOUT_BAR = "STDOUT: "
+const STDERR_BAR = "STDERR: "
+const EXIT_BAR = "EXIT: "
+
+// ExecRequest names an allowed command, the directory to run it in and the
+// values for its argument templates
+type ExecRequest struct {
+	Command string            `json:"command"`
+	Dir     string            `json:"dir"`
+	Params  map[string]string `json:"params"`
+}
+
+func FormatExec(request ExecRequest) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	return EXEC_BAR + string(data), nil
+}
+
+func ParseExec(message string) (ExecRequest, error) {
+	var request ExecRequest
+	err := json.Unmarshal([]byte(strings.TrimPrefix(message, EXEC_BAR)), &request)
+	return request, err
+}
@@ -0,0 +1,256 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FETCH_ATTEMPTS = 5
+const FETCH_RETRY_DELAY = 2 * time.Second
+
+// FETCH_TIMEOUT bounds connecting to the source, waiting for its answer and
+// each read of the package. There is no limit on the whole download, which
+// runs as long as data keeps arriving, but a source that stalls fails the
+// attempt rather than holding the destination locks of the deploy.
+const FETCH_TIMEOUT = 30 * time.Second
+
+var fetch_dialer = net.Dialer{Timeout: FETCH_TIMEOUT, KeepAlive: 30 * time.Second}
+
+var fetch_client = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	TLSHandshakeTimeout:   FETCH_TIMEOUT,
+	ResponseHeaderTimeout: FETCH_TIMEOUT,
+	DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := fetch_dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &idle_conn{Conn: conn, timeout: FETCH_TIMEOUT}, nil
+	},
+}}
+
+// idle_conn moves its deadline on with each read and write, so it only
+// expires once no data has moved for the timeout
+type idle_conn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *idle_conn) Read(b []byte) (int, error) {
+	if err := conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *idle_conn) Write(b []byte) (int, error) {
+	if err := conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(b)
+}
+
+// IsRemoteSource reports whether a package source is an HTTP(S) URL rather
+// than a local path or file share
+func IsRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// FETCH_PART_SUFFIX is added to the name of a package while it downloads
+const FETCH_PART_SUFFIX = ".part"
+
+// fetch_locks has a mutex for each package being downloaded, so fetches of
+// the same package take turns and the later ones find it downloaded
+var fetch_locks sync.Map
+
+// FetchPackage downloads source into dst_path and checks its sha256 against
+// digest. The download goes to dst_path with FETCH_PART_SUFFIX and is only
+// renamed to dst_path once its digest matches, so dst_path is never a partial
+// or wrong package. A part left by an earlier attempt is resumed rather than
+// started over, and failed attempts are retried. source is an HTTP(S) URL, a
+// file:// URL or a local or UNC path. max_size of zero is unlimited.
+func FetchPackage(source string, dst_path string, digest []byte, max_size int, progress *ProgressInfo) error {
+	lock, _ := fetch_locks.LoadOrStore(dst_path, new(sync.Mutex))
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// a package fetched by an earlier deploy is used as is
+	if file_digest(dst_path) == hex.EncodeToString(digest) {
+		return nil
+	}
+	part_path := dst_path + FETCH_PART_SUFFIX
+	var err error
+	for attempt := 1; attempt <= FETCH_ATTEMPTS; attempt++ {
+		if err = fetch_once(source, part_path, max_size, progress); err == nil {
+			break
+		}
+		// the part of a download that keeps failing is resumed by the next
+		// deploy, one that cannot succeed is removed
+		var fatal *fetchError
+		if errors.As(err, &fatal) {
+			os.Remove(part_path)
+			return err
+		}
+		if attempt == FETCH_ATTEMPTS {
+			return err
+		}
+		time.Sleep(FETCH_RETRY_DELAY)
+	}
+	if received := file_digest(part_path); received != hex.EncodeToString(digest) {
+		os.Remove(part_path)
+		return fmt.Errorf("digest mismatch for %s, expected %s and received %s", source, hex.EncodeToString(digest), received)
+	}
+	return os.Rename(part_path, dst_path)
+}
+
+// file_digest is the sha256 of the file in hex, or empty if it cannot be read
+func file_digest(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// fetchError is a failure that retrying will not fix
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+func fetch_once(source string, dst_path string, max_size int, progress *ProgressInfo) error {
+	file, err := os.OpenFile(dst_path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return &fetchError{err}
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &fetchError{err}
+	}
+
+	body, total, offset, err := open_source(source, offset)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if max_size > 0 && total > int64(max_size) {
+		return &fetchError{fmt.Errorf("package of %s is larger than the limit of %s", FormatBytes(int(total)), FormatBytes(max_size))}
+	}
+	if err := file.Truncate(offset); err != nil {
+		return &fetchError{err}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return &fetchError{err}
+	}
+
+	buffer := make([]byte, 64*1024)
+	count := offset
+	for {
+		n, read_err := body.Read(buffer)
+		if n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return &fetchError{err}
+			}
+			count += int64(n)
+			if max_size > 0 && count > int64(max_size) {
+				return &fetchError{fmt.Errorf("package is larger than the limit of %s", FormatBytes(max_size))}
+			}
+			progress.Write(int(count), int(total), "downloading")
+		}
+		if read_err == io.EOF {
+			break
+		}
+		if read_err != nil {
+			return read_err
+		}
+	}
+	if total > 0 && count != total {
+		return fmt.Errorf("download ended at %d of %d bytes", count, total)
+	}
+	progress.Writeln(int(count), int(count), "download complete")
+	return nil
+}
+
+// open_source opens the package at the offset, returning the offset actually
+// used, which is zero when the source cannot resume, and the total size or
+// zero when it is unknown
+func open_source(source string, offset int64) (body io.ReadCloser, total int64, start int64, err error) {
+	if !IsRemoteSource(source) {
+		path := source
+		if u, err := url.Parse(source); err == nil && u.Scheme == "file" {
+			path = u.Path
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, 0, &fetchError{err}
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, 0, err
+		}
+		if offset > info.Size() {
+			offset = 0
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, 0, 0, err
+		}
+		return file, info.Size(), offset, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, 0, 0, &fetchError{err}
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := fetch_client.Do(request)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		if response.ContentLength < 0 {
+			return response.Body, 0, offset, nil
+		}
+		return response.Body, offset + response.ContentLength, offset, nil
+	case http.StatusOK:
+		if response.ContentLength < 0 {
+			return response.Body, 0, 0, nil
+		}
+		return response.Body, response.ContentLength, 0, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is at least as long as the package, start over
+		response.Body.Close()
+		return open_source(source, 0)
+	}
+	response.Body.Close()
+	err = fmt.Errorf("failed to download %s: %s", source, response.Status)
+	if response.StatusCode >= 500 {
+		return nil, 0, 0, err
+	}
+	return nil, 0, 0, &fetchError{err}
+}
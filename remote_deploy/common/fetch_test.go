@@ -0,0 +1,128 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// artifact_server serves one package and records the Range of each request
+type artifact_server struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	ranges []string
+}
+
+func new_artifact_server(t *testing.T, data []byte) *artifact_server {
+	server := new(artifact_server)
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		server.ranges = append(server.ranges, r.Header.Get("Range"))
+		server.mutex.Unlock()
+		http.ServeContent(w, r, "app.tar.gz", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func fetch_data() []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), 20000)
+}
+
+func check_fetched(t *testing.T, dst_path string, data []byte) {
+	t.Helper()
+	fetched, err := os.ReadFile(dst_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, data) {
+		t.Errorf("fetched %d bytes that differ from the %d served", len(fetched), len(data))
+	}
+	if _, err := os.Stat(dst_path + FETCH_PART_SUFFIX); !os.IsNotExist(err) {
+		t.Errorf("the part file is left after the download: %v", err)
+	}
+}
+
+func TestFetchPackage(t *testing.T) {
+	data := fetch_data()
+	digest := sha256.Sum256(data)
+	server := new_artifact_server(t, data)
+	dst_path := filepath.Join(t.TempDir(), "app.tar.gz")
+
+	if err := FetchPackage(server.URL+"/app.tar.gz", dst_path, digest[:], 0, BeginProgressTo(ProgressBytesRate)); err != nil {
+		t.Fatal(err)
+	}
+	check_fetched(t, dst_path, data)
+
+	// a package already there is not downloaded again
+	if err := FetchPackage(server.URL+"/app.tar.gz", dst_path, digest[:], 0, BeginProgressTo(ProgressBytesRate)); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.ranges) != 1 {
+		t.Errorf("%d requests were made, want 1", len(server.ranges))
+	}
+}
+
+func TestFetchPackageResume(t *testing.T) {
+	data := fetch_data()
+	digest := sha256.Sum256(data)
+	server := new_artifact_server(t, data)
+	dst_path := filepath.Join(t.TempDir(), "app.tar.gz")
+	// the part an interrupted download left
+	if err := os.WriteFile(dst_path+FETCH_PART_SUFFIX, data[:100000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FetchPackage(server.URL+"/app.tar.gz", dst_path, digest[:], 0, BeginProgressTo(ProgressBytesRate)); err != nil {
+		t.Fatal(err)
+	}
+	check_fetched(t, dst_path, data)
+	if len(server.ranges) != 1 || server.ranges[0] != "bytes=100000-" {
+		t.Errorf("requested ranges %q, want [bytes=100000-]", server.ranges)
+	}
+}
+
+func TestFetchPackageDigestMismatch(t *testing.T) {
+	data := fetch_data()
+	digest := sha256.Sum256([]byte("another package"))
+	server := new_artifact_server(t, data)
+	dst_path := filepath.Join(t.TempDir(), "app.tar.gz")
+
+	err := FetchPackage(server.URL+"/app.tar.gz", dst_path, digest[:], 0, BeginProgressTo(ProgressBytesRate))
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("FetchPackage() = %v, want a digest mismatch", err)
+	}
+	for _, path := range []string{dst_path, dst_path + FETCH_PART_SUFFIX} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is left after a digest mismatch: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestFetchPackageMaxSize(t *testing.T) {
+	data := fetch_data()
+	digest := sha256.Sum256(data)
+	server := new_artifact_server(t, data)
+	dst_path := filepath.Join(t.TempDir(), "app.tar.gz")
+
+	err := FetchPackage(server.URL+"/app.tar.gz", dst_path, digest[:], len(data)-1, BeginProgressTo(ProgressBytesRate))
+	if err == nil || !strings.Contains(err.Error(), "larger than the limit") {
+		t.Fatalf("FetchPackage() = %v, want the size limit", err)
+	}
+	// the limit is not retried
+	if len(server.ranges) != 1 {
+		t.Errorf("%d requests were made, want 1", len(server.ranges))
+	}
+	for _, path := range []string{dst_path, dst_path + FETCH_PART_SUFFIX} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is left after going over the limit: %v", filepath.Base(path), err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"os"
+	"time"
+)
+
+// agent endpoints for looking at and cleaning up destinations, the path to
+// work on is passed as the path query parameter
+const FS_LIST = "/fs/list"
+const FS_STAT = "/fs/stat"
+const FS_GET = "/fs/get"
+const FS_DELETE = "/fs/delete"
+
+// FileEntry is how the agent describes a file or directory
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Dir     bool      `json:"dir"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func NewFileEntry(info os.FileInfo) FileEntry {
+	return FileEntry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Dir:     info.IsDir(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+	}
+}
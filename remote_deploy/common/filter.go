@@ -0,0 +1,50 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Filter picks which files of a source folder go into a package. Patterns use
+// path.Match syntax and are matched against the slash separated path relative
+// to the source and against the base name, so "*.pdb" matches at any depth.
+// With no Include patterns every file is included.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+func (filter *Filter) Validate() error {
+	for _, pattern := range append(append([]string{}, filter.Include...), filter.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid filter pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the relative path is packaged, excluded directories
+// are skipped with everything in them and include patterns only apply to files
+func (filter *Filter) Match(name string, dir bool) bool {
+	name = strings.TrimPrefix(name, "/")
+	if filter == nil || len(name) == 0 {
+		return true
+	}
+	if match_any(filter.Exclude, name) {
+		return false
+	}
+	return dir || len(filter.Include) == 0 || match_any(filter.Include, name)
+}
+
+func match_any(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level orders log records, a logger drops records below its level
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var level_names = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "level" + strconv.Itoa(int(level))
+	}
+	return level_names[level]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range level_names {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %s, the levels are: %s", s, strings.Join(level_names, ", "))
+}
+
+// log formats shared by every handler that writes lines
+const LOG_TEXT = "text"
+const LOG_JSON = "json"
+
+func ValidateLogFormat(format string) error {
+	if format != LOG_TEXT && format != LOG_JSON {
+		return fmt.Errorf("invalid log format %s, the formats are: %s, %s", format, LOG_TEXT, LOG_JSON)
+	}
+	return nil
+}
+
+type LogField struct {
+	Key   string
+	Value any
+}
+
+// LogRecord is one line of a log, the fields of the logger come before the
+// fields of the call
+type LogRecord struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []LogField
+}
+
+// LogHandler writes records somewhere, such as a file or the Windows event
+// log. Handlers are called from many goroutines and do their own locking.
+type LogHandler interface {
+	Handle(record LogRecord)
+}
+
+// Logger writes levelled records with key/value fields to its handlers:
+//
+//	logger.Info("deploy finished", "destination", dst, "items", count)
+//
+// A nil *Logger drops everything, so a logger can be used before it is set up.
+type Logger struct {
+	level    Level
+	handlers []LogHandler
+	fields   []LogField
+}
+
+func NewLogger(level Level, handlers ...LogHandler) *Logger {
+	return &Logger{level: level, handlers: handlers}
+}
+
+// With returns a logger that adds the fields to every record, it is how a
+// deploy ID ends up on every line of a deploy
+func (logger *Logger) With(kv ...any) *Logger {
+	if logger == nil {
+		return nil
+	}
+	child := *logger
+	child.fields = append(append([]LogField(nil), logger.fields...), log_fields(kv)...)
+	return &child
+}
+
+func (logger *Logger) Enabled(level Level) bool {
+	return logger != nil && level >= logger.level
+}
+
+func (logger *Logger) Log(level Level, message string, kv ...any) {
+	if !logger.Enabled(level) {
+		return
+	}
+	record := LogRecord{Time: time.Now(), Level: level, Message: message, Fields: append(append([]LogField(nil), logger.fields...), log_fields(kv)...)}
+	for _, handler := range logger.handlers {
+		handler.Handle(record)
+	}
+}
+
+func (logger *Logger) Debug(message string, kv ...any) { logger.Log(LevelDebug, message, kv...) }
+func (logger *Logger) Info(message string, kv ...any)  { logger.Log(LevelInfo, message, kv...) }
+func (logger *Logger) Warn(message string, kv ...any)  { logger.Log(LevelWarn, message, kv...) }
+func (logger *Logger) Error(message string, kv ...any) { logger.Log(LevelError, message, kv...) }
+
+// log_fields pairs up keys and values, a value without a key is kept under
+// "!extra" rather than dropped
+func log_fields(kv []any) []LogField {
+	fields := make([]LogField, 0, (len(kv)+1)/2)
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			fields = append(fields, LogField{Key: "!extra", Value: kv[i]})
+			break
+		}
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		fields = append(fields, LogField{Key: key, Value: kv[i+1]})
+	}
+	return fields
+}
+
+// log_value turns errors, durations and other Stringers into text so both
+// formats show them the same way
+func log_value(value any) any {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	case string, bool, int, int64, uint64, float64:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// FormatLogFields writes the fields as key=value pairs, quoting values that
+// would otherwise be ambiguous
+func FormatLogFields(fields []LogField) string {
+	var b strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(field.Key)
+		b.WriteByte('=')
+		text := fmt.Sprint(log_value(field.Value))
+		if len(text) == 0 || strings.ContainsAny(text, " =\"\\\t\r\n") {
+			text = strconv.Quote(text)
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// FormatLogText is one line such as
+// 2006-01-02T15:04:05.000Z07:00 INFO deploy finished deploy=4f2a items=12
+func FormatLogText(record LogRecord) string {
+	line := record.Time.Format("2006-01-02T15:04:05.000Z07:00") + " " + strings.ToUpper(record.Level.String()) + " " + record.Message
+	if len(record.Fields) > 0 {
+		line += " " + FormatLogFields(record.Fields)
+	}
+	return line
+}
+
+// FormatLogJSON is one object per line with time, level and msg followed by
+// the fields, a field named like one of those three is dropped
+func FormatLogJSON(record LogRecord) string {
+	var b strings.Builder
+	write := func(key string, value any) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('{')
+	write("time", record.Time.Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	write("level", record.Level.String())
+	b.WriteByte(',')
+	write("msg", record.Message)
+	for _, field := range record.Fields {
+		if field.Key == "time" || field.Key == "level" || field.Key == "msg" {
+			continue
+		}
+		b.WriteByte(',')
+		write(field.Key, log_value(field.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func format_log(record LogRecord, format string) string {
+	if format == LOG_JSON {
+		return FormatLogJSON(record)
+	}
+	return FormatLogText(record)
+}
+
+// WriterHandler writes each record as a line of text or JSON
+type WriterHandler struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format string
+}
+
+func NewWriterHandler(writer io.Writer, format string) *WriterHandler {
+	return &WriterHandler{writer: writer, format: format}
+}
+
+func (handler *WriterHandler) Handle(record LogRecord) {
+	line := format_log(record, handler.format)
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	fmt.Fprintln(handler.writer, line)
+}
+
+// RotatingFileHandler writes lines to a file, once the file would grow past
+// max_size it is renamed to path.1, path.1 to path.2 and so on, keeping
+// max_files old files
+type RotatingFileHandler struct {
+	mutex     sync.Mutex
+	path      string
+	format    string
+	max_size  int
+	max_files int
+	file      *os.File
+	size      int
+	closed    bool
+}
+
+func NewRotatingFileHandler(path string, format string, max_size int, max_files int) (*RotatingFileHandler, error) {
+	handler := &RotatingFileHandler{path: path, format: format, max_size: max_size, max_files: max_files}
+	if err := handler.open(); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+func (handler *RotatingFileHandler) open() error {
+	file, err := os.OpenFile(handler.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	handler.file = file
+	handler.size = int(info.Size())
+	return nil
+}
+
+func (handler *RotatingFileHandler) Handle(record LogRecord) {
+	line := format_log(record, handler.format) + "\n"
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	if handler.closed {
+		return
+	}
+	if handler.size > 0 && handler.size+len(line) > handler.max_size {
+		if err := handler.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %v\n", handler.path, err)
+		}
+	}
+	if handler.file == nil {
+		return
+	}
+	n, _ := handler.file.WriteString(line)
+	handler.size += n
+}
+
+// rotate always reopens the file, a failed rename leaves the lines going to
+// the current file rather than being lost
+func (handler *RotatingFileHandler) rotate() error {
+	if handler.file != nil {
+		handler.file.Close()
+		handler.file = nil
+	}
+	for i := handler.max_files; i > 0; i-- {
+		older := handler.path + "." + strconv.Itoa(i)
+		if i == handler.max_files {
+			os.Remove(older)
+			continue
+		}
+		os.Rename(older, handler.path+"."+strconv.Itoa(i+1))
+	}
+	var err error
+	if handler.max_files > 0 {
+		err = os.Rename(handler.path, handler.path+".1")
+	} else {
+		err = os.Remove(handler.path)
+	}
+	if open_err := handler.open(); open_err != nil {
+		return open_err
+	}
+	return err
+}
+
+// Close closes the file, lines handled after it are dropped rather than
+// reopening the file
+func (handler *RotatingFileHandler) Close() error {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	handler.closed = true
+	if handler.file == nil {
+		return nil
+	}
+	err := handler.file.Close()
+	handler.file = nil
+	return err
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var log_time = time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+func log_record(message string, kv ...any) LogRecord {
+	return LogRecord{Time: log_time, Level: LevelInfo, Message: message, Fields: log_fields(kv)}
+}
+
+func read_log(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileHandlerRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	line := func(i int) string {
+		return FormatLogText(log_record("line "+strconv.Itoa(i))) + "\n"
+	}
+	// two lines fit in a file, the third starts the next one
+	handler, err := NewRotatingFileHandler(path, LOG_TEXT, 2*len(line(1))+1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	for i := 1; i <= 8; i++ {
+		handler.Handle(log_record("line " + strconv.Itoa(i)))
+	}
+
+	want := map[string]string{
+		path:        line(7) + line(8),
+		path + ".1": line(5) + line(6),
+		path + ".2": line(3) + line(4),
+	}
+	for file, content := range want {
+		if got := read_log(t, file); got != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, content)
+		}
+	}
+	// the oldest lines went with the file beyond max_files
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("agent.log.3 is kept beyond max_files: %v", err)
+	}
+
+	handler.Close()
+	handler.Handle(log_record("line 9"))
+	if got := read_log(t, path); got != want[path] {
+		t.Errorf("a line handled after Close was written: %q", got)
+	}
+}
+
+func TestRotatingFileHandlerAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	first := FormatLogText(log_record("before a restart")) + "\n"
+	if err := os.WriteFile(path, []byte(first), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the size of the file already there counts towards max_size
+	handler, err := NewRotatingFileHandler(path, LOG_TEXT, len(first)+1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	handler.Handle(log_record("after a restart"))
+	if got := read_log(t, path+".1"); got != first {
+		t.Errorf("agent.log.1 = %q, want %q", got, first)
+	}
+}
+
+func TestRotatingFileHandlerFormats(t *testing.T) {
+	record := log_record("deploy finished", "deploy", "4f2a", "items", 12, "dst", `C:\sites\my app`, "msg", "dropped")
+	t.Run("text", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.log")
+		handler, err := NewRotatingFileHandler(path, LOG_TEXT, 1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer handler.Close()
+		handler.Handle(record)
+		want := `2024-01-02T03:04:05.006Z INFO deploy finished deploy=4f2a items=12 dst="C:\\sites\\my app" msg=dropped` + "\n"
+		if got := read_log(t, path); got != want {
+			t.Errorf("text line = %q, want %q", got, want)
+		}
+	})
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.jsonl")
+		handler, err := NewRotatingFileHandler(path, LOG_JSON, 1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer handler.Close()
+		handler.Handle(record)
+		handler.Handle(log_record("second"))
+		lines := strings.Split(strings.TrimSuffix(read_log(t, path), "\n"), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("%d lines were written, want one per record", len(lines))
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+			t.Fatalf("%q is not JSON: %v", lines[0], err)
+		}
+		want := map[string]any{"time": "2024-01-02T03:04:05.006Z", "level": "info", "msg": "deploy finished", "deploy": "4f2a", "items": 12.0, "dst": `C:\sites\my app`}
+		for key, value := range want {
+			if fields[key] != value {
+				t.Errorf("%s = %v, want %v", key, fields[key], value)
+			}
+		}
+		if len(fields) != len(want) {
+			t.Errorf("fields = %v, want only %v", fields, want)
+		}
+	})
+}
@@ -3,6 +3,8 @@ package common
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +17,32 @@ import (
 
 const DATA_DONE = "DATA_DONE"
 const META_BAR = "META|"
+const ERROR_BAR = "ERROR: "
+
+// error kinds sent with ERROR messages so the client can tell why a deploy failed
+const ERROR_AUTH = "AUTH"
+const ERROR_TRANSFER = "TRANSFER"
+const ERROR_EXTRACT = "EXTRACT"
+const ERROR_BUSY = "BUSY"
+const ERROR_LIMIT = "LIMIT"
+const ERROR_EXEC = "EXEC"
+const ERROR_RELEASE = "RELEASE"
+
+func FormatError(kind string, err error) string {
+	return ERROR_BAR + kind + ": " + err.Error()
+}
+
+// ParseError splits an ERROR message into its kind and text, messages from
+// agents that do not send a kind are returned with an empty kind
+func ParseError(message string) (kind string, text string) {
+	text = strings.TrimPrefix(message, ERROR_BAR)
+	for _, k := range []string{ERROR_AUTH, ERROR_TRANSFER, ERROR_EXTRACT, ERROR_BUSY, ERROR_LIMIT, ERROR_EXEC, ERROR_RELEASE} {
+		if strings.HasPrefix(text, k+": ") {
+			return k, text[len(k)+2:]
+		}
+	}
+	return "", text
+}
 
 const KB float64 = 1024
 const MB float64 = KB * KB
@@ -36,71 +64,35 @@ func FormatBytes(x int) string {
 	}
 }
 
-func ProgressBytesValue(count int, total int, message string) string {
-	return fmt.Sprintf("[%.0f%%] %s %s", 100.0*float64(count)/float64(total), FormatBytes(count), message)
-}
-
-func ProgressEachValue(count int, total int, message string) string {
-	return fmt.Sprintf("[%.0f%%] %d/%d %s", 100.0*float64(count)/float64(total), count, total, message)
-}
-
-func ProgressMessageValue(count int, total int, message string) string {
-	return message
-}
-
-type ProgressFunc func(count int, total int, message string) string
-
-type ProgressInfo struct {
-	timeStamp         time.Time
-	rateLimit         time.Duration // limit progress updates by rate limit
-	previouslyWritten int
-	progress          ProgressFunc
-	print             bool
-}
-
-func (info *ProgressInfo) Write(count int, total int, message string) {
-	elapsed := time.Since(info.timeStamp)
-	if elapsed > info.rateLimit {
-		info.timeStamp = time.Now()
-		progress_message := info.progress(count, total, message)
-		if info.print {
-			message_length := len([]rune(progress_message))
-			erase_length := info.previouslyWritten - message_length
-			fmt.Print("\r", progress_message)
-			if erase_length > 0 {
-				fmt.Print(strings.Repeat(" ", erase_length), strings.Repeat("\b", erase_length))
-			}
-			info.previouslyWritten = message_length
-		}
+func FormatDuration(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
 	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
 }
 
-func (info *ProgressInfo) Writeln(count int, total int, message string) {
-	progress_message := info.progress(count, total, message)
-	message_length := len([]rune(progress_message))
-	erase_length := info.previouslyWritten - message_length
-	if info.print {
-		fmt.Print("\r", progress_message)
-		if erase_length > 0 {
-			fmt.Print(strings.Repeat(" ", erase_length), strings.Repeat("\b", erase_length))
+// ParseBytes reads sizes such as "512", "64KB", "1.5 MB" or "5MB/s" as bytes,
+// the units match the ones written by FormatBytes
+func ParseBytes(s string) (int, error) {
+	value := strings.ToUpper(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "/s")))
+	units := []struct {
+		suffix string
+		size   float64
+	}{{"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB}, {"B", 1}}
+	multiplier := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.size
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
 		}
-		fmt.Println()
-		info.previouslyWritten = 0
 	}
-}
-
-func (info *ProgressInfo) DisablePrint() {
-	info.print = false
-}
-
-func BeginProgress(progress ProgressFunc) *ProgressInfo {
-	var info = new(ProgressInfo)
-	info.rateLimit = 100 * time.Millisecond
-	info.timeStamp = time.Now()
-	info.previouslyWritten = 0
-	info.print = true
-	info.progress = progress
-	return info
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid byte size: %s", s)
+	}
+	return int(number * multiplier), nil
 }
 
 func EnsureDir(path string) error {
@@ -112,16 +104,26 @@ func EnsureDir(path string) error {
 	return nil
 }
 
-func Compress(src string, dst io.Writer, progress *ProgressInfo) (compress_count int, err error) {
+func Compress(src string, dst io.Writer, progress *ProgressInfo) (manifest *Manifest, err error) {
+	return CompressFiltered(src, dst, nil, progress)
+}
+
+// CompressFiltered packages only what the filter matches, a nil filter
+// packages everything
+func CompressFiltered(src string, dst io.Writer, filter *Filter, progress *ProgressInfo) (manifest *Manifest, err error) {
 	zip_writer := gzip.NewWriter(dst)
 	defer zip_writer.Close()
 	tar_writer := tar.NewWriter(zip_writer)
 	defer tar_writer.Close()
 	total := 0
 	count := 0
+	manifest = new(Manifest)
 
 	// need to walk all files to count them
 	filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err == nil && !filter.Match(filepath.ToSlash(file[len(src):]), info.IsDir()) {
+			return skip_filtered(info)
+		}
 		total++
 		return nil
 	})
@@ -131,6 +133,9 @@ func Compress(src string, dst io.Writer, progress *ProgressInfo) (compress_count
 		if err != nil {
 			return err
 		}
+		if !filter.Match(filepath.ToSlash(file[len(src):]), info.IsDir()) {
+			return skip_filtered(info)
+		}
 		header, err := tar.FileInfoHeader(info, file)
 		if err != nil {
 			return err
@@ -139,6 +144,17 @@ func Compress(src string, dst io.Writer, progress *ProgressInfo) (compress_count
 		header.Name = filepath.ToSlash(file[len(src):])
 		if len(header.Name) == 0 {
 			header.Name = fmt.Sprintf("ROOT%d", total)
+			if !info.IsDir() {
+				// a single file is packaged as an empty ROOT followed by the file
+				root := &tar.Header{Name: header.Name, Typeflag: tar.TypeDir, Mode: 0755, ModTime: info.ModTime()}
+				if err := tar_writer.WriteHeader(root); err != nil {
+					return err
+				}
+				header.Name = "/" + filepath.Base(file)
+				manifest.add(header.Name, info)
+			}
+		} else {
+			manifest.add(header.Name, info)
 		}
 		progress.Write(count, total, "compressing: "+filepath.Dir(header.Name))
 		count++
@@ -152,9 +168,12 @@ func Compress(src string, dst io.Writer, progress *ProgressInfo) (compress_count
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(tar_writer, data); err != nil {
+			defer data.Close()
+			hash := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(tar_writer, hash), data); err != nil {
 				return err
 			}
+			manifest.Files[len(manifest.Files)-1].Digest = hex.EncodeToString(hash.Sum(nil))
 		}
 
 		return nil
@@ -162,15 +181,32 @@ func Compress(src string, dst io.Writer, progress *ProgressInfo) (compress_count
 
 	if err != nil {
 		fmt.Println()
-		return 0, err
+		return nil, err
 	}
 
 	progress.Writeln(total, total, "compression complete")
 
-	return count, nil
+	manifest.Items = count
+	return manifest, nil
+}
+
+// skip_filtered leaves out a filtered file, or a filtered directory and
+// everything in it
+func skip_filtered(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
 }
 
 func Uncompress(src io.Reader, dst string, progress *ProgressInfo) error {
+	return UncompressTemplates(src, dst, nil, progress)
+}
+
+// UncompressTemplates extracts a package, writing the files templates has
+// rendered in place of their templates. Templates.Render must have read the
+// package first, nil templates extract every file as it is.
+func UncompressTemplates(src io.Reader, dst string, templates *Templates, progress *ProgressInfo) error {
 	zip_reader, err := gzip.NewReader(src)
 	if err != nil {
 		return err
@@ -201,11 +237,22 @@ func Uncompress(src io.Reader, dst string, progress *ProgressInfo) error {
 			return err
 		}
 
-		target := filepath.Join(dst, header.Name)
+		target, err := ExtractTarget(dst, header.Name)
+		if err != nil {
+			return err
+		}
 		count++
 		progress.Write(count, total_items, filepath.Dir(target))
 
-		tar_to_target(target, header, tar_reader)
+		if content, ok := templates.content(header.Name); ok && header.Typeflag == tar.TypeReg {
+			if err := os.WriteFile(TemplateTarget(target), content, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tar_to_target(target, header, tar_reader); err != nil {
+			return err
+		}
 	}
 
 	progress.Writeln(total_items, total_items, "decompression complete")
@@ -222,7 +269,7 @@ func tar_to_target(target string, header *tar.Header, tar_reader *tar.Reader) er
 			return err
 		}
 	case tar.TypeReg:
-		file, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 		if err != nil {
 			return err
 		}
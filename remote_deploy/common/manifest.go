@@ -0,0 +1,109 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const MANIFEST_BAR = "MANIFEST|"
+
+// ManifestEntry describes one item of a deploy package, Path is slash
+// separated and relative to the package root
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Dir    bool   `json:"dir,omitempty"`
+	Digest string `json:"sha256,omitempty"` // of the file's content in hex
+}
+
+// Manifest lists what a deploy package will write, it is built by Compress
+// and sent ahead of the data so the agent can check it before the upload
+type Manifest struct {
+	Items int             `json:"items"`
+	Bytes int64           `json:"bytes"`
+	Files []ManifestEntry `json:"files"`
+}
+
+func (manifest *Manifest) add(name string, info os.FileInfo) {
+	entry := ManifestEntry{Path: strings.TrimPrefix(name, "/"), Dir: info.IsDir()}
+	if !entry.Dir {
+		entry.Size = info.Size()
+		manifest.Bytes += entry.Size
+	}
+	manifest.Files = append(manifest.Files, entry)
+}
+
+// RequiredSpace is how many more bytes extracting to dst needs, files that
+// already exist are replaced so only growth counts
+func (manifest *Manifest) RequiredSpace(dst string) int64 {
+	var required int64
+	for _, entry := range manifest.Files {
+		if entry.Dir {
+			continue
+		}
+		existing := int64(0)
+		if info, err := os.Stat(filepath.Join(dst, filepath.FromSlash(entry.Path))); err == nil && !info.IsDir() {
+			existing = info.Size()
+		}
+		if entry.Size > existing {
+			required += entry.Size - existing
+		}
+	}
+	return required
+}
+
+// ReadManifest builds the manifest of a package from its tar headers, it is
+// used for packages the agent fetched itself rather than received from a client
+func ReadManifest(src io.Reader) (*Manifest, error) {
+	zip_reader, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer zip_reader.Close()
+
+	manifest := new(Manifest)
+	tar_reader := tar.NewReader(zip_reader)
+	for {
+		header, err := tar_reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Items++
+		if strings.HasPrefix(header.Name, "ROOT") {
+			continue
+		}
+		manifest.add(header.Name, header.FileInfo())
+		if header.Typeflag == tar.TypeReg {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tar_reader); err != nil {
+				return nil, err
+			}
+			manifest.Files[len(manifest.Files)-1].Digest = hex.EncodeToString(hash.Sum(nil))
+		}
+	}
+	return manifest, nil
+}
+
+func FormatManifest(manifest *Manifest) (string, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	return MANIFEST_BAR + string(data), nil
+}
+
+func ParseManifest(message string) (*Manifest, error) {
+	manifest := new(Manifest)
+	err := json.Unmarshal([]byte(strings.TrimPrefix(message, MANIFEST_BAR)), manifest)
+	return manifest, err
+}
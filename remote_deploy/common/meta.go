@@ -0,0 +1,136 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// messages the agent sends while a deploy waits for its destinations
+const READY = "READY"
+const QUEUED_BAR = "QUEUED: "
+
+// DeployMeta is the first message of a deploy, it is sent as
+// META|<size>|<count>|<dst1,dst2>|key=value|key=value
+// the leading fields are positional, options are key=value so they can be
+// added without breaking older agents
+type DeployMeta struct {
+	Size         int
+	Count        int
+	Destinations []string
+	Wait         bool              // queue behind other deploys instead of failing when busy
+	Source       string            // the agent fetches the package from this URL or path
+	Digest       string            // sha256 of a fetched or staged package in hex
+	Mirror       bool              // delete what is in a destination but not in the package
+	DryRun       bool              // only report the plan for each destination
+	ID           string            // names the deploy so the client can resume it
+	Release      string            // label of what is deployed, such as a git SHA, version or build number
+	Force        bool              // deploy a release older than the one a destination is on
+	Vars         map[string]string // values for the templates of the package, see Templates
+}
+
+// Fetched reports whether the agent supplies the package itself rather than
+// receiving it, either from Source or, with only a Digest, from a package it
+// already has staged as a rollback does
+func (meta *DeployMeta) Fetched() bool {
+	return len(meta.Digest) > 0
+}
+
+func FormatMeta(meta DeployMeta) string {
+	fields := []string{
+		strconv.Itoa(meta.Size),
+		strconv.Itoa(meta.Count),
+		strings.Join(meta.Destinations, ","),
+	}
+	if meta.Wait {
+		fields = append(fields, "wait=1")
+	}
+	if len(meta.ID) > 0 {
+		fields = append(fields, "id="+meta.ID)
+	}
+	if meta.Mirror {
+		fields = append(fields, "mirror=1")
+	}
+	if meta.DryRun {
+		fields = append(fields, "dryrun=1")
+	}
+	if len(meta.Source) > 0 {
+		fields = append(fields, "source="+url.QueryEscape(meta.Source))
+	}
+	if len(meta.Digest) > 0 {
+		fields = append(fields, "digest="+meta.Digest)
+	}
+	if len(meta.Release) > 0 {
+		fields = append(fields, "release="+url.QueryEscape(meta.Release))
+	}
+	if meta.Force {
+		fields = append(fields, "force=1")
+	}
+	if len(meta.Vars) > 0 {
+		vars := url.Values{}
+		for name, value := range meta.Vars {
+			vars.Set(name, value)
+		}
+		fields = append(fields, "vars="+vars.Encode())
+	}
+	return META_BAR + strings.Join(fields, "|")
+}
+
+func ParseMeta(message string) (DeployMeta, error) {
+	var meta DeployMeta
+	fields := strings.Split(strings.TrimPrefix(message, META_BAR), "|")
+	if len(fields) < 3 {
+		return meta, errors.New("invalid meta data")
+	}
+	var err error
+	if meta.Size, err = strconv.Atoi(fields[0]); err != nil {
+		return meta, fmt.Errorf("invalid meta data size: %s", fields[0])
+	}
+	if meta.Count, err = strconv.Atoi(fields[1]); err != nil {
+		return meta, fmt.Errorf("invalid meta data count: %s", fields[1])
+	}
+	if len(fields[2]) > 0 {
+		meta.Destinations = strings.Split(fields[2], ",")
+	}
+	for _, option := range fields[3:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "wait":
+			meta.Wait = value == "1"
+		case "id":
+			meta.ID = value
+		case "mirror":
+			meta.Mirror = value == "1"
+		case "dryrun":
+			meta.DryRun = value == "1"
+		case "source":
+			if meta.Source, err = url.QueryUnescape(value); err != nil {
+				return meta, fmt.Errorf("invalid meta data source: %s", value)
+			}
+		case "digest":
+			meta.Digest = value
+		case "release":
+			if meta.Release, err = url.QueryUnescape(value); err != nil {
+				return meta, fmt.Errorf("invalid meta data release: %s", value)
+			}
+		case "force":
+			meta.Force = value == "1"
+		case "vars":
+			vars, err := url.ParseQuery(value)
+			if err != nil {
+				return meta, fmt.Errorf("invalid meta data vars: %s", value)
+			}
+			meta.Vars = make(map[string]string, len(vars))
+			for name := range vars {
+				meta.Vars[name] = vars.Get(name)
+			}
+		}
+	}
+	return meta, nil
+}
+
+func FormatQueued(position int) string {
+	return QUEUED_BAR + strconv.Itoa(position)
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const PLAN_BAR = "PLAN|"
+
+// actions a deploy would take on one path of a destination
+const PLAN_CREATE = "create"
+const PLAN_OVERWRITE = "overwrite"
+const PLAN_UNCHANGED = "unchanged"
+const PLAN_DELETE = "delete"
+
+// PlanEntry is one path of a dry run, Delta is how much the destination grows
+// or shrinks by when the action is taken
+type PlanEntry struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Size   int64  `json:"size"`
+	Delta  int64  `json:"delta"`
+}
+
+// Plan is what a deploy would do to one destination without writing to it,
+// Problems are the errors extraction would stop at
+type Plan struct {
+	Destination string      `json:"destination"`
+	Entries     []PlanEntry `json:"entries"`
+	Problems    []string    `json:"problems,omitempty"`
+}
+
+// Count is the number of entries with the action
+func (plan *Plan) Count(action string) int {
+	count := 0
+	for _, entry := range plan.Entries {
+		if entry.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// Delta is the net change in bytes of the whole destination
+func (plan *Plan) Delta() int64 {
+	var delta int64
+	for _, entry := range plan.Entries {
+		delta += entry.Delta
+	}
+	return delta
+}
+
+// ExtractTarget is where a package entry is written under dst, entries that
+// would land outside of dst are refused
+func ExtractTarget(dst string, name string) (string, error) {
+	target := filepath.Join(dst, filepath.FromSlash(name))
+	rel, err := filepath.Rel(filepath.Clean(dst), target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("package entry is outside the destination: %s", name)
+	}
+	return target, nil
+}
+
+// BuildPlan compares the manifest with what is in dst, in mirror mode files
+// in dst that are not in the manifest are planned for deletion
+func BuildPlan(manifest *Manifest, dst string, mirror bool) *Plan {
+	plan := &Plan{Destination: dst, Entries: make([]PlanEntry, 0)}
+	problem := func(format string, arg ...any) {
+		plan.Problems = append(plan.Problems, fmt.Sprintf(format, arg...))
+	}
+	if info, err := os.Stat(dst); err == nil && !info.IsDir() {
+		problem("destination is not a directory: %s", dst)
+		return plan
+	}
+
+	for _, entry := range manifest.Files {
+		target, err := ExtractTarget(dst, entry.Path)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		info, err := os.Stat(target)
+		if entry.Dir {
+			if err == nil && !info.IsDir() {
+				problem("a file is in the way of directory %s", entry.Path)
+			}
+			continue
+		}
+		if os.IsNotExist(err) {
+			plan.Entries = append(plan.Entries, PlanEntry{Path: entry.Path, Action: PLAN_CREATE, Size: entry.Size, Delta: entry.Size})
+			continue
+		}
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		if info.IsDir() {
+			problem("a directory is in the way of file %s", entry.Path)
+			continue
+		}
+		if info.Size() == entry.Size && len(entry.Digest) > 0 && file_digest(target) == entry.Digest {
+			plan.Entries = append(plan.Entries, PlanEntry{Path: entry.Path, Action: PLAN_UNCHANGED, Size: entry.Size})
+			continue
+		}
+		// opening for write without truncating checks permission and locks
+		// without changing the file
+		file, err := os.OpenFile(target, os.O_WRONLY, 0)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		file.Close()
+		plan.Entries = append(plan.Entries, PlanEntry{Path: entry.Path, Action: PLAN_OVERWRITE, Size: entry.Size, Delta: entry.Size - info.Size()})
+	}
+
+	if mirror {
+		extras, err := MirrorExtras(manifest, dst, LocalPathStyle)
+		if err != nil {
+			problem("%v", err)
+		}
+		for _, extra := range extras {
+			plan.Entries = append(plan.Entries, PlanEntry{Path: extra.Path, Action: PLAN_DELETE, Size: extra.Size, Delta: -extra.Size})
+		}
+	}
+	return plan
+}
+
+// MirrorExtras lists what is in dst but not in the manifest, a directory that
+// is not in the manifest is listed once rather than with its contents. Names
+// are compared with the case rules of style, so a file whose case differs
+// from the package's is the file the package replaced, not an extra.
+func MirrorExtras(manifest *Manifest, dst string, style PathStyle) ([]ManifestEntry, error) {
+	wanted := make(map[string]bool, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		wanted[style.key(entry.Path)] = true
+	}
+	extras := make([]ManifestEntry, 0)
+	err := filepath.Walk(dst, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && file == dst {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if file == dst {
+			return nil
+		}
+		rel, err := filepath.Rel(dst, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if wanted[style.key(rel)] {
+			return nil
+		}
+		if info.IsDir() {
+			extra := ManifestEntry{Path: rel, Dir: true}
+			extra.Size, _ = dir_size(file)
+			extras = append(extras, extra)
+			return filepath.SkipDir
+		}
+		extras = append(extras, ManifestEntry{Path: rel, Size: info.Size()})
+		return nil
+	})
+	sort.Slice(extras, func(i, j int) bool { return extras[i].Path < extras[j].Path })
+	return extras, err
+}
+
+func dir_size(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func FormatPlan(plan *Plan) (string, error) {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return "", err
+	}
+	return PLAN_BAR + string(data), nil
+}
+
+func ParsePlan(message string) (*Plan, error) {
+	plan := new(Plan)
+	err := json.Unmarshal([]byte(strings.TrimPrefix(message, PLAN_BAR)), plan)
+	return plan, err
+}
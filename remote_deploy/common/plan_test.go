@@ -0,0 +1,60 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMirrorExtras(t *testing.T) {
+	dst := t.TempDir()
+	for _, name := range []string{"readme.TXT", "app.dll", "Logs/today.log", "old.txt", "Bin/app.exe"} {
+		path := filepath.Join(dst, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := &Manifest{Files: []ManifestEntry{
+		{Path: "README.txt", Size: 10},
+		{Path: "app.dll", Size: 7},
+		{Path: "bin", Dir: true},
+		{Path: "bin/APP.exe", Size: 11},
+	}}
+	tests := []struct {
+		name   string
+		style  PathStyle
+		extras []string
+	}{
+		// the files whose case differs are the ones the package replaced
+		{"windows", PathStyleOf("windows"), []string{"Logs", "old.txt"}},
+		{"darwin", PathStyleOf("darwin"), []string{"Logs", "old.txt"}},
+		// on Linux they are different files
+		{"linux", PathStyleOf("linux"), []string{"Bin", "Logs", "old.txt", "readme.TXT"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extras, err := MirrorExtras(manifest, dst, test.style)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := make([]string, 0, len(extras))
+			for _, extra := range extras {
+				paths = append(paths, extra.Path)
+			}
+			if !reflect.DeepEqual(paths, test.extras) {
+				t.Errorf("MirrorExtras() = %q, want %q", paths, test.extras)
+			}
+		})
+	}
+}
+
+func TestMirrorExtrasMissingDestination(t *testing.T) {
+	extras, err := MirrorExtras(&Manifest{}, filepath.Join(t.TempDir(), "missing"), PathStyleOf("windows"))
+	if err != nil || len(extras) != 0 {
+		t.Errorf("MirrorExtras() = %v, %v, want nothing", extras, err)
+	}
+}
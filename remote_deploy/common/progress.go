@@ -0,0 +1,327 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PROGRESS_WINDOW = 5 * time.Second
+const PROGRESS_SAMPLE_INTERVAL = 250 * time.Millisecond
+
+// ProgressStats is the state of a ProgressInfo at the time of a write, the
+// rate is measured over a sliding window so it follows changes in speed
+type ProgressStats struct {
+	Count   int
+	Total   int
+	Elapsed time.Duration
+	Rate    float64       // items or bytes per second
+	ETA     time.Duration // zero until a rate is known
+}
+
+func (stats ProgressStats) Percent() float64 {
+	if stats.Total == 0 {
+		return 100
+	}
+	return 100.0 * float64(stats.Count) / float64(stats.Total)
+}
+
+func ProgressBytesValue(stats ProgressStats, message string) string {
+	return fmt.Sprintf("[%.0f%%] %s %s", stats.Percent(), FormatBytes(stats.Count), message)
+}
+
+func ProgressEachValue(stats ProgressStats, message string) string {
+	return fmt.Sprintf("[%.0f%%] %d/%d %s", stats.Percent(), stats.Count, stats.Total, message)
+}
+
+func ProgressMessageValue(stats ProgressStats, message string) string {
+	return message
+}
+
+func ProgressBytesRate(stats ProgressStats, message string) string {
+	return fmt.Sprintf("[%.0f%%] %s %s/s %s %s", stats.Percent(), FormatBytes(stats.Count), FormatBytes(int(stats.Rate)), formatTiming(stats), message)
+}
+
+func ProgressEachRate(stats ProgressStats, message string) string {
+	return fmt.Sprintf("[%.0f%%] %d/%d %.1f/s %s %s", stats.Percent(), stats.Count, stats.Total, stats.Rate, formatTiming(stats), message)
+}
+
+func formatTiming(stats ProgressStats) string {
+	if stats.Count >= stats.Total || stats.ETA == 0 {
+		return FormatDuration(stats.Elapsed)
+	}
+	return FormatDuration(stats.Elapsed) + " ETA " + FormatDuration(stats.ETA)
+}
+
+type ProgressFunc func(stats ProgressStats, message string) string
+
+// ProgressUpdate is sent to every sink of a ProgressInfo, Text is the message
+// after formatting by the ProgressFunc and Final is set by Writeln
+type ProgressUpdate struct {
+	Stats   ProgressStats
+	Message string
+	Text    string
+	Final   bool
+}
+
+// ProgressSink receives progress updates, a ProgressInfo holds its lock while
+// calling sinks so a sink shared by several ProgressInfo needs its own lock
+type ProgressSink interface {
+	Progress(update ProgressUpdate)
+}
+
+// ProgressSinkFunc lets a plain function, such as a metrics counter, be used
+// as a sink
+type ProgressSinkFunc func(update ProgressUpdate)
+
+func (f ProgressSinkFunc) Progress(update ProgressUpdate) {
+	f(update)
+}
+
+type progressSample struct {
+	timeStamp time.Time
+	count     int
+}
+
+type ProgressInfo struct {
+	mutex     sync.Mutex
+	clock     func() time.Time
+	timeStamp time.Time
+	rateLimit time.Duration // limit progress updates by rate limit
+	progress  ProgressFunc
+	sinks     []ProgressSink
+	started   time.Time
+	samples   []progressSample
+}
+
+// record adds the count to the sliding window and recalculates the stats
+func (info *ProgressInfo) record(count int, total int) ProgressStats {
+	now := info.clock()
+	if len(info.samples) == 0 || now.Sub(info.samples[len(info.samples)-1].timeStamp) >= PROGRESS_SAMPLE_INTERVAL {
+		info.samples = append(info.samples, progressSample{timeStamp: now, count: count})
+	}
+	for len(info.samples) > 2 && now.Sub(info.samples[0].timeStamp) > PROGRESS_WINDOW {
+		info.samples = info.samples[1:]
+	}
+
+	stats := ProgressStats{Count: count, Total: total, Elapsed: now.Sub(info.started)}
+	oldest := progressSample{timeStamp: info.started}
+	if len(info.samples) > 1 {
+		oldest = info.samples[0]
+	}
+	if window := now.Sub(oldest.timeStamp).Seconds(); window > 0 {
+		stats.Rate = float64(count-oldest.count) / window
+	}
+	if stats.Rate > 0 && total > count {
+		stats.ETA = time.Duration(float64(total-count) / stats.Rate * float64(time.Second))
+	}
+	return stats
+}
+
+func (info *ProgressInfo) dispatch(stats ProgressStats, message string, final bool) {
+	update := ProgressUpdate{Stats: stats, Message: message, Text: info.progress(stats, message), Final: final}
+	for _, sink := range info.sinks {
+		sink.Progress(update)
+	}
+}
+
+func (info *ProgressInfo) Write(count int, total int, message string) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	stats := info.record(count, total)
+	if now := info.clock(); now.Sub(info.timeStamp) > info.rateLimit {
+		info.timeStamp = now
+		info.dispatch(stats, message, false)
+	}
+}
+
+func (info *ProgressInfo) Writeln(count int, total int, message string) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	info.dispatch(info.record(count, total), message, true)
+}
+
+func (info *ProgressInfo) AddSink(sink ProgressSink) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	info.sinks = append(info.sinks, sink)
+}
+
+func (info *ProgressInfo) SetRateLimit(limit time.Duration) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	info.rateLimit = limit
+}
+
+// BeginProgress writes progress to the terminal
+func BeginProgress(progress ProgressFunc) *ProgressInfo {
+	return BeginProgressTo(progress, NewTerminalSink(os.Stdout))
+}
+
+// BeginProgressTo writes progress to the given sinks only
+func BeginProgressTo(progress ProgressFunc, sinks ...ProgressSink) *ProgressInfo {
+	return begin_progress(time.Now, progress, sinks...)
+}
+
+// begin_progress takes the clock the rate and ETA are measured with
+func begin_progress(clock func() time.Time, progress ProgressFunc, sinks ...ProgressSink) *ProgressInfo {
+	var info = new(ProgressInfo)
+	info.clock = clock
+	info.rateLimit = 100 * time.Millisecond
+	info.timeStamp = clock()
+	info.started = info.timeStamp
+	info.progress = progress
+	info.sinks = sinks
+	return info
+}
+
+// TerminalSink redraws the current line, a final update moves on to the next
+type TerminalSink struct {
+	mutex             sync.Mutex
+	writer            io.Writer
+	previouslyWritten int
+}
+
+func NewTerminalSink(writer io.Writer) *TerminalSink {
+	return &TerminalSink{writer: writer}
+}
+
+func (sink *TerminalSink) Progress(update ProgressUpdate) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	message_length := len([]rune(update.Text))
+	erase_length := sink.previouslyWritten - message_length
+	fmt.Fprint(sink.writer, "\r", update.Text)
+	if erase_length > 0 {
+		fmt.Fprint(sink.writer, strings.Repeat(" ", erase_length), strings.Repeat("\b", erase_length))
+	}
+	if update.Final {
+		fmt.Fprintln(sink.writer)
+		sink.previouslyWritten = 0
+	} else {
+		sink.previouslyWritten = message_length
+	}
+}
+
+// WriterSink writes every update on its own line, for output that is not a
+// terminal, such as a CI log, where carriage returns do not redraw
+type WriterSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+func (sink *WriterSink) Progress(update ProgressUpdate) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	fmt.Fprintln(sink.writer, update.Text)
+}
+
+// MessageWriter is satisfied by a *websocket.Conn, it keeps common free of
+// the websocket dependency
+type MessageWriter interface {
+	WriteMessage(message_type int, data []byte) error
+}
+
+const TEXT_MESSAGE = 1 // websocket.TextMessage
+
+// WebSocketSink sends each update as a text message with the prefix, the
+// connection is shared with the handler so writes go through the lock given
+type WebSocketSink struct {
+	mutex  *sync.Mutex
+	conn   MessageWriter
+	prefix string
+}
+
+func NewWebSocketSink(conn MessageWriter, mutex *sync.Mutex, prefix string) *WebSocketSink {
+	if mutex == nil {
+		mutex = new(sync.Mutex)
+	}
+	return &WebSocketSink{mutex: mutex, conn: conn, prefix: prefix}
+}
+
+func (sink *WebSocketSink) Progress(update ProgressUpdate) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_ = sink.conn.WriteMessage(TEXT_MESSAGE, []byte(sink.prefix+update.Text))
+}
+
+// ChannelSink hands updates to another goroutine. It never blocks the writer:
+// an update is dropped when the channel is full, so the reader should size
+// the buffer for the updates it must not miss or watch for Final itself.
+type ChannelSink chan ProgressUpdate
+
+func (sink ChannelSink) Progress(update ProgressUpdate) {
+	select {
+	case sink <- update:
+	default:
+	}
+}
+
+// LogSink writes final updates at info, and every other update at debug
+// when verbose, to a logger
+type LogSink struct {
+	logger  *Logger
+	verbose bool
+}
+
+func NewLogSink(logger *Logger, verbose bool) *LogSink {
+	return &LogSink{logger: logger, verbose: verbose}
+}
+
+func (sink *LogSink) Progress(update ProgressUpdate) {
+	if update.Final {
+		sink.logger.Info(update.Text, "count", update.Stats.Count, "total", update.Stats.Total, "elapsed", update.Stats.Elapsed.Round(time.Millisecond))
+	} else if sink.verbose {
+		sink.logger.Debug(update.Text, "count", update.Stats.Count, "total", update.Stats.Total)
+	}
+}
+
+// MultiProgress renders several progress bars on their own lines, each bar
+// can be written from its own goroutine without clobbering the others
+type MultiProgress struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	lines  []string
+	drawn  int
+}
+
+func NewMultiProgress(writer io.Writer) *MultiProgress {
+	return &MultiProgress{writer: writer}
+}
+
+// Sink adds a line to the bottom of the display and returns the sink that
+// writes to it
+func (multi *MultiProgress) Sink() ProgressSink {
+	multi.mutex.Lock()
+	defer multi.mutex.Unlock()
+	index := len(multi.lines)
+	multi.lines = append(multi.lines, "")
+	return ProgressSinkFunc(func(update ProgressUpdate) {
+		multi.set(index, update.Text)
+	})
+}
+
+// Bar returns a ProgressInfo that writes to a new line of the display
+func (multi *MultiProgress) Bar(progress ProgressFunc) *ProgressInfo {
+	return BeginProgressTo(progress, multi.Sink())
+}
+
+func (multi *MultiProgress) set(index int, message string) {
+	multi.mutex.Lock()
+	defer multi.mutex.Unlock()
+	multi.lines[index] = message
+	if multi.drawn > 0 {
+		fmt.Fprintf(multi.writer, "\033[%dA", multi.drawn)
+	}
+	for _, line := range multi.lines {
+		fmt.Fprint(multi.writer, "\r\033[K", line, "\n")
+	}
+	multi.drawn = len(multi.lines)
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake_clock is moved on by the test rather than by time passing
+type fake_clock struct {
+	now time.Time
+}
+
+func (clock *fake_clock) time() time.Time {
+	return clock.now
+}
+
+func TestProgressRateAndETA(t *testing.T) {
+	clock := &fake_clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var last ProgressUpdate
+	info := begin_progress(clock.time, ProgressBytesRate, ProgressSinkFunc(func(update ProgressUpdate) {
+		last = update
+	}))
+	const total = 100000
+	count := 0
+	step := func(seconds int, per_second int) {
+		for i := 0; i < seconds; i++ {
+			clock.now = clock.now.Add(time.Second)
+			count += per_second
+			info.Write(count, total, "sending")
+		}
+	}
+
+	step(4, 1000)
+	if last.Stats.Rate != 1000 {
+		t.Errorf("rate = %.1f, want 1000", last.Stats.Rate)
+	}
+	if want := time.Duration(total-count) * time.Second / 1000; last.Stats.ETA != want {
+		t.Errorf("ETA = %s, want %s", last.Stats.ETA, want)
+	}
+
+	// once the window has moved past the slow start the rate is the new speed
+	step(8, 5000)
+	if last.Stats.Rate != 5000 {
+		t.Errorf("rate = %.1f after speeding up, want 5000", last.Stats.Rate)
+	}
+	if want := time.Duration(total-count) * time.Second / 5000; last.Stats.ETA != want {
+		t.Errorf("ETA = %s after speeding up, want %s", last.Stats.ETA, want)
+	}
+	if last.Stats.Elapsed != 12*time.Second {
+		t.Errorf("elapsed = %s, want 12s", last.Stats.Elapsed)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	info.Writeln(total, total, "sent")
+	if !last.Final || last.Stats.ETA != 0 {
+		t.Errorf("final update %+v, want no ETA", last)
+	}
+	if !strings.HasPrefix(last.Text, "[100%] 97.66 KB") {
+		t.Errorf("final text = %q", last.Text)
+	}
+}
+
+func TestProgressRateLimit(t *testing.T) {
+	clock := &fake_clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	updates := 0
+	info := begin_progress(clock.time, ProgressEachRate, ProgressSinkFunc(func(update ProgressUpdate) {
+		updates++
+	}))
+	for i := 1; i <= 10; i++ {
+		clock.now = clock.now.Add(50 * time.Millisecond)
+		info.Write(i, 10, "compressing")
+	}
+	// an update once more than the 100ms limit has passed, at 150, 300 and 450ms
+	if updates != 3 {
+		t.Errorf("%d updates were sent, want 3", updates)
+	}
+}
+
+func TestChannelSinkDropsWhenFull(t *testing.T) {
+	clock := &fake_clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	sink := make(ChannelSink, 2)
+	info := begin_progress(clock.time, ProgressEachValue, sink)
+	// nobody reads the channel, the writer must not block on the third update
+	for i := 1; i <= 3; i++ {
+		clock.now = clock.now.Add(time.Second)
+		info.Write(i, 3, "sending")
+	}
+	if len(sink) != 2 {
+		t.Fatalf("%d updates are queued, want 2", len(sink))
+	}
+	if first := <-sink; first.Stats.Count != 1 {
+		t.Errorf("first update is %d, want 1", first.Stats.Count)
+	}
+	if second := <-sink; second.Stats.Count != 2 {
+		t.Errorf("second update is %d, want the third to be dropped", second.Stats.Count)
+	}
+}
+
+func TestMultiProgress(t *testing.T) {
+	var out bytes.Buffer
+	multi := NewMultiProgress(&out)
+	web1 := multi.Bar(ProgressMessageValue)
+	web2 := multi.Bar(ProgressMessageValue)
+	web1.Writeln(0, 1, "web1 running")
+	web2.Writeln(0, 1, "web2 running")
+	web1.Writeln(1, 1, "web1 done")
+	lines := strings.Split(out.String(), "\n")
+	// each redraw moves up over the lines drawn before and draws both
+	last := strings.Join(lines[len(lines)-3:], "\n")
+	if want := "\033[2A\r\033[Kweb1 done\n\r\033[Kweb2 running\n"; last != want {
+		t.Errorf("last redraw = %q, want %q", last, want)
+	}
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareReleases orders two release labels when both are semantic versions,
+// with or without a leading v, or both are build numbers. It returns -1, 0 or
+// 1 as a is older than, the same as or newer than b, and ok is false for
+// labels that cannot be ordered such as git SHAs.
+func CompareReleases(a string, b string) (order int, ok bool) {
+	if build_a, err := strconv.ParseUint(a, 10, 64); err == nil {
+		build_b, err := strconv.ParseUint(b, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return compare_numbers(build_a, build_b), true
+	}
+	version_a, ok_a := parse_version(a)
+	version_b, ok_b := parse_version(b)
+	if !ok_a || !ok_b {
+		return 0, false
+	}
+	for i := 0; i < len(version_a.numbers) || i < len(version_b.numbers); i++ {
+		var number_a, number_b uint64
+		if i < len(version_a.numbers) {
+			number_a = version_a.numbers[i]
+		}
+		if i < len(version_b.numbers) {
+			number_b = version_b.numbers[i]
+		}
+		if order := compare_numbers(number_a, number_b); order != 0 {
+			return order, true
+		}
+	}
+	return compare_prerelease(version_a.prerelease, version_b.prerelease), true
+}
+
+type version struct {
+	numbers    []uint64
+	prerelease []string
+}
+
+// parse_version reads 1.2.3, v1.2 or 1.2.3-rc.1+build, the build metadata
+// after a + does not order versions
+func parse_version(label string) (version, bool) {
+	var parsed version
+	label = strings.TrimPrefix(label, "v")
+	label, _, _ = strings.Cut(label, "+")
+	label, prerelease, has_prerelease := strings.Cut(label, "-")
+	parts := strings.Split(label, ".")
+	if len(parts) < 2 {
+		return parsed, false
+	}
+	for _, part := range parts {
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return parsed, false
+		}
+		parsed.numbers = append(parsed.numbers, number)
+	}
+	if has_prerelease {
+		if len(prerelease) == 0 {
+			return parsed, false
+		}
+		parsed.prerelease = strings.Split(prerelease, ".")
+	}
+	return parsed, true
+}
+
+// compare_prerelease orders pre-releases as semantic versioning does, a
+// release is newer than any of its pre-releases, numeric identifiers are
+// compared as numbers and are older than alphanumeric ones
+func compare_prerelease(a []string, b []string) int {
+	if len(a) == 0 || len(b) == 0 {
+		return compare_numbers(uint64(len(b)), uint64(len(a)))
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		number_a, err_a := strconv.ParseUint(a[i], 10, 64)
+		number_b, err_b := strconv.ParseUint(b[i], 10, 64)
+		switch {
+		case err_a == nil && err_b == nil:
+			if order := compare_numbers(number_a, number_b); order != 0 {
+				return order
+			}
+		case err_a == nil:
+			return -1
+		case err_b == nil:
+			return 1
+		case a[i] != b[i]:
+			return strings.Compare(a[i], b[i])
+		}
+	}
+	return compare_numbers(uint64(len(a)), uint64(len(b)))
+}
+
+func compare_numbers(a uint64, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// a client that loses its connection reconnects and sends RESUME|<id>, the
+// agent answers STATE|<json> with how far the deploy got
+const RESUME_BAR = "RESUME|"
+const STATE_BAR = "STATE|"
+
+// states of a deploy on the agent, unknown means the agent no longer has it
+// and the deploy has to start over
+const STATE_RECEIVING = "receiving"
+const STATE_DEPLOYING = "deploying"
+const STATE_DONE = "done"
+const STATE_FAILED = "failed"
+const STATE_UNKNOWN = "unknown"
+
+// DeployState is the agent's answer to RESUME, Received is how many bytes of
+// the package it has so the client continues from there
+type DeployState struct {
+	Status    string   `json:"status"`
+	Received  int      `json:"received"`
+	Completed []string `json:"completed,omitempty"`
+	Kind      string   `json:"kind,omitempty"` // error kind of a failed deploy
+	Error     string   `json:"error,omitempty"`
+}
+
+// NewDeployID names a deploy so it can be resumed on a new connection
+func NewDeployID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func FormatState(state DeployState) string {
+	data, _ := json.Marshal(state)
+	return STATE_BAR + string(data)
+}
+
+func ParseState(message string) (DeployState, error) {
+	var state DeployState
+	err := json.Unmarshal([]byte(strings.TrimPrefix(message, STATE_BAR)), &state)
+	return state, err
+}
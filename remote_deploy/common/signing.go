@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const SIG_BAR = "SIG|"
+
+const KEY_TYPE = "ed25519"
+
+// SIGNATURE_HEADER carries the signature of a file uploaded over HTTP,
+// formatted by FormatSignature, such as a package sent to the coordinator or
+// a new agent executable
+const SIGNATURE_HEADER = "X-Deploy-Signature"
+
+// TrustedKey is a public key entry from a trusted keys file. The file uses
+// the same one line format as a generated .pub file: "ed25519 <base64> <name>"
+type TrustedKey struct {
+	Key  ed25519.PublicKey
+	Name string
+}
+
+func Digest(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func SignDigest(key ed25519.PrivateKey, digest []byte) []byte {
+	return ed25519.Sign(key, digest)
+}
+
+// VerifyDigest checks the signature was made by the given public key and that
+// the public key is one of the trusted keys, returning the matching entry
+func VerifyDigest(trusted []TrustedKey, key ed25519.PublicKey, digest []byte, signature []byte) (*TrustedKey, error) {
+	if len(key) != ed25519.PublicKeySize || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("signature is missing")
+	}
+	for i := range trusted {
+		if trusted[i].Key.Equal(key) {
+			if !ed25519.Verify(key, digest, signature) {
+				return nil, errors.New("signature is invalid")
+			}
+			return &trusted[i], nil
+		}
+	}
+	return nil, fmt.Errorf("signed by untrusted key %s", Fingerprint(key))
+}
+
+func FormatSignature(key ed25519.PublicKey, signature []byte) string {
+	return SIG_BAR + base64.StdEncoding.EncodeToString(key) + "|" + base64.StdEncoding.EncodeToString(signature)
+}
+
+func ParseSignature(message string) (ed25519.PublicKey, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(message, SIG_BAR), "|")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("invalid signature message")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return ed25519.PublicKey(key), signature, nil
+}
+
+// GenerateKeyPair writes <name>.key and <name>.pub into dir, refusing to
+// overwrite an existing private key
+func GenerateKeyPair(dir string, name string) (private_path string, public_path string, err error) {
+	private_path = filepath.Join(dir, name+".key")
+	public_path = filepath.Join(dir, name+".pub")
+	if _, err := os.Stat(private_path); err == nil {
+		return "", "", fmt.Errorf("key already exists: %s", private_path)
+	}
+	if err := EnsureDir(dir); err != nil {
+		return "", "", err
+	}
+	public_key, private_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	seed := base64.StdEncoding.EncodeToString(private_key.Seed())
+	if err := os.WriteFile(private_path, []byte(seed+"\n"), 0600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(public_path, []byte(FormatPublicKey(public_key, name)+"\n"), 0644); err != nil {
+		return "", "", err
+	}
+	return private_path, public_path, nil
+}
+
+func FormatPublicKey(key ed25519.PublicKey, name string) string {
+	return fmt.Sprintf("%s %s %s", KEY_TYPE, base64.StdEncoding.EncodeToString(key), name)
+}
+
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid private key: %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func ParsePublicKey(line string) (*TrustedKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != KEY_TYPE {
+		return nil, fmt.Errorf("invalid public key: %s", line)
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: %s", line)
+	}
+	return &TrustedKey{Key: ed25519.PublicKey(key), Name: strings.Join(fields[2:], " ")}, nil
+}
+
+// LoadPublicKeys reads a trusted keys file, one key per line, blank lines and
+// lines starting with # are ignored
+func LoadPublicKeys(path string) ([]TrustedKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make([]TrustedKey, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, err := ParsePublicKey(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,196 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TEMPLATE_SUFFIX is trimmed from the name a rendered file is written to,
+// appsettings.json.tmpl is extracted as appsettings.json
+const TEMPLATE_SUFFIX = ".tmpl"
+
+// TEMPLATE_MAX_SIZE keeps a large file matched by mistake from being read
+// into memory
+const TEMPLATE_MAX_SIZE = 16 * 1024 * 1024
+
+var var_name = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateVarName checks a variable or secret name can be used in a
+// template as {{.name}} or {{secret "name"}}
+func ValidateVarName(name string) error {
+	if !var_name.MatchString(name) {
+		return fmt.Errorf("invalid name %q, names are letters, digits and underscores", name)
+	}
+	return nil
+}
+
+// ValidateTemplatePattern checks a pattern Templates matches names with
+func ValidateTemplatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", pattern)
+	}
+	return nil
+}
+
+// Templates renders the files of a package that match one of Patterns with
+// text/template as the package is extracted. A pattern with a slash is
+// matched against the path in the package, one without against the file
+// name. Templates refer to Vars as {{.name}} and to secrets, which are not
+// shipped in the package, as {{secret "name"}}. A variable or secret that is
+// not defined fails the render.
+type Templates struct {
+	Patterns []string
+	Vars     map[string]string
+	Secret   func(name string) (string, error)
+	rendered map[string][]byte
+}
+
+// Match reports whether a package entry, named without a leading slash, is
+// a template
+func (templates *Templates) Match(name string) bool {
+	if templates == nil {
+		return false
+	}
+	for _, pattern := range templates.Patterns {
+		subject := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			subject = name
+		}
+		if matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateTarget is the name a template is extracted as
+func TemplateTarget(name string) string {
+	if strings.HasSuffix(name, TEMPLATE_SUFFIX) && len(path.Base(name)) > len(TEMPLATE_SUFFIX) {
+		return strings.TrimSuffix(name, TEMPLATE_SUFFIX)
+	}
+	return name
+}
+
+// Render reads the package and renders every template in it, the package is
+// checked in full before anything is extracted so a missing variable leaves
+// the destinations as they were. Every template that fails is reported.
+func (templates *Templates) Render(src io.Reader) error {
+	zip_reader, err := gzip.NewReader(src)
+	if err != nil {
+		return err
+	}
+	defer zip_reader.Close()
+
+	templates.rendered = make(map[string][]byte)
+	files := make(map[string]bool)
+	var failures []string
+	tar_reader := tar.NewReader(zip_reader)
+	for {
+		header, err := tar_reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(header.Name, "/")
+		files[name] = true
+		if !templates.Match(name) {
+			continue
+		}
+		if header.Size > TEMPLATE_MAX_SIZE {
+			failures = append(failures, fmt.Sprintf("%s: %s is larger than templates may be", name, FormatBytes(int(header.Size))))
+			continue
+		}
+		text, err := io.ReadAll(tar_reader)
+		if err != nil {
+			return err
+		}
+		rendered, err := templates.render(name, text)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		templates.rendered[name] = rendered
+	}
+	for name := range templates.rendered {
+		if target := TemplateTarget(name); target != name && files[target] {
+			failures = append(failures, fmt.Sprintf("%s: the package also has %s", name, target))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("failed to render templates: " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (templates *Templates) render(name string, text []byte) ([]byte, error) {
+	funcs := template.FuncMap{
+		"secret": func(name string) (string, error) {
+			if templates.Secret == nil {
+				return "", fmt.Errorf("no secret %s", name)
+			}
+			return templates.Secret(name)
+		},
+	}
+	parsed, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	vars := templates.Vars
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	buffer := new(bytes.Buffer)
+	if err := parsed.Execute(buffer, vars); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Rendered lists the templates Render rendered, by their names in the package
+func (templates *Templates) Rendered() []string {
+	if templates == nil {
+		return nil
+	}
+	names := make([]string, 0, len(templates.rendered))
+	for name := range templates.rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rename changes the templates of a manifest to the names they are
+// extracted as, so a mirror keeps the rendered files
+func (templates *Templates) Rename(manifest *Manifest) {
+	if templates == nil {
+		return
+	}
+	for i, entry := range manifest.Files {
+		if _, ok := templates.rendered[entry.Path]; ok {
+			manifest.Files[i].Path = TemplateTarget(entry.Path)
+		}
+	}
+}
+
+// content is the rendered template a package entry is replaced with
+func (templates *Templates) content(name string) ([]byte, bool) {
+	if templates == nil {
+		return nil, false
+	}
+	content, ok := templates.rendered[strings.TrimPrefix(name, "/")]
+	return content, ok
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// template_package compresses files, named with slashes, into a package
+func template_package(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	src := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var data bytes.Buffer
+	if _, err := Compress(src, &data, BeginProgressTo(ProgressEachValue)); err != nil {
+		t.Fatal(err)
+	}
+	return data.Bytes()
+}
+
+func test_secret(name string) (string, error) {
+	if name == "db_password" {
+		return "s3cret", nil
+	}
+	return "", fmt.Errorf("no secret %s", name)
+}
+
+func TestRender(t *testing.T) {
+	data := template_package(t, map[string]string{
+		"appsettings.json.tmpl": `{"db": "{{.db_host}}", "password": "{{secret "db_password"}}"}`,
+		"config/app.ini":        "host={{.db_host}}",
+		"wwwroot/index.html":    "{{.db_host}} is not rendered",
+	})
+	templates := &Templates{
+		Patterns: []string{"*.tmpl", "config/*.ini"},
+		Vars:     map[string]string{"db_host": "sql01"},
+		Secret:   test_secret,
+	}
+	if err := templates.Render(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"appsettings.json.tmpl", "config/app.ini"}; !reflect.DeepEqual(templates.Rendered(), want) {
+		t.Errorf("Rendered() = %q, want %q", templates.Rendered(), want)
+	}
+	want := map[string]string{
+		"appsettings.json.tmpl": `{"db": "sql01", "password": "s3cret"}`,
+		"/config/app.ini":       "host=sql01",
+	}
+	for name, content := range want {
+		if got, ok := templates.content(name); !ok || string(got) != content {
+			t.Errorf("content(%s) = %q, %v, want %q", name, got, ok, content)
+		}
+	}
+	if _, ok := templates.content("wwwroot/index.html"); ok {
+		t.Error("a file no pattern matches was rendered")
+	}
+
+	// a mirror keeps the rendered file rather than the template
+	manifest := Manifest{Files: []ManifestEntry{{Path: "appsettings.json.tmpl"}, {Path: "config/app.ini"}, {Path: "wwwroot/index.html"}}}
+	templates.Rename(&manifest)
+	var paths []string
+	for _, entry := range manifest.Files {
+		paths = append(paths, entry.Path)
+	}
+	if want := []string{"appsettings.json", "config/app.ini", "wwwroot/index.html"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("renamed manifest = %q, want %q", paths, want)
+	}
+}
+
+func TestRenderFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		secret func(name string) (string, error)
+		errs   []string
+	}{
+		{"missing variable", map[string]string{"app.ini.tmpl": "host={{.db_host}} port={{.db_port}}"}, test_secret, []string{`map has no entry for key "db_port"`}},
+		{"missing secret", map[string]string{"app.ini.tmpl": `key={{secret "api_key"}}`}, test_secret, []string{"no secret api_key"}},
+		{"secrets without a store", map[string]string{"app.ini.tmpl": `key={{secret "db_password"}}`}, nil, []string{"no secret db_password"}},
+		{"invalid template", map[string]string{"app.ini.tmpl": "host={{.db_host"}, test_secret, []string{"app.ini.tmpl"}},
+		{"target already in the package", map[string]string{"app.ini.tmpl": "host={{.db_host}}", "app.ini": "host=localhost"}, test_secret, []string{"app.ini.tmpl: the package also has app.ini"}},
+		{"every failure is reported", map[string]string{"a.ini.tmpl": "{{.x}}", "b.ini.tmpl": "{{.y}}"}, test_secret, []string{`a.ini.tmpl`, `"x"`, `b.ini.tmpl`, `"y"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			templates := &Templates{Patterns: []string{"*.tmpl"}, Vars: map[string]string{"db_host": "sql01"}, Secret: test.secret}
+			err := templates.Render(bytes.NewReader(template_package(t, test.files)))
+			if err == nil {
+				t.Fatalf("Render() succeeded, want an error with %q", test.errs)
+			}
+			for _, text := range test.errs {
+				if !strings.Contains(err.Error(), text) {
+					t.Errorf("Render() = %v, want an error with %q", err, text)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplatesMatch(t *testing.T) {
+	templates := &Templates{Patterns: []string{"*.tmpl", "/config/*.json", "web.config"}}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"app.ini.tmpl", true},
+		{"sub/dir/app.ini.tmpl", true},
+		{"config/app.json", true},
+		{"other/config/app.json", false},
+		{"app.json", false},
+		{"web.config", true},
+		{"wwwroot/web.config", true},
+		{"web.config.bak", false},
+	}
+	for _, test := range tests {
+		if got := templates.Match(test.name); got != test.want {
+			t.Errorf("Match(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+	var none *Templates
+	if none.Match("app.ini.tmpl") {
+		t.Error("a nil Templates matched")
+	}
+}
+
+func TestTemplateTarget(t *testing.T) {
+	tests := map[string]string{
+		"appsettings.json.tmpl":     "appsettings.json",
+		"config/app.ini.tmpl":       "config/app.ini",
+		"web.config":                "web.config",
+		".tmpl":                     ".tmpl",
+		"config/.tmpl":              "config/.tmpl",
+		"appsettings.tmpl.json":     "appsettings.tmpl.json",
+		"appsettings.json.tmpl.bak": "appsettings.json.tmpl.bak",
+	}
+	for name, want := range tests {
+		if got := TemplateTarget(name); got != want {
+			t.Errorf("TemplateTarget(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestValidateTemplateNames(t *testing.T) {
+	for _, name := range []string{"db_host", "_private", "Port8080"} {
+		if err := ValidateVarName(name); err != nil {
+			t.Errorf("ValidateVarName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "8080port", "db-host", "db host", "db.host", `db"host`} {
+		if err := ValidateVarName(name); err == nil {
+			t.Errorf("ValidateVarName(%q) accepted an invalid name", name)
+		}
+	}
+	for _, pattern := range []string{"*.tmpl", "config/*.json", "app.[ij]ni"} {
+		if err := ValidateTemplatePattern(pattern); err != nil {
+			t.Errorf("ValidateTemplatePattern(%q) = %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"[", "app.[ini", `\`} {
+		if err := ValidateTemplatePattern(pattern); err == nil {
+			t.Errorf("ValidateTemplatePattern(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"remote_deploy/common"
+)
+
+const CONFIG_FILE = "coordinator.json"
+
+// CoordinatorConfig is read from coordinator.json next to the executable, or
+// the file given by -config, a missing file leaves every setting at its
+// default. Relative paths are resolved against the folder of the file.
+type CoordinatorConfig struct {
+	ListenAddr        string `json:"listen_addr"`
+	TrustedKeys       string `json:"trusted_keys"`      // keys of the clients that upload packages and submit jobs
+	AgentKeys         string `json:"agent_keys"`        // keys agents sign their heartbeats with
+	Key               string `json:"key"`               // the coordinator signs its connections to agents with this
+	PackageDir        string `json:"package_dir"`       // uploaded packages, named by digest
+	MaxPayloadSize    string `json:"max_payload_size"`  // such as "1GB"
+	HeartbeatTimeout  string `json:"heartbeat_timeout"` // an agent silent this long is offline
+	AgentTimeout      string `json:"agent_timeout"`     // how long an agent may send nothing during a deploy
+	MaxParallel       int    `json:"max_parallel"`      // agents a job deploys to at once
+	MaxJobs           int    `json:"max_jobs"`          // finished jobs kept for clients to look up
+	TLSCert           string `json:"tls_cert"`          // serve TLS when both are set
+	TLSKey            string `json:"tls_key"`
+	AgentCA           string `json:"agent_ca"`  // PEM certificate agents' certificates are checked against
+	LogLevel          string `json:"log_level"` // debug, info, warn or error
+	LogFormat         string `json:"log_format"`
+	max_payload_bytes int
+	heartbeat_timeout time.Duration
+	agent_timeout     time.Duration
+	log_level         common.Level
+	agent_tls         *tls.Config
+}
+
+func default_config() CoordinatorConfig {
+	return CoordinatorConfig{
+		ListenAddr:       "localhost:8090",
+		TrustedKeys:      "trusted_keys",
+		AgentKeys:        "agent_keys",
+		Key:              "coordinator.key",
+		PackageDir:       "packages",
+		MaxPayloadSize:   "1GB",
+		HeartbeatTimeout: "45s",
+		AgentTimeout:     "60s",
+		MaxParallel:      10,
+		MaxJobs:          100,
+		LogLevel:         "info",
+		LogFormat:        common.LOG_TEXT,
+	}
+}
+
+// default_config_path is coordinator.json next to the executable
+func default_config_path() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return CONFIG_FILE
+	}
+	return filepath.Join(filepath.Dir(exe), CONFIG_FILE)
+}
+
+func load_config(path string) (CoordinatorConfig, error) {
+	config := default_config()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return config, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, err
+		}
+	}
+	resolve := func(name string) string {
+		if len(name) == 0 || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(filepath.Dir(path), name)
+	}
+	config.TrustedKeys = resolve(config.TrustedKeys)
+	config.AgentKeys = resolve(config.AgentKeys)
+	config.Key = resolve(config.Key)
+	config.PackageDir = resolve(config.PackageDir)
+	if (len(config.TLSCert) > 0) != (len(config.TLSKey) > 0) {
+		return config, errors.New("tls_cert and tls_key must be set together")
+	}
+	config.TLSCert = resolve(config.TLSCert)
+	config.TLSKey = resolve(config.TLSKey)
+	if config.max_payload_bytes, err = common.ParseBytes(config.MaxPayloadSize); err != nil {
+		return config, fmt.Errorf("max_payload_size: %v", err)
+	}
+	if config.heartbeat_timeout, err = time.ParseDuration(config.HeartbeatTimeout); err != nil || config.heartbeat_timeout <= 0 {
+		return config, fmt.Errorf("heartbeat_timeout: invalid duration %q", config.HeartbeatTimeout)
+	}
+	if config.agent_timeout, err = time.ParseDuration(config.AgentTimeout); err != nil || config.agent_timeout <= 0 {
+		return config, fmt.Errorf("agent_timeout: invalid duration %q", config.AgentTimeout)
+	}
+	if config.MaxParallel <= 0 {
+		return config, errors.New("max_parallel: must be positive")
+	}
+	if config.MaxJobs <= 0 {
+		return config, errors.New("max_jobs: must be positive")
+	}
+	if config.log_level, err = common.ParseLevel(config.LogLevel); err != nil {
+		return config, fmt.Errorf("log_level: %v", err)
+	}
+	if err := common.ValidateLogFormat(config.LogFormat); err != nil {
+		return config, fmt.Errorf("log_format: %v", err)
+	}
+	config.agent_tls = &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.AgentCA) > 0 {
+		pem, err := os.ReadFile(resolve(config.AgentCA))
+		if err != nil {
+			return config, fmt.Errorf("agent_ca: %v", err)
+		}
+		config.agent_tls.RootCAs = x509.NewCertPool()
+		if !config.agent_tls.RootCAs.AppendCertsFromPEM(pem) {
+			return config, fmt.Errorf("agent_ca: no certificates found in %s", config.AgentCA)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+func TestMain(m *testing.M) {
+	log = common.NewLogger(common.LevelError, common.NewWriterHandler(os.Stderr, common.LOG_TEXT))
+	os.Exit(m.Run())
+}
+
+// fake_agent answers the coordinator's /rfd connections the way an agent
+// does, and fails with an error of kind when one is set. With flood it keeps
+// sending progress after the error, as an agent still extracting would.
+type fake_agent struct {
+	name   string
+	labels map[string]string
+	roots  []string
+	kind   string
+	flood  bool
+	key    ed25519.PrivateKey
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	meta     *common.DeployMeta
+	received []byte
+}
+
+func new_fake_agent(t *testing.T, name string, labels map[string]string, roots []string, coordinator_key ed25519.PublicKey) *fake_agent {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &fake_agent{name: name, labels: labels, roots: roots, key: key}
+	trusted := []common.TrustedKey{{Key: coordinator_key, Name: "coordinator"}}
+	upgrader := websocket.Upgrader{}
+	agent.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := common.VerifyRequest(r, trusted); err != nil || r.URL.Path != common.DEPLOY_PATH {
+			http.Error(w, "refused", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := agent.deploy(conn); err != nil {
+			t.Errorf("agent %s: %v", name, err)
+		}
+	}))
+	t.Cleanup(agent.server.Close)
+	return agent
+}
+
+func (agent *fake_agent) deploy(conn *websocket.Conn) error {
+	text := func() (string, error) {
+		message_type, data, err := conn.ReadMessage()
+		if err == nil && message_type != websocket.TextMessage {
+			err = errors.New("expected a text message")
+		}
+		return string(data), err
+	}
+	manifest, err := text()
+	if err != nil {
+		return err
+	}
+	if _, err := common.ParseManifest(manifest); err != nil {
+		return err
+	}
+	message, err := text()
+	if err != nil {
+		return err
+	}
+	meta, err := common.ParseMeta(message)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(common.READY)); err != nil {
+		return err
+	}
+	if _, err := text(); err != nil {
+		return err
+	}
+	var received bytes.Buffer
+	for {
+		message_type, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if message_type == websocket.TextMessage && string(data) == common.DATA_DONE {
+			break
+		}
+		received.Write(data)
+	}
+	agent.mutex.Lock()
+	agent.meta = &meta
+	agent.received = received.Bytes()
+	agent.mutex.Unlock()
+
+	if len(agent.kind) > 0 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(common.FormatError(agent.kind, errors.New("destination is full")))); err != nil || !agent.flood {
+			return err
+		}
+		// until the coordinator has closed the connection
+		for {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("PROG extracting")); err != nil {
+				return nil
+			}
+		}
+	}
+	for _, destination := range meta.Destinations {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("PROG DONE: "+destination)); err != nil {
+			return err
+		}
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("DONE")); err != nil {
+		return err
+	}
+	// the coordinator closes the connection once it has the result
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return nil
+		}
+	}
+}
+
+// fleet is a coordinator on localhost with agents on their own ports, and
+// the key of the client that uploads packages and submits jobs
+type fleet struct {
+	server     *httptest.Server
+	client_key ed25519.PrivateKey
+	agents     map[string]*fake_agent
+}
+
+func new_fleet(t *testing.T) *fleet {
+	dir := t.TempDir()
+	config, err := load_config(filepath.Join(dir, CONFIG_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := common.EnsureDir(config.PackageDir); err != nil {
+		t.Fatal(err)
+	}
+	coordinator_public, coordinator_key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_public, client_key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.TrustedKeys, []byte(common.FormatPublicKey(client_public, "build01")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	coordinator := &Coordinator{
+		config:   config,
+		key:      coordinator_key,
+		registry: NewRegistry(config.heartbeat_timeout),
+		packages: NewPackageStore(config.PackageDir),
+		jobs:     NewJobs(config.MaxJobs),
+	}
+	test_fleet := &fleet{server: httptest.NewServer(coordinator.handler()), client_key: client_key, agents: make(map[string]*fake_agent)}
+	t.Cleanup(test_fleet.server.Close)
+
+	web := map[string]string{"role": "web"}
+	for _, agent := range []*fake_agent{
+		new_fake_agent(t, "web1", web, []string{"/srv"}, coordinator_public),
+		new_fake_agent(t, "web2", web, []string{"/srv"}, coordinator_public),
+		new_fake_agent(t, "web3", web, []string{"/opt"}, coordinator_public),
+		new_fake_agent(t, "db1", map[string]string{"role": "db"}, nil, coordinator_public),
+	} {
+		test_fleet.agents[agent.name] = agent
+	}
+	// the agent keys are named after the agents, as the heartbeat requires
+	var agent_keys bytes.Buffer
+	for _, agent := range test_fleet.agents {
+		agent_keys.WriteString(common.FormatPublicKey(agent.key.Public().(ed25519.PublicKey), agent.name) + "\n")
+	}
+	if err := os.WriteFile(config.AgentKeys, agent_keys.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, agent := range test_fleet.agents {
+		registration := common.AgentRegistration{
+			Name:         agent.name,
+			Addr:         agent.server.Listener.Addr().String(),
+			Version:      common.VERSION,
+			OS:           "linux/amd64",
+			Destinations: agent.roots,
+			Labels:       agent.labels,
+		}
+		response := test_fleet.send(t, http.MethodPost, common.COORD_HEARTBEAT, nil, registration, agent.key)
+		if response.StatusCode != http.StatusNoContent {
+			t.Fatalf("heartbeat of %s: %s", agent.name, response.Status)
+		}
+	}
+	return test_fleet
+}
+
+// send makes a request signed with key, a body that is not []byte is sent as
+// JSON
+func (test_fleet *fleet) send(t *testing.T, method string, path string, header http.Header, body any, key ed25519.PrivateKey) *http.Response {
+	t.Helper()
+	data, ok := body.([]byte)
+	if !ok && body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(method, test_fleet.server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	common.SignRequest(request.Header, method, request.URL.RequestURI(), data, key)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func decode(t *testing.T, response *http.Response, value any) {
+	t.Helper()
+	if response.StatusCode >= 300 {
+		t.Fatalf("request failed: %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upload stores a package of a few files, signed by the client
+func (test_fleet *fleet) upload(t *testing.T) ([]byte, common.PackageInfo) {
+	src := t.TempDir()
+	for name, content := range map[string]string{"app.dll": "binary", "web.config": "<configuration/>", "wwwroot/index.html": "<html/>"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var data bytes.Buffer
+	if _, err := common.Compress(src, &data, common.BeginProgressTo(common.ProgressEachValue)); err != nil {
+		t.Fatal(err)
+	}
+	key := test_fleet.client_key
+	signature := common.FormatSignature(key.Public().(ed25519.PublicKey), common.SignDigest(key, common.Digest(data.Bytes())))
+	var stored common.PackageInfo
+	decode(t, test_fleet.send(t, http.MethodPut, common.COORD_PACKAGES, http.Header{common.SIGNATURE_HEADER: {signature}}, data.Bytes(), key), &stored)
+	return data.Bytes(), stored
+}
+
+// run submits a job and waits for it to finish
+func (test_fleet *fleet) run(t *testing.T, request common.JobRequest) common.Job {
+	var job common.Job
+	decode(t, test_fleet.send(t, http.MethodPost, common.COORD_JOBS, nil, request, test_fleet.client_key), &job)
+	if job.Submitter != "build01" {
+		t.Errorf("submitter = %s, want build01", job.Submitter)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Finished == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not finish: %+v", job.ID, job)
+		}
+		time.Sleep(20 * time.Millisecond)
+		decode(t, test_fleet.send(t, http.MethodGet, common.COORD_JOBS+"?id="+job.ID, nil, nil, test_fleet.client_key), &job)
+	}
+	return job
+}
+
+func statuses(job common.Job) map[string]string {
+	result := make(map[string]string)
+	for _, agent := range job.Results {
+		result[agent.Agent] = agent.Status
+	}
+	return result
+}
+
+func TestJobFansOutBySelector(t *testing.T) {
+	test_fleet := new_fleet(t)
+	data, stored := test_fleet.upload(t)
+	job := test_fleet.run(t, common.JobRequest{
+		Digest:       stored.Digest,
+		Selector:     "role=web",
+		Destinations: []string{"/srv/app"},
+		Release:      "v1.2.0",
+		Vars:         map[string]string{"db_host": "sql01"},
+	})
+
+	if job.Status != common.JOB_DONE {
+		t.Errorf("job status = %s, want %s", job.Status, common.JOB_DONE)
+	}
+	// web3 has no root for the destination and db1 is not selected
+	want := map[string]string{"web1": common.JOB_DONE, "web2": common.JOB_DONE, "web3": common.JOB_SKIPPED}
+	if got := statuses(job); !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+	for _, result := range job.Results {
+		agent := test_fleet.agents[result.Agent]
+		agent.mutex.Lock()
+		defer agent.mutex.Unlock()
+		if result.Status != common.JOB_DONE {
+			if agent.meta != nil {
+				t.Errorf("%s was deployed to", result.Agent)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(result.Completed, []string{"/srv/app"}) {
+			t.Errorf("%s completed %v, want [/srv/app]", result.Agent, result.Completed)
+		}
+		if agent.meta == nil || agent.meta.Release != "v1.2.0" || agent.meta.Vars["db_host"] != "sql01" || agent.meta.Size != stored.Size {
+			t.Errorf("%s got meta %+v", result.Agent, agent.meta)
+		}
+		if !bytes.Equal(agent.received, data) {
+			t.Errorf("%s received %d bytes that differ from the %d byte package", result.Agent, len(agent.received), len(data))
+		}
+	}
+	if test_fleet.agents["db1"].meta != nil {
+		t.Error("db1 was deployed to without matching the selector")
+	}
+}
+
+func TestJobFailsWithAgentError(t *testing.T) {
+	test_fleet := new_fleet(t)
+	test_fleet.agents["web2"].kind = common.ERROR_LIMIT
+	_, stored := test_fleet.upload(t)
+	job := test_fleet.run(t, common.JobRequest{Digest: stored.Digest, Selector: "role=web", Destinations: []string{"/srv/app"}, Parallel: 1})
+
+	if job.Status != common.JOB_FAILED {
+		t.Errorf("job status = %s, want %s", job.Status, common.JOB_FAILED)
+	}
+	want := map[string]string{"web1": common.JOB_DONE, "web2": common.JOB_FAILED, "web3": common.JOB_SKIPPED}
+	if got := statuses(job); !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+	for _, result := range job.Results {
+		if result.Agent == "web2" && (result.Kind != common.ERROR_LIMIT || result.Error != "destination is full") {
+			t.Errorf("web2 failed with %s: %s, want %s: destination is full", result.Kind, result.Error, common.ERROR_LIMIT)
+		}
+	}
+}
+
+func TestJobStopsReadingAfterAgentError(t *testing.T) {
+	test_fleet := new_fleet(t)
+	test_fleet.agents["web2"].kind = common.ERROR_EXTRACT
+	test_fleet.agents["web2"].flood = true
+	_, stored := test_fleet.upload(t)
+	job := test_fleet.run(t, common.JobRequest{Digest: stored.Digest, Selector: "role=web", Destinations: []string{"/srv/app"}})
+	if status := statuses(job)["web2"]; status != common.JOB_FAILED {
+		t.Fatalf("web2 = %s, want %s", status, common.JOB_FAILED)
+	}
+
+	// the reader of web2's connection must not be left blocked on messages
+	// nobody reads once the push has returned
+	stack := make([]byte, 1<<20)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		stack = stack[:runtime.Stack(stack[:cap(stack)], true)]
+		if !strings.Contains(string(stack), "(*agentConn).read") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("an agent connection is still being read after its job finished:\n%s", stack)
+		}
+	}
+}
+
+func TestJobNeedsMatchingAgent(t *testing.T) {
+	test_fleet := new_fleet(t)
+	_, stored := test_fleet.upload(t)
+	response := test_fleet.send(t, http.MethodPost, common.COORD_JOBS, nil, common.JobRequest{Digest: stored.Digest, Selector: "role=cache", Destinations: []string{"/srv/app"}}, test_fleet.client_key)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("job for no agent: %s, want 400", response.Status)
+	}
+	// an agent's key cannot submit jobs
+	response = test_fleet.send(t, http.MethodPost, common.COORD_JOBS, nil, common.JobRequest{Digest: stored.Digest, Selector: "role=web", Destinations: []string{"/srv/app"}}, test_fleet.agents["web1"].key)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("job signed by an agent: %s, want 401", response.Status)
+	}
+}
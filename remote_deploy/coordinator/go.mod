@@ -0,0 +1,9 @@
+module remote_deploy/coordinator/v0.1.0
+
+go 1.18
+
+replace remote_deploy/common => ../common
+
+require remote_deploy/common v0.1.0
+
+require github.com/gorilla/websocket v1.5.0
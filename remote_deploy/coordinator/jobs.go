@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// Jobs holds the jobs in memory, the oldest finished jobs are dropped once
+// there are more than max
+type Jobs struct {
+	mutex sync.Mutex
+	jobs  []*common.Job // oldest first
+	max   int
+}
+
+func NewJobs(max int) *Jobs {
+	return &Jobs{max: max}
+}
+
+func (jobs *Jobs) add(job *common.Job) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	jobs.jobs = append(jobs.jobs, job)
+	for i := 0; len(jobs.jobs) > jobs.max && i < len(jobs.jobs); {
+		if jobs.jobs[i].Finished != nil {
+			jobs.jobs = append(jobs.jobs[:i], jobs.jobs[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// snapshot copies a job so it can be encoded while the job runs
+func snapshot(job *common.Job) common.Job {
+	copy_job := *job
+	copy_job.Results = append([]common.JobResult(nil), job.Results...)
+	return copy_job
+}
+
+func (jobs *Jobs) get(id string) (common.Job, bool) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	for _, job := range jobs.jobs {
+		if job.ID == id {
+			return snapshot(job), true
+		}
+	}
+	return common.Job{}, false
+}
+
+// list returns the jobs newest first
+func (jobs *Jobs) list() []common.Job {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	result := make([]common.Job, 0, len(jobs.jobs))
+	for i := len(jobs.jobs) - 1; i >= 0; i-- {
+		result = append(result, snapshot(jobs.jobs[i]))
+	}
+	return result
+}
+
+// update changes one agent's result of a running job
+func (jobs *Jobs) update(job *common.Job, index int, change func(result *common.JobResult)) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	change(&job.Results[index])
+}
+
+// finish sets the job's status from its results, it failed when any agent
+// failed or no agent deployed it
+func (jobs *Jobs) finish(job *common.Job) string {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.Status = common.JOB_FAILED
+	for _, result := range job.Results {
+		if result.Status == common.JOB_FAILED {
+			job.Status = common.JOB_FAILED
+			return job.Status
+		}
+		if result.Status == common.JOB_DONE {
+			job.Status = common.JOB_DONE
+		}
+	}
+	return job.Status
+}
+
+// handle_jobs lists the jobs, or the one given by ?id=, on GET and starts a
+// job on POST
+func (coordinator *Coordinator) handle_jobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if len(id) == 0 {
+			write_json(w, coordinator.jobs.list())
+			return
+		}
+		job, ok := coordinator.jobs.get(id)
+		if !ok {
+			http.Error(w, "no job "+id, http.StatusNotFound)
+			return
+		}
+		write_json(w, job)
+	case http.MethodPost:
+		var request common.JobRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&request); err != nil {
+			http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := coordinator.start_job(request, signer(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(job)
+	default:
+		http.Error(w, "jobs are listed with GET and started with POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// start_job works out which agents a job goes to and starts it. Matching
+// agents that are offline fail at once and those that do not serve the
+// destinations are skipped.
+func (coordinator *Coordinator) start_job(request common.JobRequest, submitter string) (common.Job, error) {
+	selector, err := common.ParseSelector(request.Selector)
+	if err != nil {
+		return common.Job{}, err
+	}
+	if len(request.Destinations) == 0 {
+		return common.Job{}, errors.New("destinations are required")
+	}
+	if request.Parallel < 0 {
+		return common.Job{}, errors.New("parallel must not be negative")
+	}
+	for name := range request.Vars {
+		if err := common.ValidateVarName(name); err != nil {
+			return common.Job{}, fmt.Errorf("vars: %v", err)
+		}
+	}
+	stored, err := coordinator.packages.get(request.Digest)
+	if err != nil {
+		return common.Job{}, err
+	}
+	agents := coordinator.registry.list(selector)
+	if len(agents) == 0 {
+		return common.Job{}, fmt.Errorf("no agent matches %s", selector)
+	}
+	request.Selector = selector.String()
+	job := &common.Job{ID: common.NewDeployID(), Request: request, Submitter: submitter, Created: time.Now().UTC(), Status: common.JOB_RUNNING}
+	for _, agent := range agents {
+		result := common.JobResult{Agent: agent.Name, Addr: agent.Addr, Status: common.JOB_PENDING}
+		if !agent.Online {
+			result.Status = common.JOB_FAILED
+			result.Kind = common.ERROR_TRANSFER
+			result.Error = fmt.Sprintf("agent is offline, last seen %s ago", time.Since(agent.LastSeen).Round(time.Second))
+		} else if !serves(agent, request.Destinations) {
+			result.Status = common.JOB_SKIPPED
+			result.Error = "agent does not deploy to " + strings.Join(request.Destinations, ", ")
+		}
+		job.Results = append(job.Results, result)
+	}
+	coordinator.jobs.add(job)
+	started := snapshot(job)
+	log.Info("job started", "job", job.ID, "digest", stored.Digest, "selector", request.Selector, "agents", len(agents), "submitter", submitter)
+	go coordinator.run_job(job, agents, stored)
+	return started, nil
+}
+
+// run_job deploys to the pending agents, at most parallel at a time
+func (coordinator *Coordinator) run_job(job *common.Job, agents []common.FleetAgent, stored *StoredPackage) {
+	job_log := log.With("job", job.ID)
+	parallel := coordinator.config.MaxParallel
+	if job.Request.Parallel > 0 && job.Request.Parallel < parallel {
+		parallel = job.Request.Parallel
+	}
+	manifest, err := coordinator.manifest(stored)
+	slots := make(chan struct{}, parallel)
+	var wait sync.WaitGroup
+	for i, agent := range agents {
+		if job.Results[i].Status != common.JOB_PENDING {
+			continue
+		}
+		if err != nil {
+			coordinator.jobs.update(job, i, func(result *common.JobResult) {
+				result.Status, result.Kind, result.Error = common.JOB_FAILED, common.ERROR_TRANSFER, err.Error()
+			})
+			continue
+		}
+		wait.Add(1)
+		go func(i int, agent common.FleetAgent) {
+			defer wait.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			coordinator.jobs.update(job, i, func(result *common.JobResult) { result.Status = common.JOB_RUNNING })
+			agent_log := job_log.With("agent", agent.Name)
+			agent_log.Info("deploying", "addr", agent.Addr)
+			push_err := coordinator.push(agent, job.Request, stored, manifest, func(progress string, completed []string) {
+				coordinator.jobs.update(job, i, func(result *common.JobResult) {
+					if len(progress) > 0 {
+						result.Progress = progress
+					}
+					if completed != nil {
+						result.Completed = append([]string(nil), completed...)
+					}
+				})
+			})
+			coordinator.jobs.update(job, i, func(result *common.JobResult) {
+				result.Status = common.JOB_DONE
+				if push_err != nil {
+					result.Status = common.JOB_FAILED
+					result.Kind = common.ERROR_TRANSFER
+					if e, ok := push_err.(*pushError); ok {
+						result.Kind = e.kind
+					}
+					result.Error = push_err.Error()
+				}
+			})
+			if push_err != nil {
+				agent_log.Warn("deploy failed", "err", push_err)
+			} else {
+				agent_log.Info("deploy finished")
+			}
+		}(i, agent)
+	}
+	wait.Wait()
+	job_log.Info("job finished", "status", coordinator.jobs.finish(job))
+}
+
+// manifest is the MANIFEST message of a stored package, the agents check it
+// before the upload
+func (coordinator *Coordinator) manifest(stored *StoredPackage) (string, error) {
+	file, err := os.Open(coordinator.packages.path(stored.Digest))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	manifest, err := common.ReadManifest(file)
+	if err != nil {
+		return "", err
+	}
+	return common.FormatManifest(manifest)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"remote_deploy/common"
+)
+
+var log *common.Logger
+
+// Coordinator keeps track of a fleet of agents and deploys stored packages to
+// those a job's selector matches
+type Coordinator struct {
+	config   CoordinatorConfig
+	key      ed25519.PrivateKey
+	registry *Registry
+	packages *PackageStore
+	jobs     *Jobs
+}
+
+func main() {
+	config_path := flag.String("config", default_config_path(), "settings file: -config c:\\deploy\\coordinator.json")
+	flag.Parse()
+
+	log = common.NewLogger(common.LevelInfo, common.NewWriterHandler(os.Stderr, common.LOG_TEXT))
+	config, err := load_config(*config_path)
+	if err != nil {
+		log.Error("failed to load config", "file", *config_path, "err", err)
+		os.Exit(1)
+	}
+	log = common.NewLogger(config.log_level, common.NewWriterHandler(os.Stderr, config.LogFormat))
+	key, err := common.LoadPrivateKey(config.Key)
+	if err != nil {
+		log.Error("failed to load the coordinator key, create one with the client's keygen", "file", config.Key, "err", err)
+		os.Exit(1)
+	}
+	if err := common.EnsureDir(config.PackageDir); err != nil {
+		log.Error("failed to create the package folder", "dir", config.PackageDir, "err", err)
+		os.Exit(1)
+	}
+	coordinator := &Coordinator{
+		config:   config,
+		key:      key,
+		registry: NewRegistry(config.heartbeat_timeout),
+		packages: NewPackageStore(config.PackageDir),
+		jobs:     NewJobs(config.MaxJobs),
+	}
+
+	server := http.Server{Addr: config.ListenAddr, Handler: coordinator.handler()}
+
+	log.Info("coordinator listening", "addr", config.ListenAddr, "version", common.VERSION)
+	if len(config.TLSCert) > 0 {
+		err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Error("failed to listen", "addr", config.ListenAddr, "err", err)
+		os.Exit(1)
+	}
+}
+
+// handler routes the coordinator's endpoints, agents sign their heartbeats
+// and clients everything else
+func (coordinator *Coordinator) handler() http.Handler {
+	config := coordinator.config
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.COORD_HEARTBEAT, coordinator.authorized(config.AgentKeys, coordinator.handle_heartbeat))
+	mux.HandleFunc(common.COORD_AGENTS, coordinator.authorized(config.TrustedKeys, coordinator.handle_agents))
+	mux.HandleFunc(common.COORD_PACKAGES, coordinator.authorized(config.TrustedKeys, coordinator.handle_packages))
+	mux.HandleFunc(common.COORD_JOBS, coordinator.authorized(config.TrustedKeys, coordinator.handle_jobs))
+	return mux
+}
+
+type signer_key struct{}
+
+// signer is the name of the key a request was signed with
+func signer(r *http.Request) string {
+	name, _ := r.Context().Value(signer_key{}).(string)
+	return name
+}
+
+// authorized only runs the handler for requests signed by one of the keys in
+// keys_path, the file is read on every request so keys can be added or
+// revoked without a restart
+func (coordinator *Coordinator) authorized(keys_path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trusted, err := common.LoadPublicKeys(keys_path)
+		if err != nil {
+			err = fmt.Errorf("no trusted keys configured: %v", err)
+		}
+		var key *common.TrustedKey
+		if err == nil {
+			key, err = common.VerifyRequest(r, trusted)
+		}
+		if err != nil {
+			log.Warn("rejected request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), signer_key{}, key.Name)))
+	}
+}
+
+func write_json(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
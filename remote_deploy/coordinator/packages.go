@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// StoredPackage is a package's description kept next to it, Signature is the
+// uploader's SIG message that agents verify the package against
+type StoredPackage struct {
+	common.PackageInfo
+	Signature string `json:"signature"`
+}
+
+// PackageStore keeps uploaded packages as <digest>.tar.gz with a
+// <digest>.json describing each
+type PackageStore struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+func NewPackageStore(dir string) *PackageStore {
+	return &PackageStore{dir: dir}
+}
+
+func valid_digest(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	return err == nil && len(decoded) == sha256.Size && digest == strings.ToLower(digest)
+}
+
+func (store *PackageStore) path(digest string) string {
+	return filepath.Join(store.dir, digest+".tar.gz")
+}
+
+func (store *PackageStore) info_path(digest string) string {
+	return filepath.Join(store.dir, digest+".json")
+}
+
+func (store *PackageStore) get(digest string) (*StoredPackage, error) {
+	if !valid_digest(digest) {
+		return nil, fmt.Errorf("invalid package digest: %s", digest)
+	}
+	data, err := os.ReadFile(store.info_path(digest))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("package %s was not uploaded", digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := new(StoredPackage)
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("package %s: %v", digest, err)
+	}
+	return stored, nil
+}
+
+// list returns the packages newest first
+func (store *PackageStore) list() ([]common.PackageInfo, error) {
+	names, err := filepath.Glob(filepath.Join(store.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	packages := make([]common.PackageInfo, 0, len(names))
+	for _, name := range names {
+		stored, err := store.get(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			continue
+		}
+		packages = append(packages, stored.PackageInfo)
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Uploaded.After(packages[j].Uploaded) })
+	return packages, nil
+}
+
+var errTooLarge = errors.New("package is too large")
+
+// add stores a package from src, hashing it as it is written. The signature
+// is checked against the clients' trusted keys before the package is kept,
+// the agents check it again against their own.
+func (store *PackageStore) add(src io.Reader, max_size int, signature string, trusted []common.TrustedKey) (*StoredPackage, error) {
+	signer_key, signed_digest, err := common.ParseSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(store.dir, "upload-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(src, int64(max_size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > int64(max_size) {
+		return nil, errTooLarge
+	}
+	digest := hash.Sum(nil)
+	key, err := common.VerifyDigest(trusted, signer_key, digest, signed_digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	manifest, err := common.ReadManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid package: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	stored := &StoredPackage{
+		PackageInfo: common.PackageInfo{Digest: hex.EncodeToString(digest), Size: int(size), Items: manifest.Items, Signer: key.Name, Uploaded: time.Now().UTC()},
+		Signature:   signature,
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := os.Rename(file.Name(), store.path(stored.Digest)); err != nil {
+		return nil, err
+	}
+	// the description is written last, a package without one was not stored
+	if err := os.WriteFile(store.info_path(stored.Digest)+".tmp", data, 0644); err != nil {
+		return nil, err
+	}
+	return stored, os.Rename(store.info_path(stored.Digest)+".tmp", store.info_path(stored.Digest))
+}
+
+// handle_packages lists the packages on GET and stores the body of a PUT,
+// signed with the SIGNATURE_HEADER
+func (coordinator *Coordinator) handle_packages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		packages, err := coordinator.packages.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		write_json(w, packages)
+	case http.MethodPut:
+		trusted, err := common.LoadPublicKeys(coordinator.config.TrustedKeys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stored, err := coordinator.packages.add(r.Body, coordinator.config.max_payload_bytes, r.Header.Get(common.SIGNATURE_HEADER), trusted)
+		if err == errTooLarge {
+			http.Error(w, fmt.Sprintf("package is larger than the limit of %s", common.FormatBytes(coordinator.config.max_payload_bytes)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Warn("rejected package", "remote", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("package stored", "digest", stored.Digest, "size", stored.Size, "items", stored.Items, "signer", stored.Signer)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(stored.PackageInfo)
+	default:
+		http.Error(w, "packages are listed with GET and uploaded with PUT", http.StatusMethodNotAllowed)
+	}
+}
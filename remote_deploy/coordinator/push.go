@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+// CHUNK_SIZE is how much of a package goes in each binary message
+const CHUNK_SIZE = 256 * 1024
+
+// pushError carries the error kind an agent reported, or the kind the
+// coordinator gives a failure of its own
+type pushError struct {
+	kind string
+	err  error
+}
+
+func (e *pushError) Error() string {
+	return e.err.Error()
+}
+
+func transfer_error(err error) *pushError {
+	return &pushError{kind: common.ERROR_TRANSFER, err: err}
+}
+
+// agentConn is a deploy connection to one agent, messages are read on their
+// own goroutine so the agent's pings are answered while the package is sent
+type agentConn struct {
+	*websocket.Conn
+	timeout  time.Duration
+	messages chan string
+	err      error         // why messages was closed
+	done     chan struct{} // closed by close, the reader stops handing on messages
+}
+
+// dial opens a signed /rfd WebSocket to the agent
+func (coordinator *Coordinator) dial(agent common.FleetAgent) (*agentConn, error) {
+	scheme := "ws"
+	if agent.TLS {
+		scheme = "wss"
+	}
+	target := url.URL{Scheme: scheme, Host: agent.Addr, Path: common.DEPLOY_PATH}
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: coordinator.config.agent_timeout, TLSClientConfig: coordinator.config.agent_tls}
+	header := make(http.Header)
+	common.SignRequest(header, http.MethodGet, target.RequestURI(), nil, coordinator.key)
+	conn, response, err := dialer.Dial(target.String(), header)
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusUnauthorized {
+			body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+			return nil, &pushError{kind: common.ERROR_AUTH, err: fmt.Errorf("agent refused the coordinator's key, add it to the agent's trusted keys: %s", strings.TrimSpace(string(body)))}
+		}
+		return nil, transfer_error(err)
+	}
+	conn.SetReadLimit(1024 * 1024)
+	c := &agentConn{Conn: conn, timeout: coordinator.config.agent_timeout, messages: make(chan string, 16), done: make(chan struct{})}
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(c.timeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.timeout))
+		if net_err, ok := err.(net.Error); err == websocket.ErrCloseSent || ok && net_err.Timeout() {
+			return nil
+		}
+		return err
+	})
+	go c.read()
+	return c, nil
+}
+
+func (c *agentConn) read() {
+	defer close(c.messages)
+	for {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		message_type, data, err := c.Conn.ReadMessage()
+		if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+			err = fmt.Errorf("agent sent nothing for %s", c.timeout)
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		if message_type == websocket.TextMessage {
+			select {
+			case c.messages <- string(data):
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// close ends the connection, along with the reader when push has returned
+// without reading every message the agent sent
+func (c *agentConn) close() {
+	close(c.done)
+	c.Conn.Close()
+}
+
+// next returns the agent's next message, an ERROR message is returned as a
+// pushError with the agent's kind
+func (c *agentConn) next() (string, error) {
+	message, ok := <-c.messages
+	if !ok {
+		if websocket.IsCloseError(c.err, websocket.CloseNormalClosure, websocket.CloseGoingAway) || c.err == nil {
+			return "", transfer_error(errors.New("agent closed the connection"))
+		}
+		return "", transfer_error(c.err)
+	}
+	if strings.HasPrefix(message, common.ERROR_BAR) {
+		kind, text := common.ParseError(message)
+		if len(kind) == 0 {
+			kind = common.ERROR_TRANSFER
+		}
+		return "", &pushError{kind: kind, err: errors.New(text)}
+	}
+	return message, nil
+}
+
+func (c *agentConn) send(message_type int, data []byte) error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := c.Conn.WriteMessage(message_type, data); err != nil {
+		return transfer_error(err)
+	}
+	return nil
+}
+
+// push deploys a stored package to one agent with the same messages a client
+// sends. The package goes with the signature of whoever uploaded it, so the
+// agent only deploys packages signed by a key it trusts itself.
+func (coordinator *Coordinator) push(agent common.FleetAgent, request common.JobRequest, stored *StoredPackage, manifest string, update func(progress string, completed []string)) error {
+	file, err := os.Open(coordinator.packages.path(stored.Digest))
+	if err != nil {
+		return transfer_error(err)
+	}
+	defer file.Close()
+
+	conn, err := coordinator.dial(agent)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	meta := common.DeployMeta{ID: common.NewDeployID(), Size: stored.Size, Count: stored.Items, Destinations: request.Destinations, Wait: request.Wait, Mirror: request.Mirror, Release: request.Release, Force: request.Force, Vars: request.Vars}
+	if err := conn.send(websocket.TextMessage, []byte(manifest)); err != nil {
+		return err
+	}
+	if err := conn.send(websocket.TextMessage, []byte(common.FormatMeta(meta))); err != nil {
+		return err
+	}
+	for {
+		message, err := conn.next()
+		if err != nil {
+			return err
+		}
+		if message == common.READY {
+			break
+		}
+		if strings.HasPrefix(message, common.QUEUED_BAR) {
+			position, _ := strconv.Atoi(strings.TrimPrefix(message, common.QUEUED_BAR))
+			update(fmt.Sprintf("queued at position %d", position), nil)
+		}
+	}
+
+	if err := conn.send(websocket.TextMessage, []byte(stored.Signature)); err != nil {
+		return err
+	}
+	chunk := make([]byte, CHUNK_SIZE)
+	for sent := 0; ; {
+		n, err := io.ReadFull(file, chunk)
+		if n > 0 {
+			if err := conn.send(websocket.BinaryMessage, chunk[:n]); err != nil {
+				return err
+			}
+			sent += n
+			update(fmt.Sprintf("sent %s of %s", common.FormatBytes(sent), common.FormatBytes(stored.Size)), nil)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return transfer_error(err)
+		}
+	}
+	if err := conn.send(websocket.TextMessage, []byte(common.DATA_DONE)); err != nil {
+		return err
+	}
+
+	var completed []string
+	for {
+		message, err := conn.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(message, "PROGRESS: "):
+			update(strings.TrimPrefix(message, "PROGRESS: "), nil)
+		case strings.HasPrefix(message, "PROG DONE: "):
+			completed = append(completed, strings.TrimSpace(strings.TrimPrefix(message, "PROG DONE: ")))
+			update("", completed)
+		case message == "DONE":
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// Registry holds the agents that have sent a heartbeat since the coordinator
+// started, agents register again within one heartbeat so nothing is stored
+type Registry struct {
+	mutex   sync.Mutex
+	agents  map[string]*common.FleetAgent
+	timeout time.Duration
+}
+
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{agents: make(map[string]*common.FleetAgent), timeout: timeout}
+}
+
+// heartbeat records an agent, it returns true when the agent is new or was
+// offline
+func (registry *Registry) heartbeat(registration common.AgentRegistration) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	now := time.Now()
+	previous, ok := registry.agents[registration.Name]
+	returned := !ok || now.Sub(previous.LastSeen) > registry.timeout
+	registry.agents[registration.Name] = &common.FleetAgent{AgentRegistration: registration, LastSeen: now.UTC()}
+	return returned
+}
+
+// list returns the agents the selector matches, all of them for a nil
+// selector, sorted by name
+func (registry *Registry) list(selector common.Selector) []common.FleetAgent {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	now := time.Now()
+	agents := make([]common.FleetAgent, 0, len(registry.agents))
+	for _, agent := range registry.agents {
+		if selector != nil && !selector.Matches(agent.Labels) {
+			continue
+		}
+		entry := *agent
+		entry.Online = now.Sub(agent.LastSeen) <= registry.timeout
+		agents = append(agents, entry)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// serves reports whether each destination lies below one of the agent's
+// roots, an agent without roots deploys anywhere
+func serves(agent common.FleetAgent, destinations []string) bool {
+	if len(agent.Destinations) == 0 {
+		return true
+	}
+	// the agent's own path rules apply, not the coordinator's
+	goos, _, _ := strings.Cut(agent.OS, "/")
+	for _, destination := range destinations {
+		if _, err := common.CheckDestination(destination, agent.Destinations, common.PathStyleOf(goos)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (coordinator *Coordinator) handle_heartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "heartbeats are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var registration common.AgentRegistration
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&registration)
+	if err == nil && (len(registration.Name) == 0 || len(registration.Addr) == 0) {
+		err = errors.New("name and addr are required")
+	}
+	if err != nil {
+		http.Error(w, "invalid heartbeat: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// an agent's key is named after it, so one agent cannot take over the
+	// name, and with it the deploys, of another
+	if registration.Name != signer(r) {
+		http.Error(w, fmt.Sprintf("agent %s must sign its heartbeats with the key named %s, not %s", registration.Name, registration.Name, signer(r)), http.StatusForbidden)
+		return
+	}
+	if coordinator.registry.heartbeat(registration) {
+		log.Info("agent registered", "agent", registration.Name, "addr", registration.Addr, "version", registration.Version, "labels", common.Selector(registration.Labels).String())
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handle_agents lists the agents, only those matching ?selector= when given
+func (coordinator *Coordinator) handle_agents(w http.ResponseWriter, r *http.Request) {
+	var selector common.Selector
+	if value := r.URL.Query().Get("selector"); len(value) > 0 {
+		var err error
+		if selector, err = common.ParseSelector(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	write_json(w, coordinator.registry.list(selector))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"remote_deploy/common"
+)
+
+// authorized only runs the handler for requests signed by a trusted key, it
+// guards deploys and file operations alike
+func (service *DeployAgentService) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trusted, err := common.LoadPublicKeys(service.config.TrustedKeys)
+		if err != nil {
+			err = fmt.Errorf("no trusted keys configured: %v", err)
+		} else {
+			_, err = common.VerifyRequest(r, trusted)
+		}
+		if err != nil {
+			log.Warn("rejected request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+			service.metrics.rejected(AUTH_REQUEST)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
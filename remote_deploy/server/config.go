@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"remote_deploy/common"
+)
+
+const CONFIG_FILE = "deploy_agent.json"
+
+// AgentConfig is read from deploy_agent.json next to the agent executable,
+// a missing file leaves every setting at its default
+type AgentConfig struct {
+	ListenAddr           string                    `json:"listen_addr"`
+	TrustedKeys          string                    `json:"trusted_keys"`
+	MaxConcurrentDeploys int                       `json:"max_concurrent_deploys"`
+	MaxPayloadSize       string                    `json:"max_payload_size"`  // such as "512MB"
+	StagingDir           string                    `json:"staging_dir"`       // deploy packages, kept for rollbacks
+	RetainReleases       int                       `json:"retain_releases"`   // staged packages kept per destination, its current one included, 0 keeps them all
+	RetainAge            string                    `json:"retain_age"`        // packages not deployed for this long are removed, such as "720h", empty keeps them
+	RetainSize           string                    `json:"retain_size"`       // staged packages of each destination root, those never deployed included, are trimmed to this total, such as "10GB", empty is no limit
+	PruneInterval        string                    `json:"prune_interval"`    // how often the janitor applies the retention settings
+	DestinationRoots     []string                  `json:"destination_roots"` // deploys and file operations are confined to these
+	Commands             map[string]*CommandConfig `json:"commands"`          // the allow-list for exec
+	HistoryFile          string                    `json:"history_file"`
+	TLSCert              string                    `json:"tls_cert"` // serve TLS when both are set
+	TLSKey               string                    `json:"tls_key"`
+	ResumeWindow         string                    `json:"resume_window"`      // how long a dropped upload waits for its client, such as "2m"
+	IdleTimeout          string                    `json:"idle_timeout"`       // how long a client may send nothing, not even a pong
+	WriteTimeout         string                    `json:"write_timeout"`      // how long a write to a client may block
+	MetricsToken         string                    `json:"metrics_token"`      // bearer token Prometheus sends for /metrics, open when empty
+	LogLevel             string                    `json:"log_level"`          // debug, info, warn or error
+	LogFile              string                    `json:"log_file"`           // written as well as the event log when set
+	LogFormat            string                    `json:"log_format"`         // text or json, for the log file
+	LogMaxSize           string                    `json:"log_max_size"`       // the log file is rotated at this size, such as "10MB"
+	LogMaxFiles          int                       `json:"log_max_files"`      // rotated log files kept
+	Coordinator          string                    `json:"coordinator"`        // URL of a coordinator to register with, such as "https://deploy:8090"
+	CoordinatorKey       string                    `json:"coordinator_key"`    // private key heartbeats are signed with
+	CoordinatorCA        string                    `json:"coordinator_ca"`     // PEM certificate the coordinator's is checked against
+	Name                 string                    `json:"name"`               // the agent's name on the coordinator and of its key there, the hostname by default
+	AdvertiseAddr        string                    `json:"advertise_addr"`     // where the coordinator reaches the agent, listen_addr by default
+	Labels               map[string]string         `json:"labels"`             // matched by the selectors of coordinator jobs
+	HeartbeatInterval    string                    `json:"heartbeat_interval"` // such as "15s"
+	UpdateKeys           string                    `json:"update_keys"`        // keys allowed to update the agent itself, updates are refused without the file
+	UpdateTimeout        string                    `json:"update_timeout"`     // how long a new executable has to start before the previous one is restored
+	Templates            []string                  `json:"templates"`          // files rendered as they are extracted, such as ["*.tmpl", "config/appsettings.json"]
+	TemplateVars         map[string]string         `json:"template_vars"`      // this host's values for templates, a deploy's own values override them
+	SecretsFile          string                    `json:"secrets_file"`       // the encrypted secrets templates and commands refer to by name
+	SecretsKey           string                    `json:"secrets_key"`        // the key of secrets_file, made when the first secret is set
+	max_payload_bytes    int
+	log_level            common.Level
+	log_max_bytes        int
+	resume_window        time.Duration
+	idle_timeout         time.Duration
+	write_timeout        time.Duration
+	heartbeat_interval   time.Duration
+	update_timeout       time.Duration
+	retain_age           time.Duration
+	retain_bytes         int
+	prune_interval       time.Duration
+}
+
+func default_config() AgentConfig {
+	return AgentConfig{
+		ListenAddr:           "localhost:8081",
+		TrustedKeys:          "trusted_keys",
+		MaxConcurrentDeploys: 4,
+		MaxPayloadSize:       "1GB",
+		StagingDir:           "staging",
+		RetainReleases:       5,
+		PruneInterval:        "1h",
+		HistoryFile:          "history.jsonl",
+		ResumeWindow:         "2m",
+		IdleTimeout:          "60s",
+		WriteTimeout:         "10s",
+		LogLevel:             "info",
+		LogFormat:            common.LOG_TEXT,
+		LogMaxSize:           "10MB",
+		LogMaxFiles:          5,
+		CoordinatorKey:       "agent.key",
+		HeartbeatInterval:    "15s",
+		UpdateKeys:           "update_keys",
+		UpdateTimeout:        "60s",
+		SecretsFile:          "secrets.json",
+		SecretsKey:           "secrets.key",
+	}
+}
+
+// agent_path resolves a file name relative to the agent executable
+func agent_path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(filepath.Dir(exe), name)
+}
+
+func load_config() (AgentConfig, error) {
+	config := default_config()
+	data, err := os.ReadFile(agent_path(CONFIG_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return config, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, err
+		}
+	}
+	config.TrustedKeys = agent_path(config.TrustedKeys)
+	config.UpdateKeys = agent_path(config.UpdateKeys)
+	config.StagingDir = agent_path(config.StagingDir)
+	config.HistoryFile = agent_path(config.HistoryFile)
+	config.SecretsFile = agent_path(config.SecretsFile)
+	config.SecretsKey = agent_path(config.SecretsKey)
+	if (len(config.TLSCert) > 0) != (len(config.TLSKey) > 0) {
+		return config, errors.New("tls_cert and tls_key must be set together")
+	}
+	if len(config.TLSCert) > 0 {
+		config.TLSCert = agent_path(config.TLSCert)
+		config.TLSKey = agent_path(config.TLSKey)
+	}
+	if config.max_payload_bytes, err = common.ParseBytes(config.MaxPayloadSize); err != nil {
+		return config, fmt.Errorf("max_payload_size: %v", err)
+	}
+	if config.RetainReleases < 0 {
+		return config, errors.New("retain_releases: must not be negative")
+	}
+	if len(config.RetainAge) > 0 {
+		if config.retain_age, err = time.ParseDuration(config.RetainAge); err != nil || config.retain_age <= 0 {
+			return config, fmt.Errorf("retain_age: invalid duration %q", config.RetainAge)
+		}
+	}
+	if len(config.RetainSize) > 0 {
+		if config.retain_bytes, err = common.ParseBytes(config.RetainSize); err != nil || config.retain_bytes <= 0 {
+			return config, fmt.Errorf("retain_size: invalid size %q", config.RetainSize)
+		}
+	}
+	if config.prune_interval, err = time.ParseDuration(config.PruneInterval); err != nil || config.prune_interval <= 0 {
+		return config, fmt.Errorf("prune_interval: invalid duration %q", config.PruneInterval)
+	}
+	for i, root := range config.DestinationRoots {
+		parsed, err := common.ParseDestination(root, common.LocalPathStyle)
+		if err != nil {
+			return config, fmt.Errorf("destination_roots: %v", err)
+		}
+		config.DestinationRoots[i] = parsed.String()
+	}
+	for _, pattern := range config.Templates {
+		if err := common.ValidateTemplatePattern(pattern); err != nil {
+			return config, fmt.Errorf("templates: %v", err)
+		}
+	}
+	for name := range config.TemplateVars {
+		if err := common.ValidateVarName(name); err != nil {
+			return config, fmt.Errorf("template_vars: %v", err)
+		}
+	}
+	if config.resume_window, err = time.ParseDuration(config.ResumeWindow); err != nil {
+		return config, fmt.Errorf("resume_window: %v", err)
+	}
+	if config.idle_timeout, err = time.ParseDuration(config.IdleTimeout); err != nil || config.idle_timeout <= 0 {
+		return config, fmt.Errorf("idle_timeout: invalid duration %q", config.IdleTimeout)
+	}
+	if config.write_timeout, err = time.ParseDuration(config.WriteTimeout); err != nil || config.write_timeout <= 0 {
+		return config, fmt.Errorf("write_timeout: invalid duration %q", config.WriteTimeout)
+	}
+	if config.update_timeout, err = time.ParseDuration(config.UpdateTimeout); err != nil || config.update_timeout <= 0 {
+		return config, fmt.Errorf("update_timeout: invalid duration %q", config.UpdateTimeout)
+	}
+	if config.log_level, err = common.ParseLevel(config.LogLevel); err != nil {
+		return config, fmt.Errorf("log_level: %v", err)
+	}
+	if err := common.ValidateLogFormat(config.LogFormat); err != nil {
+		return config, fmt.Errorf("log_format: %v", err)
+	}
+	if config.log_max_bytes, err = common.ParseBytes(config.LogMaxSize); err != nil || config.log_max_bytes <= 0 {
+		return config, fmt.Errorf("log_max_size: invalid size %q", config.LogMaxSize)
+	}
+	if config.LogMaxFiles < 0 {
+		return config, fmt.Errorf("log_max_files: must not be negative")
+	}
+	if len(config.LogFile) > 0 {
+		config.LogFile = agent_path(config.LogFile)
+	}
+	if len(config.Coordinator) > 0 {
+		if err := config.parse_coordinator(); err != nil {
+			return config, err
+		}
+	}
+	for name, command := range config.Commands {
+		if command == nil {
+			return config, fmt.Errorf("commands.%s: is empty", name)
+		}
+		if err := command.parse(name); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+func (config *AgentConfig) parse_coordinator() error {
+	coordinator, err := url.Parse(config.Coordinator)
+	if err != nil || (coordinator.Scheme != "http" && coordinator.Scheme != "https") || len(coordinator.Host) == 0 {
+		return fmt.Errorf("coordinator: invalid URL %q", config.Coordinator)
+	}
+	if config.heartbeat_interval, err = time.ParseDuration(config.HeartbeatInterval); err != nil || config.heartbeat_interval <= 0 {
+		return fmt.Errorf("heartbeat_interval: invalid duration %q", config.HeartbeatInterval)
+	}
+	config.CoordinatorKey = agent_path(config.CoordinatorKey)
+	if len(config.CoordinatorCA) > 0 {
+		config.CoordinatorCA = agent_path(config.CoordinatorCA)
+	}
+	if len(config.Name) == 0 {
+		config.Name, _ = os.Hostname()
+	}
+	if len(config.AdvertiseAddr) == 0 {
+		config.AdvertiseAddr = config.ListenAddr
+	}
+	return nil
+}
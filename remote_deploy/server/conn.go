@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errIdle = errors.New("client was idle")
+
+// clientConn is a client's WebSocket with a deadline on every read and write,
+// it pings the client so a connection that is only half open is closed after
+// the idle timeout instead of holding a handler and its locks forever
+type clientConn struct {
+	*websocket.Conn
+	idle_timeout  time.Duration
+	write_timeout time.Duration
+	metrics       *DeployMetrics
+	stop          chan struct{}
+	stop_once     sync.Once
+}
+
+// accept upgrades a request to a WebSocket and starts its heartbeat
+func (service *DeployAgentService) accept(w http.ResponseWriter, r *http.Request) (*clientConn, error) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(MAX_MESSAGE_SIZE)
+	c := &clientConn{Conn: conn, idle_timeout: service.config.idle_timeout, write_timeout: service.config.write_timeout, metrics: service.metrics, stop: make(chan struct{})}
+	c.metrics.connection(1)
+	conn.SetPingHandler(func(data string) error {
+		c.extend()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.write_timeout))
+		if net_err, ok := err.(net.Error); err == websocket.ErrCloseSent || ok && net_err.Timeout() {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(string) error {
+		c.extend()
+		return nil
+	})
+	go c.heartbeat()
+	return c, nil
+}
+
+func (c *clientConn) extend() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.idle_timeout))
+}
+
+func (c *clientConn) heartbeat() {
+	ticker := time.NewTicker(c.idle_timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.write_timeout)); err != nil {
+				return
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// ReadMessage returns errIdle when the client sends nothing, not even a pong,
+// for the idle timeout
+func (c *clientConn) ReadMessage() (int, []byte, error) {
+	c.extend()
+	message_type, data, err := c.Conn.ReadMessage()
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		err = errIdle
+	}
+	return message_type, data, err
+}
+
+func (c *clientConn) WriteMessage(message_type int, data []byte) error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(c.write_timeout))
+	err := c.Conn.WriteMessage(message_type, data)
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		err = fmt.Errorf("client stopped reading for %s", c.write_timeout)
+	}
+	return err
+}
+
+func (c *clientConn) Close() error {
+	c.stop_once.Do(func() {
+		close(c.stop)
+		c.metrics.connection(-1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// free_space returns the bytes available to the agent on the volume holding
+// path, path must exist
+func free_space(path string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
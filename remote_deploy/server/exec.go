@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+// CommandConfig is one entry of the exec allow-list, each argument is a
+// text/template filled from the request's params, such as "{{.pool}}"
+type CommandConfig struct {
+	Program   string            `json:"program"`
+	Args      []string          `json:"args"`
+	Timeout   string            `json:"timeout"` // such as "60s", defaults to EXEC_TIMEOUT
+	Secrets   map[string]string `json:"secrets"` // environment variables set to secrets, such as {"DB_PASSWORD": "db_password"}
+	templates []*template.Template
+	timeout   time.Duration
+}
+
+const EXEC_TIMEOUT = 5 * time.Minute
+const EXEC_CHUNK_SIZE = 4 * 1024
+
+// parse checks the command's templates and timeout when the config is loaded
+func (command *CommandConfig) parse(name string) error {
+	if len(command.Program) == 0 {
+		return fmt.Errorf("commands.%s: program is required", name)
+	}
+	command.templates = make([]*template.Template, len(command.Args))
+	for i, arg := range command.Args {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return fmt.Errorf("commands.%s: %v", name, err)
+		}
+		command.templates[i] = tmpl
+	}
+	for variable, secret := range command.Secrets {
+		if len(variable) == 0 || strings.ContainsAny(variable, "=\x00") {
+			return fmt.Errorf("commands.%s: secrets: invalid environment variable %q", name, variable)
+		}
+		if err := common.ValidateVarName(secret); err != nil {
+			return fmt.Errorf("commands.%s: secrets: %v", name, err)
+		}
+	}
+	command.timeout = EXEC_TIMEOUT
+	if len(command.Timeout) > 0 {
+		timeout, err := time.ParseDuration(command.Timeout)
+		if err != nil {
+			return fmt.Errorf("commands.%s: %v", name, err)
+		}
+		command.timeout = timeout
+	}
+	return nil
+}
+
+// args renders the argument templates, params are only ever substituted into
+// a single argument and the program is run without a shell. A value starting
+// with a dash is refused, as the program could take it for an option the
+// allow-list did not give.
+func (command *CommandConfig) args(params map[string]string) ([]string, error) {
+	for name, value := range params {
+		if strings.ContainsAny(value, "\x00\r\n") {
+			return nil, fmt.Errorf("param %s contains a control character", name)
+		}
+		if strings.HasPrefix(value, "-") {
+			return nil, fmt.Errorf("param %s starts with a dash, it could be taken for an option", name)
+		}
+	}
+	args := make([]string, len(command.templates))
+	for i, tmpl := range command.templates {
+		var arg strings.Builder
+		if err := tmpl.Execute(&arg, params); err != nil {
+			return nil, err
+		}
+		args[i] = arg.String()
+	}
+	return args, nil
+}
+
+// handle_exec runs an allowed command in a directory inside the destination
+// roots, streaming its output as it is written and finishing with its exit code
+func (service *DeployAgentService) handle_exec(w http.ResponseWriter, r *http.Request) {
+	c, err := service.accept(w, r)
+	if err != nil {
+		log.Error("failed to upgrade to a WebSocket", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	defer c.Close()
+
+	mt, message, err := c.ReadMessage()
+	if err != nil {
+		return
+	}
+	if mt != websocket.TextMessage || !strings.HasPrefix(string(message), common.EXEC_BAR) {
+		_ = c.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_TRANSFER, errors.New("unknown command"))))
+		return
+	}
+	request, err := common.ParseExec(string(message))
+	if err != nil {
+		_ = c.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_TRANSFER, err)))
+		return
+	}
+	cmd, ctx, cancel, err := service.prepare_exec(request)
+	if err != nil {
+		log.Warn("rejected exec", "command", request.Command, "dir", request.Dir, "remote", r.RemoteAddr, "err", err)
+		_ = c.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_EXEC, err)))
+		return
+	}
+	defer cancel()
+
+	// stdout and stderr are streamed from their own goroutines
+	var write_mutex sync.Mutex
+	stdout := &execWriter{conn: c, mutex: &write_mutex, prefix: common.STDOUT_BAR}
+	stderr := &execWriter{conn: c, mutex: &write_mutex, prefix: common.STDERR_BAR}
+	stdout_pipe, err := cmd.StdoutPipe()
+	if err == nil {
+		var stderr_pipe io.ReadCloser
+		if stderr_pipe, err = cmd.StderrPipe(); err == nil {
+			if err = cmd.Start(); err == nil {
+				log.Info("exec", "command", request.Command, "dir", cmd.Dir, "remote", r.RemoteAddr)
+				var streams sync.WaitGroup
+				streams.Add(2)
+				go stream_output(stdout_pipe, stdout, &streams)
+				go stream_output(stderr_pipe, stderr, &streams)
+
+				// the client closing the connection stops the command
+				go func() {
+					for {
+						if _, _, err := c.ReadMessage(); err != nil {
+							cancel()
+							return
+						}
+					}
+				}()
+
+				streams.Wait()
+				err = cmd.Wait()
+			}
+		}
+	}
+
+	code := 0
+	var exit_err *exec.ExitError
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s timed out after %s", request.Command, service.config.Commands[request.Command].timeout)
+	}
+	if errors.As(err, &exit_err) {
+		code = exit_err.ExitCode()
+	} else if err != nil {
+		_ = c.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_EXEC, err)))
+		return
+	}
+	write_mutex.Lock()
+	defer write_mutex.Unlock()
+	_ = c.WriteMessage(websocket.TextMessage, []byte(common.EXIT_BAR+strconv.Itoa(code)))
+}
+
+// prepare_exec checks the request against the allow-list and the destination
+// roots and builds the command to run
+func (service *DeployAgentService) prepare_exec(request common.ExecRequest) (*exec.Cmd, context.Context, context.CancelFunc, error) {
+	command, ok := service.config.Commands[request.Command]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("command is not allowed: %s", request.Command)
+	}
+	dir, _, err := service.within_roots(request.Dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, nil, nil, fmt.Errorf("not a directory: %s", request.Dir)
+	}
+	args, err := command.args(request.Params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	env, err := service.secret_env(command)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), command.timeout)
+	cmd := exec.CommandContext(ctx, command.Program, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	return cmd, ctx, cancel, nil
+}
+
+// execWriter sends each write as a text message with the stream's prefix
+type execWriter struct {
+	conn   *clientConn
+	mutex  *sync.Mutex
+	prefix string
+}
+
+func (writer *execWriter) Write(data []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if err := writer.conn.WriteMessage(websocket.TextMessage, append([]byte(writer.prefix), data...)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// stream_output forwards output as soon as it is read rather than by line, so
+// progress written without a newline shows up straight away
+func stream_output(src io.Reader, dst io.Writer, streams *sync.WaitGroup) {
+	defer streams.Done()
+	buffer := make([]byte, EXEC_CHUNK_SIZE)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				// keep draining so the command is not blocked on a full pipe
+				_, _ = io.Copy(io.Discard, src)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"remote_deploy/common"
+)
+
+// fetch_package downloads a pull deploy into the staging directory, named by
+// its digest so an interrupted download resumes on the next attempt, then
+// runs the same preflight a pushed package gets. A rollback has no source and
+// uses the package staged by an earlier deploy. The error kind tells the
+// client whether the download or the preflight failed.
+func (service *DeployAgentService) fetch_package(conn common.MessageWriter, meta common.DeployMeta) (*os.File, string, error) {
+	digest, err := hex.DecodeString(meta.Digest)
+	if err != nil || len(digest) != 32 {
+		return nil, common.ERROR_TRANSFER, fmt.Errorf("invalid package digest: %s", meta.Digest)
+	}
+	if err := common.EnsureDir(service.config.StagingDir); err != nil {
+		return nil, common.ERROR_TRANSFER, err
+	}
+	path := service.staged_path(meta.Digest)
+	if _, err := os.Stat(path); len(meta.Source) == 0 && err != nil {
+		return nil, common.ERROR_TRANSFER, fmt.Errorf("package %s is not staged on this agent", meta.Digest)
+	}
+	progress := common.BeginProgressTo(common.ProgressBytesRate, common.NewWebSocketSink(conn, nil, "PROGRESS: "))
+	if err := common.FetchPackage(meta.Source, path, digest, service.config.max_payload_bytes, progress); err != nil {
+		return nil, common.ERROR_TRANSFER, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, common.ERROR_TRANSFER, err
+	}
+	manifest, err := common.ReadManifest(file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, common.ERROR_TRANSFER, fmt.Errorf("invalid package %s: %v", meta.Source, err)
+	}
+	if err := preflight(manifest, meta.Destinations); err != nil {
+		file.Close()
+		return nil, common.ERROR_LIMIT, err
+	}
+	return file, "", nil
+}
+
+func (service *DeployAgentService) staged_path(digest string) string {
+	return filepath.Join(service.config.StagingDir, digest+".tar.gz")
+}
+
+// stage_package keeps a pushed package so it can be rolled back to, written
+// to a temporary name first so a partial file is never taken for the package
+func (service *DeployAgentService) stage_package(digest string, data []byte) error {
+	path := service.staged_path(digest)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := common.EnsureDir(service.config.StagingDir); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
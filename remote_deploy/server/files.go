@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"remote_deploy/common"
+)
+
+// within_roots normalises the path and checks it is one of the destination
+// roots or inside one, following links so one inside a root cannot lead out
+// of it. File operations are refused when no roots are configured.
+func (service *DeployAgentService) within_roots(path string) (clean string, is_root bool, err error) {
+	if len(path) == 0 {
+		return "", false, errors.New("path is required")
+	}
+	destination, err := common.ParseDestination(path, common.LocalPathStyle)
+	if err != nil {
+		return "", false, err
+	}
+	resolved, err := common.ResolveLinks(destination)
+	if err != nil {
+		return "", false, err
+	}
+	for _, root := range service.config.DestinationRoots {
+		parsed, err := common.ParseDestination(root, common.LocalPathStyle)
+		if err != nil {
+			continue
+		}
+		if parsed, err = common.ResolveLinks(parsed); err != nil {
+			continue
+		}
+		if resolved.Within(parsed) {
+			return destination.String(), len(resolved.Names) == len(parsed.Names), nil
+		}
+	}
+	return "", false, fmt.Errorf("path is outside the destination roots: %s", path)
+}
+
+// check_destinations normalises the destinations of a deploy, with roots
+// configured each must be within one, without them a deploy may go anywhere
+func (service *DeployAgentService) check_destinations(meta *common.DeployMeta) error {
+	for i, destination := range meta.Destinations {
+		if len(service.config.DestinationRoots) > 0 {
+			clean, _, err := service.within_roots(destination)
+			if err != nil {
+				return err
+			}
+			meta.Destinations[i] = clean
+			continue
+		}
+		parsed, err := common.ParseDestination(destination, common.LocalPathStyle)
+		if err != nil {
+			return err
+		}
+		meta.Destinations[i] = parsed.String()
+	}
+	return nil
+}
+
+func write_json(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func (service *DeployAgentService) handle_fs_list(w http.ResponseWriter, r *http.Request) {
+	path, _, err := service.within_roots(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	items, err := os.ReadDir(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	entries := make([]common.FileEntry, 0, len(items))
+	for _, item := range items {
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, common.NewFileEntry(info))
+	}
+	write_json(w, entries)
+}
+
+func (service *DeployAgentService) handle_fs_stat(w http.ResponseWriter, r *http.Request) {
+	path, _, err := service.within_roots(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	write_json(w, common.NewFileEntry(info))
+}
+
+// handle_fs_get streams the path as a tar.gz in the same format as a deploy
+// package, so the client can extract it with common.Uncompress
+func (service *DeployAgentService) handle_fs_get(w http.ResponseWriter, r *http.Request) {
+	path, _, err := service.within_roots(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)+".tar.gz"))
+	if _, err := common.Compress(path, w, common.BeginProgressTo(common.ProgressEachValue)); err != nil {
+		log.Error("failed to send file", "path", path, "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+func (service *DeployAgentService) handle_fs_delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "delete requires the DELETE method", http.StatusMethodNotAllowed)
+		return
+	}
+	path, is_root, err := service.within_roots(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if is_root {
+		http.Error(w, "a destination root cannot be deleted", http.StatusForbidden)
+		return
+	}
+	// a deploy to the folder, one it is in or one within it would have files
+	// removed from under it
+	release, err := service.queue.Acquire([]string{path}, false, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer release()
+	if _, err := os.Lstat(path); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := os.RemoveAll(path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info("deleted", "path", path, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
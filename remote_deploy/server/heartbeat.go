@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// heartbeat registers the agent with the coordinator every interval until
+// stop is closed. The coordinator takes an agent that misses a few
+// heartbeats to be offline, so a failure is only logged when it starts and
+// when it clears.
+func (service *DeployAgentService) heartbeat(stop chan struct{}) {
+	config := service.config
+	key, err := common.LoadPrivateKey(config.CoordinatorKey)
+	if err != nil {
+		log.Error("failed to load the coordinator key, the agent is not registered", "file", config.CoordinatorKey, "err", err)
+		return
+	}
+	client, err := coordinator_client(config)
+	if err != nil {
+		log.Error("failed to set up the coordinator connection, the agent is not registered", "err", err)
+		return
+	}
+	target := strings.TrimSuffix(config.Coordinator, "/") + common.COORD_HEARTBEAT
+	ticker := time.NewTicker(config.heartbeat_interval)
+	defer ticker.Stop()
+	var failing error
+	for first := true; ; first = false {
+		err := service.send_heartbeat(client, target, key)
+		if err != nil && (first || failing == nil) {
+			log.Warn("failed to register with the coordinator", "coordinator", config.Coordinator, "err", err)
+		}
+		if err == nil && (first || failing != nil) {
+			log.Info("registered with the coordinator", "coordinator", config.Coordinator, "name", config.Name, "labels", common.Selector(config.Labels).String())
+		}
+		failing = err
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func coordinator_client(config AgentConfig) (*http.Client, error) {
+	tls_config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.CoordinatorCA) > 0 {
+		pem, err := os.ReadFile(config.CoordinatorCA)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CoordinatorCA)
+		}
+	}
+	return &http.Client{Timeout: config.heartbeat_interval, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tls_config}}, nil
+}
+
+func (service *DeployAgentService) send_heartbeat(client *http.Client, target string, key ed25519.PrivateKey) error {
+	config := service.config
+	info := agent_info()
+	active, _ := service.queue.Status()
+	body, err := json.Marshal(common.AgentRegistration{
+		Name:         config.Name,
+		Addr:         config.AdvertiseAddr,
+		TLS:          len(config.TLSCert) > 0,
+		Version:      info.Version,
+		Hostname:     info.Hostname,
+		OS:           info.OS,
+		Destinations: config.DestinationRoots,
+		Labels:       config.Labels,
+		Active:       active,
+	})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	common.SignRequest(request.Header, http.MethodPost, request.URL.RequestURI(), body, key)
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		text, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s %s", response.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
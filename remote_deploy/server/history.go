@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+const HISTORY_LIMIT = 50
+
+// DeployHistory appends every deploy to a JSON lines file, it is read back
+// for the history and status endpoints and to find a package to roll back to
+type DeployHistory struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func NewDeployHistory(path string) *DeployHistory {
+	return &DeployHistory{path: path}
+}
+
+func (history *DeployHistory) Append(entries ...common.HistoryEntry) error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	file, err := os.OpenFile(history.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read returns every entry, oldest first, a missing file is an empty history
+func (history *DeployHistory) read() ([]common.HistoryEntry, error) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	entries := make([]common.HistoryEntry, 0)
+	file, err := os.Open(history.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry common.HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Query returns the newest entries first, only those for destination when
+// it is not empty
+func (history *DeployHistory) Query(destination string, limit int) ([]common.HistoryEntry, error) {
+	entries, err := history.read()
+	if err != nil {
+		return nil, err
+	}
+	key := destination_key(destination)
+	result := make([]common.HistoryEntry, 0)
+	for i := len(entries) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		if len(destination) == 0 || destination_key(entries[i].Destination) == key {
+			result = append(result, entries[i])
+		}
+	}
+	return result, nil
+}
+
+// Latest returns the newest entry of each destination
+func (history *DeployHistory) Latest() ([]common.HistoryEntry, error) {
+	entries, err := history.read()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	result := make([]common.HistoryEntry, 0)
+	for i := len(entries) - 1; i >= 0; i-- {
+		key := destination_key(entries[i].Destination)
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, entries[i])
+		}
+	}
+	return result, nil
+}
+
+// Current returns the newest successful entry of each destination, the
+// release it is on now
+func (history *DeployHistory) Current() ([]common.HistoryEntry, error) {
+	entries, err := history.read()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	result := make([]common.HistoryEntry, 0)
+	for i := len(entries) - 1; i >= 0; i-- {
+		key := destination_key(entries[i].Destination)
+		if entries[i].Status == "ok" && !seen[key] {
+			seen[key] = true
+			result = append(result, entries[i])
+		}
+	}
+	return result, nil
+}
+
+// Releases returns the release labels a destination has had, newest first.
+// Deploys without a label are left out, so the first is the latest labelled.
+func (history *DeployHistory) Releases(destination string) ([]string, error) {
+	entries, err := history.Query(destination, 0)
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Status == "ok" && len(entry.Release) > 0 {
+			releases = append(releases, entry.Release)
+		}
+	}
+	return releases, nil
+}
+
+// check_release refuses a release older than the one a destination is on
+// unless the deploy is forced. Labels that cannot be ordered, such as git
+// SHAs, are older when the destination had them before its current one.
+func (service *DeployAgentService) check_release(meta common.DeployMeta) error {
+	if len(meta.Release) == 0 || meta.Force {
+		return nil
+	}
+	for _, destination := range meta.Destinations {
+		releases, err := service.history.Releases(destination)
+		if err != nil {
+			return err
+		}
+		if len(releases) == 0 || releases[0] == meta.Release {
+			continue
+		}
+		older := false
+		if order, ok := common.CompareReleases(meta.Release, releases[0]); ok {
+			older = order < 0
+		} else {
+			for _, earlier := range releases[1:] {
+				older = older || earlier == meta.Release
+			}
+		}
+		if older {
+			return fmt.Errorf("%s is on release %s and %s is older, force the deploy to go back to it", destination, releases[0], meta.Release)
+		}
+	}
+	return nil
+}
+
+// record_deploy adds a deploy to the history, the destination that failed is
+// recorded with the error and those after it are left out as they were not
+// touched
+func (service *DeployAgentService) record_deploy(meta common.DeployMeta, kind string, signer string, completed []string, deploy_err error) {
+	entry := common.HistoryEntry{
+		Time:    time.Now().UTC(),
+		Kind:    kind,
+		Digest:  meta.Digest,
+		Release: meta.Release,
+		Vars:    meta.Vars,
+		Size:    meta.Size,
+		Items:   meta.Count,
+		Signer:  signer,
+		Status:  "ok",
+	}
+	entries := make([]common.HistoryEntry, 0, len(completed)+1)
+	for _, destination := range completed {
+		entry.Destination = destination
+		entries = append(entries, entry)
+	}
+	if deploy_err != nil && len(completed) < len(meta.Destinations) {
+		entry.Destination = meta.Destinations[len(completed)]
+		entry.Status = "failed"
+		entry.Error = deploy_err.Error()
+		entries = append(entries, entry)
+	}
+	if err := service.history.Append(entries...); err != nil {
+		log.Warn("failed to record deploy", "deploy", meta.ID, "file", service.history.path, "err", err)
+	}
+}
+
+func (service *DeployAgentService) handle_history(w http.ResponseWriter, r *http.Request) {
+	limit := HISTORY_LIMIT
+	if value := r.URL.Query().Get("limit"); len(value) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid limit: "+value, http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := service.history.Query(r.URL.Query().Get("dst"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	write_json(w, entries)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"golang.org/x/sys/windows/svc/debug"
+
+	"remote_deploy/common"
+)
+
+// event IDs by level, so the event log can be filtered on them
+const (
+	EVENT_INFO    = 1
+	EVENT_WARNING = 2
+	EVENT_ERROR   = 3
+	EVENT_DEBUG   = 4
+)
+
+// EventLogHandler writes records to the Windows event log, or the console
+// when the agent is not running as a service. The event log keeps its own
+// time and level, so only the message and fields are written.
+type EventLogHandler struct {
+	elog debug.Log
+}
+
+func NewEventLogHandler(elog debug.Log) *EventLogHandler {
+	return &EventLogHandler{elog: elog}
+}
+
+func (handler *EventLogHandler) Handle(record common.LogRecord) {
+	text := SERVICE_NAME + ": " + record.Message
+	if len(record.Fields) > 0 {
+		text += " " + common.FormatLogFields(record.Fields)
+	}
+	switch record.Level {
+	case common.LevelError:
+		_ = handler.elog.Error(EVENT_ERROR, text)
+	case common.LevelWarn:
+		_ = handler.elog.Warning(EVENT_WARNING, text)
+	case common.LevelDebug:
+		_ = handler.elog.Info(EVENT_DEBUG, text)
+	default:
+		_ = handler.elog.Info(EVENT_INFO, text)
+	}
+}
+
+// setup_logging sends records to the event log and, when configured, to a
+// rotating log file, which is returned so the agent can close it when it
+// stops. The file is optional, so failing to open it is logged rather than
+// stopping the agent.
+func setup_logging(elog debug.Log, config AgentConfig) (*common.Logger, *common.RotatingFileHandler) {
+	handlers := []common.LogHandler{NewEventLogHandler(elog)}
+	var file *common.RotatingFileHandler
+	var file_err error
+	if len(config.LogFile) > 0 {
+		file, file_err = common.NewRotatingFileHandler(config.LogFile, config.LogFormat, config.log_max_bytes, config.LogMaxFiles)
+		if file_err == nil {
+			handlers = append(handlers, file)
+		}
+	}
+	logger := common.NewLogger(config.log_level, handlers...)
+	if file_err != nil {
+		logger.Error("failed to open log file", "path", config.LogFile, "err", file_err)
+	}
+	return logger, file
+}
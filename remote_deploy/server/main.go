@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/sys/windows/svc/debug"
 
@@ -17,118 +24,466 @@ import (
 	"remote_deploy/winsvc"
 )
 
-var upgrader = websocket.Upgrader{}
-var log debug.Log
+var upgrader = websocket.Upgrader{EnableCompression: true}
+var log *common.Logger
 var deploy_agent DeployAgentService
 
 const SERVICE_NAME = "Deploy Agent"
 
-func main() {
+// MAX_MESSAGE_SIZE bounds a single WebSocket message, data arrives in chunks
+// far smaller than this and the manifest is the largest text message
+const MAX_MESSAGE_SIZE = 64 * 1024 * 1024
 
-	deploy_agent = DeployAgentService{listen_addr: "localhost:8081"}
+func main() {
 
-	service_manager := winsvc.ServiceManager{Name: SERVICE_NAME, Desc: SERVICE_NAME, Service: &deploy_agent}
+	service_manager := winsvc.ServiceManager{Name: SERVICE_NAME, Desc: SERVICE_NAME}
+	deploy_agent = DeployAgentService{exit: service_manager.Exit}
+	service_manager.Service = &deploy_agent
 
 	if len(os.Args) > 1 {
-		service_manager.Command(os.Args[1])
-	} else {
-		service_manager.Run()
+		switch os.Args[1] {
+		case VERSION_COMMAND:
+			fmt.Println(common.VERSION)
+		case UPDATE_COMMAND:
+			finish_update(os.Args[2:])
+		default:
+			service_manager.Command(os.Args[1])
+		}
+		return
+	}
+	service_manager.Run()
+	// an update stops the agent for the previous executable to start the new
+	// one, the agent's log is closed by now
+	if deploy_agent.updating {
+		if err := start_update_helper(service_manager.IsService(), deploy_agent.config.update_timeout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed to start the update helper: %v\n", SERVICE_NAME, err)
+			os.Exit(1)
+		}
 	}
 }
 
 type DeployAgentService struct {
 	listen_addr string
 	server      http.Server
+	config      AgentConfig
+	queue       *DeployQueue
+	history     *DeployHistory
+	secrets     *SecretStore
+	sessions    *DeploySessions
+	metrics     *DeployMetrics
+	events      *UIEvents
+	ui_sessions *UISessions
+	stop        chan struct{}
+	log_file    *common.RotatingFileHandler
+	exit        func() // stops the agent as the service manager would
+	update_lock sync.Mutex
+	prune_lock  sync.Mutex
+	updating    bool // the agent stopped for an update
 }
 
 func (service *DeployAgentService) Start(elog debug.Log) {
 
-	log = elog
+	// the event log alone until the config says where else to log
+	log = common.NewLogger(common.LevelInfo, NewEventLogHandler(elog))
+
+	config, err := load_config()
+	if err != nil {
+		log.Error("failed to load config", "file", CONFIG_FILE, "err", err)
+		return
+	}
+	log, service.log_file = setup_logging(elog, config)
+	if len(config.DestinationRoots) == 0 {
+		log.Warn("no destination_roots are configured, deploys may write to any folder the service account can, set destination_roots to confine them")
+	}
+	service.config = config
+	service.listen_addr = config.ListenAddr
+	service.queue = NewDeployQueue(config.MaxConcurrentDeploys)
+	service.history = NewDeployHistory(config.HistoryFile)
+	service.secrets = NewSecretStore(config.SecretsFile, config.SecretsKey)
+	service.metrics = NewDeployMetrics()
+	service.events = NewUIEvents()
+	service.ui_sessions = NewUISessions()
+	service.sessions = NewDeploySessions(config.resume_window, service.metrics, service.events)
 
 	srvmux := http.NewServeMux()
 
-	srvmux.HandleFunc("/rfd", handle_rfd)
+	srvmux.HandleFunc(common.DEPLOY_PATH, service.authorized(service.handle_rfd))
+	srvmux.HandleFunc(common.FS_LIST, service.authorized(service.handle_fs_list))
+	srvmux.HandleFunc(common.FS_STAT, service.authorized(service.handle_fs_stat))
+	srvmux.HandleFunc(common.FS_GET, service.authorized(service.handle_fs_get))
+	srvmux.HandleFunc(common.FS_DELETE, service.authorized(service.handle_fs_delete))
+	srvmux.HandleFunc(common.EXEC_PATH, service.authorized(service.handle_exec))
+	srvmux.HandleFunc(common.PING_PATH, service.authorized(service.handle_ping))
+	srvmux.HandleFunc(common.STATUS_PATH, service.authorized(service.handle_status))
+	srvmux.HandleFunc(common.HISTORY_PATH, service.authorized(service.handle_history))
+	srvmux.HandleFunc(common.SECRETS_PATH, service.authorized(service.handle_secrets))
+	srvmux.HandleFunc(common.PRUNE_PATH, service.authorized(service.handle_prune))
+	srvmux.HandleFunc(common.UPDATE_PATH, service.authorized(service.handle_update))
+	srvmux.HandleFunc(METRICS_PATH, service.handle_metrics)
+	service.register_ui(srvmux)
 
 	srvmux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Hello, friend. Who are you?")
 	})
 
+	service.stop = make(chan struct{})
+	go service.janitor(service.stop)
+	if len(config.Coordinator) > 0 {
+		go service.heartbeat(service.stop)
+	}
+
 	service.server = http.Server{
 		Addr:    service.listen_addr,
 		Handler: srvmux,
 	}
+	if len(config.TLSCert) > 0 {
+		certificate, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			log.Error("failed to load the TLS certificate", "cert", config.TLSCert, "err", err)
+			return
+		}
+		service.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+	listener, err := net.Listen("tcp", service.listen_addr)
+	if err != nil {
+		log.Error("failed to listen", "addr", service.listen_addr, "err", err)
+		return
+	}
+	// listening is the health an update waits for
+	confirm_update()
 
-	err := service.server.ListenAndServe()
+	if len(config.TLSCert) > 0 {
+		err = service.server.ServeTLS(listener, "", "")
+	} else {
+		err = service.server.Serve(listener)
+	}
 	if err != nil && err != http.ErrServerClosed {
-		log.Error(1, fmt.Sprintf("%s: failed to listen on %s, error: %v", SERVICE_NAME, service.listen_addr, err))
+		log.Error("failed to serve", "addr", service.listen_addr, "err", err)
 	}
 }
 
 func (service *DeployAgentService) Stop() {
+	if service.stop != nil {
+		close(service.stop)
+	}
 	service.server.Close()
+	// lines logged by deploys still finishing only go to the event log
+	if service.log_file != nil {
+		service.log_file.Close()
+	}
 }
 
-func handle_rfd(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+func (service *DeployAgentService) handle_rfd(w http.ResponseWriter, r *http.Request) {
+	c, err := service.accept(w, r)
 	if err != nil {
-		log.Error(1, fmt.Sprintf("%s: failed to upgrade to a WebSocket! %v", SERVICE_NAME, err))
+		log.Error("failed to upgrade to a WebSocket", "remote", r.RemoteAddr, "err", err)
 		return
 	}
 	defer c.Close()
+	// lines about the connection, the deploy ID is added once it is known
+	conn_log := log.With("remote", r.RemoteAddr)
 
-	buffer := bytes.NewBuffer(make([]byte, 0, 10*1024*1024))
-	data_size := 0
-	destinations := make([]string, 0)
+	// the manifest arrives before the meta data that opens the session
+	var manifest *common.Manifest
+	var session *DeploySession
+	// a connection that drops leaves the session for the client to resume,
+	// one that ends in an error abandons it
+	abort := true
+	defer func() {
+		if session != nil {
+			service.sessions.detach(session, c, abort)
+		}
+	}()
+	send := func(message string) error {
+		if session != nil {
+			return session.WriteMessage(websocket.TextMessage, []byte(message))
+		}
+		return c.WriteMessage(websocket.TextMessage, []byte(message))
+	}
 
 	for {
 		mt, message, err := c.ReadMessage()
+		if err == errIdle {
+			if session != nil && session.state().Status == common.STATE_RECEIVING {
+				conn_log.Warn("closing idle connection, the upload is discarded unless resumed", "resume_window", service.config.ResumeWindow)
+			} else {
+				conn_log.Warn("closing idle connection")
+			}
+			abort = false
+			return
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Error(1, fmt.Sprintf("%s: failed to read from WebSocket! %v", SERVICE_NAME, err))
+				conn_log.Error("failed to read from WebSocket", "err", err)
 			}
+			abort = false
 			return
 		}
 
 		switch {
-		case mt == websocket.TextMessage && string(message[0:5]) == common.META_BAR:
-			meta_strings := strings.Split(string(message[5:]), "|")
-			data_size, _ = strconv.Atoi(meta_strings[0])
-			destinations = strings.Split(meta_strings[2], ",")
+		case mt == websocket.TextMessage && strings.HasPrefix(string(message), common.META_BAR):
+			if session != nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, errors.New("meta data was already sent")))
+				return
+			}
+			meta, err := common.ParseMeta(string(message))
+			if err != nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, err))
+				return
+			}
+			if err := service.check_destinations(&meta); err != nil {
+				conn_log.Warn("rejected deploy", "destinations", strings.Join(meta.Destinations, ";"), "err", err)
+				_ = send(common.FormatError(common.ERROR_LIMIT, err))
+				return
+			}
+			if meta.DryRun {
+				err = send_plans(c, manifest, meta)
+				break
+			}
+			if meta.Size > service.config.max_payload_bytes {
+				err = fmt.Errorf("payload of %s is larger than the limit of %s", common.FormatBytes(meta.Size), common.FormatBytes(service.config.max_payload_bytes))
+				_ = send(common.FormatError(common.ERROR_LIMIT, err))
+				return
+			}
+			release, err := service.queue.Acquire(meta.Destinations, meta.Wait, func(position int) error {
+				return c.WriteMessage(websocket.TextMessage, []byte(common.FormatQueued(position)))
+			})
+			if err != nil {
+				_ = send(common.FormatError(common.ERROR_BUSY, err))
+				return
+			}
+			if err := service.check_release(meta); err != nil {
+				release()
+				conn_log.Warn("rejected deploy", "release", meta.Release, "err", err)
+				_ = send(common.FormatError(common.ERROR_RELEASE, err))
+				return
+			}
+			if session, err = service.sessions.open(c, meta, manifest, release); err != nil {
+				release()
+				_ = send(common.FormatError(common.ERROR_TRANSFER, err))
+				return
+			}
+			conn_log = conn_log.With("deploy", session.id)
+			conn_log.Info("deploy started", "destinations", strings.Join(meta.Destinations, ";"), "size", meta.Size, "items", meta.Count, "source", meta.Source, "digest", meta.Digest, "release", meta.Release)
+			// fetched packages are checked once they are downloaded
+			if meta.Fetched() {
+				err = send(common.READY)
+				break
+			}
+			if err := preflight(manifest, meta.Destinations); err != nil {
+				conn_log.Warn("rejected deploy", "err", err)
+				_ = send(common.FormatError(common.ERROR_LIMIT, err))
+				return
+			}
+			session.buffer = bytes.NewBuffer(make([]byte, 0, meta.Size))
+			err = send(common.READY)
+		case mt == websocket.TextMessage && strings.HasPrefix(string(message), common.RESUME_BAR):
+			if session != nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, errors.New("deploy was already started")))
+				return
+			}
+			session = service.sessions.attach(strings.TrimPrefix(string(message), common.RESUME_BAR), c)
+			if session == nil {
+				// the client starts over on this connection
+				err = send(common.FormatState(common.DeployState{Status: common.STATE_UNKNOWN}))
+				break
+			}
+			conn_log = conn_log.With("deploy", session.id)
+			conn_log.Info("deploy resumed", "status", session.state().Status, "received", session.state().Received)
+			err = send(common.FormatState(session.state()))
+		case mt == websocket.TextMessage && strings.HasPrefix(string(message), common.MANIFEST_BAR):
+			if manifest, err = common.ParseManifest(string(message)); err != nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, err))
+				return
+			}
+		case mt == websocket.TextMessage && strings.HasPrefix(string(message), common.SIG_BAR):
+			if session == nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, errors.New("meta data was not sent")))
+				return
+			}
+			session.signer, session.signature, err = common.ParseSignature(string(message))
+			if err != nil {
+				_ = send(common.FormatError(common.ERROR_AUTH, err))
+				return
+			}
 		case mt == websocket.TextMessage && string(message) == common.DATA_DONE:
-			if buffer.Len() != data_size {
-				_ = c.WriteMessage(websocket.TextMessage, []byte("ERROR: inavlid data size"))
+			if session == nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, errors.New("meta data was not sent")))
+				return
 			}
-			if err := decompress_deploy(c, buffer.Bytes(), destinations); err != nil {
-				_ = c.WriteMessage(websocket.TextMessage, []byte("ERROR: "+err.Error()))
+			if !service.run_deploy(session) {
+				return
 			}
 		case mt == websocket.BinaryMessage:
-			buffer.Write(message)
+			if session == nil || session.buffer == nil {
+				_ = send(common.FormatError(common.ERROR_TRANSFER, errors.New("data sent before meta data")))
+				return
+			}
+			if session.buffer.Len()+len(message) > session.meta.Size {
+				err = fmt.Errorf("received more than the %d bytes declared in the meta data", session.meta.Size)
+				_ = send(common.FormatError(common.ERROR_LIMIT, err))
+				return
+			}
+			session.mutex.Lock()
+			session.buffer.Write(message)
+			session.mutex.Unlock()
+			service.metrics.received(len(message))
 		default:
-			_ = c.WriteMessage(mt, []byte("ERROR: unknown command"))
+			_ = send(common.FormatError(common.ERROR_TRANSFER, errors.New("unknown command")))
 			return
 		}
 
 		if err != nil {
-			log.Error(1, fmt.Sprintf("%s: failed to write to WebSocket! %v", SERVICE_NAME, err))
+			conn_log.Error("failed to write to WebSocket", "err", err)
+			abort = false
 			return
 		}
 	}
 }
 
-func decompress_deploy(conn *websocket.Conn, compress_buffer []byte, destinations []string) error {
-	progress := common.BeginProgress(func(count int, total int, message string) string {
-		m := "PROGRESS: " + common.ProgressEachValue(count, total, message)
-		_ = conn.WriteMessage(websocket.TextMessage, []byte(m))
-		return m
-	})
-	progress.DisablePrint()
+// run_deploy verifies and extracts a package once it is complete, progress
+// goes to whichever connection the client is on by then. It returns false
+// when the deploy was rejected before anything was extracted.
+func (service *DeployAgentService) run_deploy(session *DeploySession) bool {
+	if session.state().Status != common.STATE_RECEIVING {
+		_ = session.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_TRANSFER, errors.New("deploy was already started"))))
+		return false
+	}
+	session.set_status(common.STATE_DEPLOYING)
+	fail := func(kind string, err error) bool {
+		if kind == common.ERROR_AUTH {
+			service.metrics.rejected(AUTH_SIGNATURE)
+		}
+		service.sessions.finish(session, nil, kind, err)
+		_ = session.WriteMessage(websocket.TextMessage, []byte(common.FormatError(kind, err)))
+		return false
+	}
+	meta := session.meta
+	var err error
+	var signer_name string
+	var package_data io.ReadSeeker
+	kind := common.DEPLOY_PUSH
+	if meta.Fetched() {
+		// the signature covers the expected digest, so it is checked
+		// before the agent downloads anything
+		digest, _ := hex.DecodeString(meta.Digest)
+		if signer_name, err = service.verify_signature(digest, session.signer, session.signature); err != nil {
+			session.log.Warn("rejected deploy", "err", err)
+			return fail(common.ERROR_AUTH, err)
+		}
+		session.log.Info("deploy signed", "signer", signer_name, "fingerprint", common.Fingerprint(session.signer))
+		file, error_kind, err := service.fetch_package(session, meta)
+		if err != nil {
+			session.log.Warn("failed to fetch package", "source", meta.Source, "err", err)
+			return fail(error_kind, err)
+		}
+		defer file.Close()
+		package_data = file
+		if info, err := file.Stat(); err == nil {
+			meta.Size = int(info.Size())
+		}
+		kind = common.DEPLOY_PULL
+		if len(meta.Source) == 0 {
+			kind = common.DEPLOY_ROLLBACK
+		}
+	} else {
+		service.metrics.upload_took(time.Since(session.opened))
+		data := session.buffer.Bytes()
+		if len(data) != meta.Size {
+			return fail(common.ERROR_TRANSFER, fmt.Errorf("invalid data size, expected %d bytes and received %d", meta.Size, len(data)))
+		}
+		digest := common.Digest(data)
+		if signer_name, err = service.verify_signature(digest, session.signer, session.signature); err != nil {
+			session.log.Warn("rejected deploy", "err", err)
+			return fail(common.ERROR_AUTH, err)
+		}
+		session.log.Info("deploy signed", "signer", signer_name, "fingerprint", common.Fingerprint(session.signer))
+		meta.Digest = hex.EncodeToString(digest)
+		if err := service.stage_package(meta.Digest, data); err != nil {
+			session.log.Warn("failed to stage package for rollbacks", "digest", meta.Digest, "err", err)
+		}
+		package_data = bytes.NewReader(data)
+	}
+	service.complete_deploy(session, package_data, meta, kind, signer_name)
+	return true
+}
+
+// complete_deploy extracts a verified package and records the outcome, it is
+// the end of every deploy whether a client or the dashboard started it
+func (service *DeployAgentService) complete_deploy(session *DeploySession, package_data io.ReadSeeker, meta common.DeployMeta, kind string, signer_name string) {
+	completed, deploy_err := service.decompress_deploy(session, package_data, meta, session.log)
+	service.sessions.finish(session, completed, common.ERROR_EXTRACT, deploy_err)
+	if deploy_err != nil {
+		session.log.Error("deploy failed", "completed", strings.Join(completed, ";"), "err", deploy_err)
+		_ = session.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_EXTRACT, deploy_err)))
+	} else {
+		session.log.Info("deploy finished", "kind", kind, "digest", meta.Digest)
+		_ = session.WriteMessage(websocket.TextMessage, []byte("DONE"))
+	}
+	service.record_deploy(meta, kind, signer_name, completed, deploy_err)
+}
+
+// verify_signature is run before anything is extracted, the trusted keys are
+// read on every deploy so keys can be added or revoked without a restart
+func (service *DeployAgentService) verify_signature(digest []byte, signer ed25519.PublicKey, signature []byte) (string, error) {
+	trusted, err := common.LoadPublicKeys(service.config.TrustedKeys)
+	if err != nil {
+		return "", fmt.Errorf("no trusted keys configured: %v", err)
+	}
+	key, err := common.VerifyDigest(trusted, signer, digest, signature)
+	if err != nil {
+		return "", err
+	}
+	return key.Name, nil
+}
+
+// decompress_deploy extracts the package to each destination in turn, stopping
+// at the first that fails, and returns the destinations that were completed
+func (service *DeployAgentService) decompress_deploy(conn common.MessageWriter, package_data io.ReadSeeker, meta common.DeployMeta, logger *common.Logger) (completed []string, err error) {
+	destinations := meta.Destinations
+	defer func(start time.Time) {
+		service.metrics.extract_took(time.Since(start))
+	}(time.Now())
+	// mirror deletes are worked out from the verified package rather than the
+	// manifest the client sent
+	var manifest *common.Manifest
+	if meta.Mirror {
+		if manifest, err = common.ReadManifest(package_data); err != nil {
+			return nil, err
+		}
+	}
+	// templates are rendered before anything is written, a missing value
+	// fails the deploy with every destination as it was
+	templates := service.templates(meta)
+	if templates != nil {
+		if _, err := package_data.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := templates.Render(package_data); err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			templates.Rename(manifest)
+		}
+		if rendered := templates.Rendered(); len(rendered) > 0 {
+			logger.Info("rendered templates", "templates", strings.Join(rendered, ";"))
+		}
+	}
+	progress := common.BeginProgressTo(common.ProgressEachValue, common.NewWebSocketSink(conn, nil, "PROGRESS: "), common.ProgressSinkFunc(service.metrics.extracted), common.NewLogSink(logger, false))
 	for i := 0; i < len(destinations); i++ {
-		reader := bytes.NewReader(compress_buffer)
-		if err := common.Uncompress(reader, destinations[i], progress); err != nil {
-			return err
+		if _, err := package_data.Seek(0, io.SeekStart); err != nil {
+			return completed, err
+		}
+		if err := common.UncompressTemplates(package_data, destinations[i], templates, progress); err != nil {
+			return completed, fmt.Errorf("%s: %v", destinations[i], err)
+		}
+		if meta.Mirror {
+			if err := mirror_delete(manifest, destinations[i]); err != nil {
+				return completed, fmt.Errorf("%s: %v", destinations[i], err)
+			}
 		}
+		completed = append(completed, destinations[i])
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("PROG DONE: "+destinations[i]))
 	}
-	_ = conn.WriteMessage(websocket.TextMessage, []byte("DONE"))
-	return nil
+	return completed, nil
 }
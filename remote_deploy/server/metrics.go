@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+const METRICS_PATH = "/metrics"
+
+// deploy outcomes counted per destination
+const (
+	DEPLOY_STARTED   = "started"
+	DEPLOY_SUCCEEDED = "succeeded"
+	DEPLOY_FAILED    = "failed"
+)
+
+// reasons an auth attempt is rejected, a request without a valid signature
+// header or a package signed by a key that is not trusted
+const (
+	AUTH_REQUEST   = "request"
+	AUTH_SIGNATURE = "signature"
+)
+
+// buckets in seconds, from a small site on a LAN to a large one over a VPN
+var duration_buckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+// histogram counts observations into cumulative buckets the way Prometheus
+// expects them
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// DeployMetrics are the agent's counters since it started, written in the
+// Prometheus text format by hand to keep the agent free of a client library
+type DeployMetrics struct {
+	mutex            sync.Mutex
+	deploys          map[string]map[string]uint64 // outcome -> destination -> count
+	received_bytes   uint64
+	extracted_files  uint64
+	extract_duration *histogram
+	upload_duration  *histogram
+	connections      int64
+	auth_rejected    map[string]uint64
+}
+
+func NewDeployMetrics() *DeployMetrics {
+	return &DeployMetrics{
+		deploys:          map[string]map[string]uint64{DEPLOY_STARTED: {}, DEPLOY_SUCCEEDED: {}, DEPLOY_FAILED: {}},
+		extract_duration: newHistogram(duration_buckets),
+		upload_duration:  newHistogram(duration_buckets),
+		auth_rejected:    map[string]uint64{AUTH_REQUEST: 0, AUTH_SIGNATURE: 0},
+	}
+}
+
+func (metrics *DeployMetrics) started(destinations []string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	for _, destination := range destinations {
+		metrics.deploys[DEPLOY_STARTED][destination]++
+	}
+}
+
+// finished counts the destinations that were completed as succeeded and the
+// rest as failed
+func (metrics *DeployMetrics) finished(destinations []string, completed []string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	done := make(map[string]bool)
+	for _, destination := range completed {
+		done[destination] = true
+	}
+	for _, destination := range destinations {
+		if done[destination] {
+			metrics.deploys[DEPLOY_SUCCEEDED][destination]++
+		} else {
+			metrics.deploys[DEPLOY_FAILED][destination]++
+		}
+	}
+}
+
+func (metrics *DeployMetrics) received(n int) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.received_bytes += uint64(n)
+}
+
+// extracted is a progress sink, the final update of an extraction carries the
+// number of items written
+func (metrics *DeployMetrics) extracted(update common.ProgressUpdate) {
+	if !update.Final {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.extracted_files += uint64(update.Stats.Count)
+}
+
+func (metrics *DeployMetrics) extract_took(d time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.extract_duration.observe(d.Seconds())
+}
+
+func (metrics *DeployMetrics) upload_took(d time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.upload_duration.observe(d.Seconds())
+}
+
+// connection adds one to the open WebSocket count, or removes one when delta
+// is negative
+func (metrics *DeployMetrics) connection(delta int64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.connections += delta
+}
+
+func (metrics *DeployMetrics) rejected(reason string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.auth_rejected[reason]++
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (metrics *DeployMetrics) WriteTo(w io.Writer) (int64, error) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	var b strings.Builder
+	for _, outcome := range []string{DEPLOY_STARTED, DEPLOY_SUCCEEDED, DEPLOY_FAILED} {
+		name := "deploy_agent_deploys_" + outcome + "_total"
+		write_header(&b, name, "counter", "Deploys "+outcome+" by destination.")
+		counts := metrics.deploys[outcome]
+		destinations := make([]string, 0, len(counts))
+		for destination := range counts {
+			destinations = append(destinations, destination)
+		}
+		sort.Strings(destinations)
+		for _, destination := range destinations {
+			fmt.Fprintf(&b, "%s{destination=\"%s\"} %d\n", name, escape_label(destination), counts[destination])
+		}
+	}
+	write_header(&b, "deploy_agent_received_bytes_total", "counter", "Bytes of packages received from clients.")
+	fmt.Fprintf(&b, "deploy_agent_received_bytes_total %d\n", metrics.received_bytes)
+	write_header(&b, "deploy_agent_extracted_files_total", "counter", "Files and folders extracted into destinations.")
+	fmt.Fprintf(&b, "deploy_agent_extracted_files_total %d\n", metrics.extracted_files)
+	write_histogram(&b, "deploy_agent_extract_duration_seconds", "Time taken to extract a package into all of its destinations.", metrics.extract_duration)
+	write_histogram(&b, "deploy_agent_upload_duration_seconds", "Time taken to receive a pushed package.", metrics.upload_duration)
+	write_header(&b, "deploy_agent_active_connections", "gauge", "Open WebSocket connections.")
+	fmt.Fprintf(&b, "deploy_agent_active_connections %d\n", metrics.connections)
+	write_header(&b, "deploy_agent_auth_rejected_total", "counter", "Requests and packages rejected for their signature.")
+	for _, reason := range []string{AUTH_REQUEST, AUTH_SIGNATURE} {
+		fmt.Fprintf(&b, "deploy_agent_auth_rejected_total{reason=\"%s\"} %d\n", reason, metrics.auth_rejected[reason])
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func write_header(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func write_histogram(b *strings.Builder, name string, help string, h *histogram) {
+	write_header(b, name, "histogram", help)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+// escape_label escapes a label value, Windows paths are full of backslashes
+func escape_label(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// handle_metrics is scraped by Prometheus, which cannot sign requests, so it
+// is guarded by a bearer token when metrics_token is set instead
+func (service *DeployAgentService) handle_metrics(w http.ResponseWriter, r *http.Request) {
+	if token := service.config.MetricsToken; len(token) > 0 {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			service.metrics.rejected(AUTH_REQUEST)
+			http.Error(w, "invalid metrics token", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = service.metrics.WriteTo(w)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+// send_plans answers a dry run with the plan for each destination, nothing is
+// uploaded and the destinations are not locked since nothing is written
+func send_plans(conn *clientConn, manifest *common.Manifest, meta common.DeployMeta) error {
+	if manifest == nil {
+		return conn.WriteMessage(websocket.TextMessage, []byte(common.FormatError(common.ERROR_TRANSFER, errors.New("manifest was not sent"))))
+	}
+	for _, destination := range meta.Destinations {
+		message, err := common.FormatPlan(common.BuildPlan(manifest, destination, meta.Mirror))
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			return err
+		}
+	}
+	return conn.WriteMessage(websocket.TextMessage, []byte("DONE"))
+}
+
+// mirror_delete removes what the package did not contain once it has been
+// extracted, using the same listing a dry run reports
+func mirror_delete(manifest *common.Manifest, destination string) error {
+	extras, err := common.MirrorExtras(manifest, destination, common.LocalPathStyle)
+	if err != nil {
+		return err
+	}
+	for _, extra := range extras {
+		target, err := common.ExtractTarget(destination, extra.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"remote_deploy/common"
+)
+
+// existing_parent walks up from a destination that may not exist yet to the
+// nearest directory that does, which is on the same volume
+func existing_parent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// preflight runs before the upload so a deploy that cannot fit is rejected
+// before any file is touched, destinations on the same volume are added
+// together since each one gets a full copy of the package
+func preflight(manifest *common.Manifest, destinations []string) error {
+	if manifest == nil {
+		return errors.New("manifest was not sent")
+	}
+	required := make(map[string]int64)
+	paths := make(map[string]string)
+	for _, destination := range destinations {
+		path, err := filepath.Abs(destination)
+		if err != nil {
+			return err
+		}
+		volume := filepath.VolumeName(path)
+		required[volume] += manifest.RequiredSpace(path)
+		paths[volume] = path
+	}
+	for volume, need := range required {
+		free, err := free_space(existing_parent(paths[volume]))
+		if err != nil {
+			return fmt.Errorf("failed to check free space for %s: %v", paths[volume], err)
+		}
+		if uint64(need) > free {
+			return fmt.Errorf("not enough space on %s, %s required and %s free", volume, common.FormatBytes(int(need)), common.FormatBytes(int(free)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// PRUNE_GRACE protects what a deploy may be using, nothing staged more
+// recently than this is removed
+const PRUNE_GRACE = time.Hour
+
+// staged_package is a package in the staging directory and what the history
+// says about it
+type staged_package struct {
+	common.PruneItem
+	modified   time.Time
+	last_used  time.Time // of its newest deploy, or when it was staged
+	referenced bool      // the history has deploys of it
+	current    bool      // some destination is on it
+	retained   bool      // among the last releases of some destination
+	removed    bool
+	roots      []string // whose retention size the package counts against
+	over       int      // roots it is over the retention size of
+}
+
+// destination_root is the destination root a destination is in, the
+// retention size applies to each root, or to each destination when no roots
+// are configured
+func (service *DeployAgentService) destination_root(destination string) string {
+	parsed, err := common.ParseDestination(destination, common.LocalPathStyle)
+	if err != nil {
+		return destination
+	}
+	for _, root := range service.config.DestinationRoots {
+		if parsed_root, err := common.ParseDestination(root, common.LocalPathStyle); err == nil && parsed.Within(parsed_root) {
+			return root
+		}
+	}
+	return parsed.String()
+}
+
+// plan_prune works out which staged packages the retention settings remove.
+// The package a destination is on is always kept, so are packages staged
+// within PRUNE_GRACE, and temporary files left by an interrupted deploy are
+// removed once they are that old.
+func (service *DeployAgentService) plan_prune(now time.Time) ([]*staged_package, []common.PruneItem, error) {
+	config := service.config
+	files, err := os.ReadDir(config.StagingDir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	packages := make(map[string]*staged_package)
+	var leftovers []common.PruneItem
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, ".tar.gz"):
+			digest := strings.TrimSuffix(name, ".tar.gz")
+			packages[digest] = &staged_package{
+				PruneItem: common.PruneItem{Name: name, Digest: digest, Size: int(info.Size())},
+				modified:  info.ModTime(),
+				last_used: info.ModTime(),
+			}
+		case (strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, common.FETCH_PART_SUFFIX)) && now.Sub(info.ModTime()) > PRUNE_GRACE:
+			leftovers = append(leftovers, common.PruneItem{Name: name, Size: int(info.Size()), Reason: "left by an interrupted deploy"})
+		}
+	}
+
+	entries, err := service.history.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	// releases of each destination newest first, and the packages of each root
+	releases := make(map[string][]string)
+	roots := make(map[string][]*staged_package)
+	in_root := make(map[string]bool)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		staged := packages[entry.Digest]
+		if entry.Status != "ok" || staged == nil {
+			continue
+		}
+		if !staged.referenced {
+			staged.referenced = true
+			staged.last_used = entry.Time
+			staged.Release = entry.Release
+		}
+		key := destination_key(entry.Destination)
+		known := false
+		for _, digest := range releases[key] {
+			known = known || digest == entry.Digest
+		}
+		if !known {
+			releases[key] = append(releases[key], entry.Digest)
+			rank := len(releases[key])
+			staged.current = staged.current || rank == 1
+			staged.retained = staged.retained || config.RetainReleases == 0 || rank <= config.RetainReleases
+		}
+		root := service.destination_root(entry.Destination)
+		if !in_root[root+"\n"+entry.Digest] {
+			in_root[root+"\n"+entry.Digest] = true
+			roots[root] = append(roots[root], staged)
+			staged.roots = append(staged.roots, root)
+		}
+	}
+	// a package no destination was deployed from takes up the same disk as
+	// the others, so it counts against every root, or against the staging
+	// directory when nothing was deployed at all
+	if len(roots) == 0 {
+		roots[config.StagingDir] = nil
+	}
+	for _, staged := range packages {
+		if staged.referenced {
+			continue
+		}
+		for root := range roots {
+			roots[root] = append(roots[root], staged)
+			staged.roots = append(staged.roots, root)
+		}
+	}
+
+	ordered := make([]*staged_package, 0, len(packages))
+	for _, staged := range packages {
+		ordered = append(ordered, staged)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].last_used.After(ordered[j].last_used) })
+	protected := func(staged *staged_package) bool {
+		return staged.current || now.Sub(staged.modified) < PRUNE_GRACE
+	}
+	remove := func(staged *staged_package, reason string) {
+		staged.removed = true
+		staged.Reason = reason
+	}
+	for _, staged := range ordered {
+		switch {
+		case protected(staged):
+		case !staged.retained && config.RetainReleases > 0:
+			if !staged.referenced {
+				remove(staged, "not deployed to any destination")
+			} else {
+				remove(staged, fmt.Sprintf("older than the last %d releases of each destination", config.RetainReleases))
+			}
+		case config.retain_age > 0 && now.Sub(staged.last_used) > config.retain_age:
+			remove(staged, fmt.Sprintf("last deployed %s ago", now.Sub(staged.last_used).Round(time.Hour)))
+		}
+	}
+	// a package shared by roots is only removed when it is over the size of
+	// every one of them, until then the roots that keep it count it
+	if config.retain_bytes > 0 {
+		for _, staged_in_root := range roots {
+			sort.Slice(staged_in_root, func(i, j int) bool { return staged_in_root[i].last_used.After(staged_in_root[j].last_used) })
+			total := 0
+			for _, staged := range staged_in_root {
+				if staged.removed {
+					continue
+				}
+				if total+staged.Size > config.retain_bytes && !protected(staged) {
+					staged.over++
+					continue
+				}
+				total += staged.Size
+			}
+		}
+		for _, staged := range ordered {
+			if !staged.removed && len(staged.roots) > 0 && staged.over == len(staged.roots) {
+				sort.Strings(staged.roots)
+				remove(staged, fmt.Sprintf("over the %s limit of %s", common.FormatBytes(config.retain_bytes), strings.Join(staged.roots, ", ")))
+			}
+		}
+	}
+	return ordered, leftovers, nil
+}
+
+// errDeploying stops a prune while deploys may be reading staged packages
+var errDeploying = errors.New("deploys are in progress, prune once they finish")
+
+// prune applies the retention settings, or only reports what they would
+// remove on a dry run
+func (service *DeployAgentService) prune(dry_run bool) (common.PruneResult, error) {
+	result := common.PruneResult{DryRun: dry_run, Removed: make([]common.PruneItem, 0)}
+	// the janitor and a client's prune do not run together
+	service.prune_lock.Lock()
+	defer service.prune_lock.Unlock()
+	if active, _ := service.queue.Status(); len(active) > 0 && !dry_run {
+		return result, errDeploying
+	}
+	packages, leftovers, err := service.plan_prune(time.Now())
+	if err != nil {
+		return result, err
+	}
+	for _, staged := range packages {
+		if staged.removed {
+			result.Removed = append(result.Removed, staged.PruneItem)
+		} else {
+			result.Kept++
+			result.KeptBytes += staged.Size
+		}
+	}
+	result.Removed = append(result.Removed, leftovers...)
+	for i := range result.Removed {
+		item := &result.Removed[i]
+		if !dry_run {
+			// a package being deployed from cannot be removed on Windows, it
+			// is left for the next prune
+			if err := os.Remove(filepath.Join(service.config.StagingDir, item.Name)); err != nil {
+				item.Error = err.Error()
+				continue
+			}
+		}
+		result.Freed += item.Size
+	}
+	return result, nil
+}
+
+// janitor prunes the staging directory every prune interval until stop is
+// closed
+func (service *DeployAgentService) janitor(stop chan struct{}) {
+	ticker := time.NewTicker(service.config.prune_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		result, err := service.prune(false)
+		if err == errDeploying {
+			continue
+		}
+		if err != nil {
+			log.Warn("failed to prune staged packages", "dir", service.config.StagingDir, "err", err)
+			continue
+		}
+		log_prune(result, "janitor")
+	}
+}
+
+func log_prune(result common.PruneResult, by string) {
+	for _, item := range result.Removed {
+		if len(item.Error) > 0 {
+			log.Warn("failed to remove staged file", "file", item.Name, "err", item.Error)
+		}
+	}
+	if result.Freed > 0 {
+		log.Info("pruned staged packages", "by", by, "removed", len(result.Removed), "freed", common.FormatBytes(result.Freed), "kept", result.Kept, "kept_size", common.FormatBytes(result.KeptBytes))
+	}
+}
+
+// handle_prune reports what a prune would remove on GET and prunes on POST
+func (service *DeployAgentService) handle_prune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "a prune is planned with GET and run with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := service.prune(r.Method == http.MethodGet)
+	if err == errDeploying {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !result.DryRun {
+		log_prune(result, r.RemoteAddr)
+	}
+	write_json(w, result)
+}
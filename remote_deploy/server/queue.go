@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+const QUEUE_NOTIFY_INTERVAL = 5 * time.Second
+
+// DeployQueue hands out per destination locks and limits how many deploys
+// run at once, waiting deploys are granted in arrival order so a deploy to
+// a busy destination is not starved by later ones
+type DeployQueue struct {
+	mutex   sync.Mutex
+	max     int
+	active  int
+	locked  map[string]common.Destination // by key
+	waiting []*deployWaiter
+}
+
+type deployWaiter struct {
+	destinations []common.Destination
+	granted      bool
+	ready        chan struct{}
+	changed      chan struct{}
+	position     int
+}
+
+func NewDeployQueue(max int) *DeployQueue {
+	return &DeployQueue{max: max, locked: make(map[string]common.Destination)}
+}
+
+// destination_key makes two spellings of the same destination share a lock,
+// with the case rules of the OS the agent runs on
+func destination_key(destination string) string {
+	if parsed, err := common.ParseDestination(destination, common.LocalPathStyle); err == nil {
+		return parsed.Key()
+	}
+	return filepath.Clean(destination)
+}
+
+// queue_destination parses a destination for the queue, one the agent cannot
+// parse only conflicts with the same spelling
+func queue_destination(destination string) common.Destination {
+	if parsed, err := common.ParseDestination(destination, common.LocalPathStyle); err == nil {
+		return parsed
+	}
+	return common.Destination{Style: common.LocalPathStyle, Names: []string{destination_key(destination)}}
+}
+
+// overlap reports whether two deploys would write to the same files, which
+// they do when one destination is the other or a folder within it
+func overlap(a common.Destination, b common.Destination) bool {
+	return a.Within(b) || b.Within(a)
+}
+
+// Acquire locks the destinations, when wait is false a busy destination or a
+// full agent fails immediately, otherwise notify is called with the position
+// in the queue whenever it changes and periodically, an error from notify
+// means the client went away and the deploy leaves the queue
+func (queue *DeployQueue) Acquire(destinations []string, wait bool, notify func(position int) error) (release func(), err error) {
+	waiter := &deployWaiter{ready: make(chan struct{}), changed: make(chan struct{}, 1)}
+	for _, destination := range destinations {
+		waiter.destinations = append(waiter.destinations, queue_destination(destination))
+	}
+
+	queue.mutex.Lock()
+	if !wait {
+		var reserved []common.Destination
+		for _, w := range queue.waiting {
+			reserved = append(reserved, w.destinations...)
+		}
+		if err := queue.busy(waiter, reserved); err != nil {
+			queue.mutex.Unlock()
+			return nil, err
+		}
+	}
+	queue.waiting = append(queue.waiting, waiter)
+	queue.grant()
+	queue.mutex.Unlock()
+
+	release = func() {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		queue.active--
+		for _, destination := range waiter.destinations {
+			delete(queue.locked, destination.Key())
+		}
+		queue.grant()
+	}
+
+	ticker := time.NewTicker(QUEUE_NOTIFY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-waiter.ready:
+			return release, nil
+		case <-waiter.changed:
+		case <-ticker.C:
+		}
+		queue.mutex.Lock()
+		position := waiter.position
+		queue.mutex.Unlock()
+		if position == 0 {
+			continue
+		}
+		if err := notify(position); err != nil {
+			queue.cancel(waiter, release)
+			return nil, err
+		}
+	}
+}
+
+// busy returns why the waiter cannot run now, reserved holds destinations
+// claimed by deploys further ahead in the queue. A destination is busy when
+// a running or earlier deploy has it, a folder it is in, or one within it.
+func (queue *DeployQueue) busy(waiter *deployWaiter, reserved []common.Destination) error {
+	for _, destination := range waiter.destinations {
+		for _, locked := range queue.locked {
+			if overlap(destination, locked) {
+				return fmt.Errorf("destination is busy: %s overlaps %s", destination, locked)
+			}
+		}
+		for _, claimed := range reserved {
+			if overlap(destination, claimed) {
+				return fmt.Errorf("destination is busy: %s overlaps %s, which an earlier deploy is waiting for", destination, claimed)
+			}
+		}
+	}
+	if queue.max > 0 && queue.active >= queue.max {
+		return fmt.Errorf("agent is running the maximum of %d deploys", queue.max)
+	}
+	return nil
+}
+
+// grant starts every waiter that can run and renumbers the rest, it is
+// called with the mutex held
+func (queue *DeployQueue) grant() {
+	var reserved []common.Destination
+	remaining := queue.waiting[:0]
+	for _, waiter := range queue.waiting {
+		if queue.busy(waiter, reserved) == nil {
+			queue.active++
+			for _, destination := range waiter.destinations {
+				queue.locked[destination.Key()] = destination
+			}
+			waiter.granted = true
+			close(waiter.ready)
+			continue
+		}
+		reserved = append(reserved, waiter.destinations...)
+		remaining = append(remaining, waiter)
+		if waiter.position != len(remaining) {
+			waiter.position = len(remaining)
+			select {
+			case waiter.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	queue.waiting = remaining
+}
+
+// cancel removes a waiter whose client went away, if it was granted in the
+// meantime its locks are released instead
+func (queue *DeployQueue) cancel(waiter *deployWaiter, release func()) {
+	queue.mutex.Lock()
+	if waiter.granted {
+		queue.mutex.Unlock()
+		release()
+		return
+	}
+	for i, w := range queue.waiting {
+		if w == waiter {
+			queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+			break
+		}
+	}
+	queue.grant()
+	queue.mutex.Unlock()
+}
+
+// Status lists the destinations being deployed to and how many deploys are
+// waiting for theirs
+func (queue *DeployQueue) Status() (active []string, waiting int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	active = make([]string, 0, len(queue.locked))
+	for key := range queue.locked {
+		active = append(active, key)
+	}
+	sort.Strings(active)
+	return active, len(queue.waiting)
+}
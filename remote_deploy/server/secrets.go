@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// SECRET_MAX_SIZE is the largest value a secret may have
+const SECRET_MAX_SIZE = 64 * 1024
+
+var errNoSecret = errors.New("no such secret")
+
+// SecretStore keeps secrets in a JSON file with each value sealed by AES-GCM.
+// The key is a file of its own, made on first use, so the store can be backed
+// up without it. A value is sealed with its name as additional data, so it
+// cannot be moved to another name in the file. Values are never logged.
+type SecretStore struct {
+	mutex    sync.Mutex
+	path     string
+	key_path string
+}
+
+type sealed_secret struct {
+	Nonce   []byte    `json:"nonce"`
+	Value   []byte    `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+func NewSecretStore(path string, key_path string) *SecretStore {
+	return &SecretStore{path: path, key_path: key_path}
+}
+
+// key_cipher reads the key, making one when create is set and there is none.
+// The key file is only readable by the account the agent runs as, on Windows
+// through the ACL of the agent's folder.
+func (store *SecretStore) key_cipher(create bool) (cipher.AEAD, error) {
+	data, err := os.ReadFile(store.key_path)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(store.key_path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Info("created secrets key", "file", store.key_path)
+		data, err = os.ReadFile(store.key_path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secrets key: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secrets key: %s is not a 256 bit key in hex", store.key_path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// read returns the sealed secrets, a missing file is an empty store
+func (store *SecretStore) read() (map[string]sealed_secret, error) {
+	secrets := make(map[string]sealed_secret)
+	data, err := os.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("%s: %v", store.path, err)
+	}
+	return secrets, nil
+}
+
+// write replaces the file through a rename, so it is never left half written
+func (store *SecretStore) write(secrets map[string]sealed_secret) error {
+	data, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := store.path + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, store.path)
+}
+
+func (store *SecretStore) Get(name string) (common.Secret, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	secrets, err := store.read()
+	if err != nil {
+		return common.Secret{}, err
+	}
+	sealed, ok := secrets[name]
+	if !ok {
+		return common.Secret{}, errNoSecret
+	}
+	aead, err := store.key_cipher(false)
+	if err != nil {
+		return common.Secret{}, err
+	}
+	value, err := aead.Open(nil, sealed.Nonce, sealed.Value, []byte(name))
+	if err != nil {
+		return common.Secret{}, fmt.Errorf("secret %s cannot be decrypted with %s", name, store.key_path)
+	}
+	return common.Secret{Name: name, Value: string(value), Updated: sealed.Updated}, nil
+}
+
+func (store *SecretStore) Set(name string, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	secrets, err := store.read()
+	if err != nil {
+		return err
+	}
+	aead, err := store.key_cipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	secrets[name] = sealed_secret{Nonce: nonce, Value: aead.Seal(nil, nonce, []byte(value), []byte(name)), Updated: time.Now().UTC()}
+	return store.write(secrets)
+}
+
+func (store *SecretStore) Delete(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	secrets, err := store.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return errNoSecret
+	}
+	delete(secrets, name)
+	return store.write(secrets)
+}
+
+// List returns the names of the secrets and when each was set, not their values
+func (store *SecretStore) List() ([]common.Secret, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	secrets, err := store.read()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]common.Secret, 0, len(secrets))
+	for name, sealed := range secrets {
+		list = append(list, common.Secret{Name: name, Updated: sealed.Updated})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// secret is a secret's value for a template or a command's environment
+func (service *DeployAgentService) secret(name string) (string, error) {
+	secret, err := service.secrets.Get(name)
+	if err == errNoSecret {
+		return "", fmt.Errorf("no secret %s", name)
+	}
+	return secret.Value, err
+}
+
+// handle_secrets manages the secret store, only names are logged. Values
+// would cross the network in the clear without TLS, so the store is only
+// served on a TLS listener.
+func (service *DeployAgentService) handle_secrets(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		log.Warn("refused secrets request without TLS", "method", r.Method, "remote", r.RemoteAddr)
+		http.Error(w, "secrets are only served over TLS, set tls_cert and tls_key in the agent's config", http.StatusForbidden)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if len(name) > 0 {
+		if err := common.ValidateVarName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	fail := func(err error) {
+		if err == errNoSecret {
+			http.Error(w, fmt.Sprintf("no secret %s", name), http.StatusNotFound)
+			return
+		}
+		log.Error("failed to access secrets", "file", service.secrets.path, "name", name, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if len(name) == 0 {
+			list, err := service.secrets.List()
+			if err != nil {
+				fail(err)
+				return
+			}
+			write_json(w, list)
+			return
+		}
+		secret, err := service.secrets.Get(name)
+		if err != nil {
+			fail(err)
+			return
+		}
+		log.Info("secret read", "name", name, "remote", r.RemoteAddr)
+		write_json(w, secret)
+	case http.MethodPut:
+		value, err := io.ReadAll(io.LimitReader(r.Body, SECRET_MAX_SIZE+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(value) > SECRET_MAX_SIZE {
+			http.Error(w, fmt.Sprintf("a secret is at most %s", common.FormatBytes(SECRET_MAX_SIZE)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := service.secrets.Set(name, string(value)); err != nil {
+			fail(err)
+			return
+		}
+		log.Info("secret set", "name", name, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := service.secrets.Delete(name); err != nil {
+			fail(err)
+			return
+		}
+		log.Info("secret removed", "name", name, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "secrets are read with GET, set with PUT and removed with DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// secret_env is the environment a command runs with, its own secrets added
+// to the agent's environment
+func (service *DeployAgentService) secret_env(command *CommandConfig) ([]string, error) {
+	if len(command.Secrets) == 0 {
+		return nil, nil
+	}
+	env := os.Environ()
+	names := make([]string, 0, len(command.Secrets))
+	for variable := range command.Secrets {
+		names = append(names, variable)
+	}
+	sort.Strings(names)
+	for _, variable := range names {
+		value, err := service.secret(command.Secrets[variable])
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, variable+"="+value)
+	}
+	return env, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+var errClientAway = errors.New("client is not connected")
+
+// DeploySession is one deploy on the agent, it outlives the connection that
+// started it so a client that loses its connection can reconnect and carry on
+// from what the agent already has
+type DeploySession struct {
+	id          string
+	mutex       sync.Mutex // guards the fields below
+	write_mutex sync.Mutex // serialises writes to conn
+	conn        *clientConn
+	meta        common.DeployMeta
+	manifest    *common.Manifest
+	buffer      *bytes.Buffer
+	signer      ed25519.PublicKey
+	signature   []byte
+	release     func()
+	status      string
+	completed   []string
+	kind        string // error kind of a failed deploy
+	err         error
+	expiry      *time.Timer
+	opened      time.Time
+	log         *common.Logger // adds the deploy ID to every line
+	events      *UIEvents
+}
+
+// WriteMessage sends to whichever connection the client is on now, it makes
+// the session usable as a progress sink across reconnects. Text messages are
+// shown on the dashboard too, even when no client is connected.
+func (session *DeploySession) WriteMessage(message_type int, data []byte) error {
+	if message_type == websocket.TextMessage {
+		session.events.publish(UIEvent{Type: UI_MESSAGE, Deploy: session.id, Text: string(data)})
+	}
+	session.mutex.Lock()
+	conn := session.conn
+	session.mutex.Unlock()
+	if conn == nil {
+		return errClientAway
+	}
+	session.write_mutex.Lock()
+	defer session.write_mutex.Unlock()
+	return conn.WriteMessage(message_type, data)
+}
+
+func (session *DeploySession) state() common.DeployState {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	state := common.DeployState{Status: session.status, Completed: session.completed}
+	if session.buffer != nil {
+		state.Received = session.buffer.Len()
+	}
+	if session.err != nil {
+		state.Kind = session.kind
+		state.Error = session.err.Error()
+	}
+	return state
+}
+
+func (session *DeploySession) set_status(status string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.status = status
+}
+
+// DeploySessions holds the deploys that can be resumed, a session whose client
+// stays away longer than the window is dropped and its destinations unlocked
+type DeploySessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*DeploySession
+	window   time.Duration
+	metrics  *DeployMetrics
+	events   *UIEvents
+}
+
+func NewDeploySessions(window time.Duration, metrics *DeployMetrics, events *UIEvents) *DeploySessions {
+	return &DeploySessions{sessions: make(map[string]*DeploySession), window: window, metrics: metrics, events: events}
+}
+
+// SessionInfo is a deploy the agent holds, as shown on the dashboard
+type SessionInfo struct {
+	ID           string    `json:"id"`
+	Destinations []string  `json:"destinations"`
+	Size         int       `json:"size"`
+	Source       string    `json:"source,omitempty"`
+	Digest       string    `json:"digest,omitempty"`
+	Opened       time.Time `json:"opened"`
+	Connected    bool      `json:"connected"`
+	common.DeployState
+}
+
+// list returns the deploys in progress and those finished within the
+// window, oldest first
+func (sessions *DeploySessions) list() []SessionInfo {
+	sessions.mutex.Lock()
+	all := make([]*DeploySession, 0, len(sessions.sessions))
+	for _, session := range sessions.sessions {
+		all = append(all, session)
+	}
+	sessions.mutex.Unlock()
+	infos := make([]SessionInfo, 0, len(all))
+	for _, session := range all {
+		session.mutex.Lock()
+		connected := session.conn != nil
+		session.mutex.Unlock()
+		meta := session.meta
+		infos = append(infos, SessionInfo{ID: session.id, Destinations: meta.Destinations, Size: meta.Size, Source: meta.Source, Digest: meta.Digest, Opened: session.opened.UTC(), Connected: connected, DeployState: session.state()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Opened.Before(infos[j].Opened) })
+	return infos
+}
+
+// open registers a deploy that holds its destination locks, release is
+// called when it finishes or is abandoned
+func (sessions *DeploySessions) open(conn *clientConn, meta common.DeployMeta, manifest *common.Manifest, release func()) (*DeploySession, error) {
+	if len(meta.ID) == 0 {
+		meta.ID = common.NewDeployID()
+	}
+	session := &DeploySession{id: meta.ID, conn: conn, meta: meta, manifest: manifest, release: release, status: common.STATE_RECEIVING, opened: time.Now(), log: log.With("deploy", meta.ID), events: sessions.events}
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if _, ok := sessions.sessions[meta.ID]; ok {
+		return nil, fmt.Errorf("deploy %s already exists", meta.ID)
+	}
+	sessions.sessions[meta.ID] = session
+	sessions.metrics.started(meta.Destinations)
+	sessions.events.publish(UIEvent{Type: UI_STARTED, Deploy: meta.ID, Destinations: meta.Destinations, Status: session.status})
+	return session, nil
+}
+
+// attach moves a session to the client's new connection, it returns nil when
+// the agent no longer has the deploy
+func (sessions *DeploySessions) attach(id string, conn *clientConn) *DeploySession {
+	sessions.mutex.Lock()
+	session := sessions.sessions[id]
+	sessions.mutex.Unlock()
+	if session == nil {
+		return nil
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.expiry != nil && session.status == common.STATE_RECEIVING {
+		session.expiry.Stop()
+		session.expiry = nil
+	}
+	session.conn = conn
+	return session
+}
+
+// detach is called when a connection ends. An upload that was cut off waits
+// for the client to come back, one that failed is dropped at once.
+func (sessions *DeploySessions) detach(session *DeploySession, conn *clientConn, abort bool) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.conn != conn {
+		// the client is already on a newer connection
+		return
+	}
+	session.conn = nil
+	if session.status != common.STATE_RECEIVING {
+		return
+	}
+	if abort {
+		sessions.remove(session)
+		return
+	}
+	session.expiry = time.AfterFunc(sessions.window, func() {
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+		if session.conn == nil && session.status == common.STATE_RECEIVING {
+			session.log.Warn("deploy was not resumed in time and is discarded", "resume_window", sessions.window)
+			sessions.remove(session)
+		}
+	})
+}
+
+// finish records the outcome and unlocks the destinations, the outcome is
+// kept for the window so a client that lost its connection can collect it.
+// kind is the error kind reported when err is not nil.
+func (sessions *DeploySessions) finish(session *DeploySession, completed []string, kind string, err error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.status = common.STATE_DONE
+	if err != nil {
+		session.status = common.STATE_FAILED
+	}
+	session.completed = completed
+	session.kind = kind
+	session.err = err
+	session.buffer = nil
+	session.release()
+	session.release = func() {}
+	sessions.metrics.finished(session.meta.Destinations, completed)
+	event := UIEvent{Type: UI_FINISHED, Deploy: session.id, Destinations: completed, Status: session.status}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	sessions.events.publish(event)
+	session.expiry = time.AfterFunc(sessions.window, func() {
+		sessions.mutex.Lock()
+		defer sessions.mutex.Unlock()
+		delete(sessions.sessions, session.id)
+	})
+}
+
+// remove drops a session that did not finish, it is called with the session's
+// mutex held
+func (sessions *DeploySessions) remove(session *DeploySession) {
+	sessions.metrics.finished(session.meta.Destinations, nil)
+	sessions.events.publish(UIEvent{Type: UI_FINISHED, Deploy: session.id, Status: common.STATE_FAILED, Error: "deploy was abandoned"})
+	session.release()
+	session.release = func() {}
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	delete(sessions.sessions, session.id)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"remote_deploy/common"
+)
+
+// capabilities are reported by ping so clients can tell what this agent
+// supports
+var capabilities = []string{
+	common.CAP_DEPLOY,
+	common.CAP_PULL,
+	common.CAP_DRY_RUN,
+	common.CAP_MIRROR,
+	common.CAP_EXEC,
+	common.CAP_FILES,
+	common.CAP_HISTORY,
+	common.CAP_ROLLBACK,
+	common.CAP_UI,
+	common.CAP_UPDATE,
+	common.CAP_PRUNE,
+	common.CAP_TEMPLATES,
+	common.CAP_SECRETS,
+}
+
+func agent_info() common.AgentInfo {
+	hostname, _ := os.Hostname()
+	return common.AgentInfo{
+		Version:      common.VERSION,
+		Hostname:     hostname,
+		OS:           runtime.GOOS + "/" + runtime.GOARCH,
+		Time:         time.Now().UTC(),
+		Capabilities: capabilities,
+	}
+}
+
+func (service *DeployAgentService) handle_ping(w http.ResponseWriter, r *http.Request) {
+	write_json(w, agent_info())
+}
+
+func (service *DeployAgentService) handle_status(w http.ResponseWriter, r *http.Request) {
+	latest, err := service.history.Latest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	active, waiting := service.queue.Status()
+	status := common.AgentStatus{
+		Version:      common.VERSION,
+		Active:       active,
+		Waiting:      waiting,
+		Destinations: latest,
+	}
+	if update, err := read_update(agent_path(UPDATE_FILE)); err == nil {
+		status.Update = update
+	}
+	write_json(w, status)
+}
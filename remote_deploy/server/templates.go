@@ -0,0 +1,22 @@
+package main
+
+import (
+	"remote_deploy/common"
+)
+
+// templates are what a deploy renders its templates with, the host's values
+// overridden by those sent with the deploy. It is nil when the agent has no
+// template patterns, the package is then extracted as it is.
+func (service *DeployAgentService) templates(meta common.DeployMeta) *common.Templates {
+	if len(service.config.Templates) == 0 {
+		return nil
+	}
+	vars := make(map[string]string, len(service.config.TemplateVars)+len(meta.Vars))
+	for name, value := range service.config.TemplateVars {
+		vars[name] = value
+	}
+	for name, value := range meta.Vars {
+		vars[name] = value
+	}
+	return &common.Templates{Patterns: service.config.Templates, Vars: vars, Secret: service.secret}
+}
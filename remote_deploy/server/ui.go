@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"remote_deploy/common"
+)
+
+//go:embed ui
+var ui_files embed.FS
+
+// the dashboard's paths below common.UI_PATH
+const (
+	UI_OVERVIEW = common.UI_PATH + "api/overview"
+	UI_HISTORY  = common.UI_PATH + "api/history"
+	UI_MANIFEST = common.UI_PATH + "api/manifest"
+	UI_ROLLBACK = common.UI_PATH + "api/rollback"
+	UI_LOGOUT   = common.UI_PATH + "api/logout"
+	UI_EVENTS   = common.UI_PATH + "events"
+)
+
+const UI_COOKIE = "deploy_ui"
+const UI_SESSION_TTL = 8 * time.Hour
+
+// UI_RECENT is how many history entries the overview carries
+const UI_RECENT = 20
+
+// UI_REQUESTED_WITH must be sent with the dashboard's POSTs, a form on another
+// site cannot set a header so it cannot roll back with the user's cookie
+const UI_REQUESTED_WITH = "deploy-ui"
+
+type uiLogin struct {
+	key    ed25519.PublicKey
+	name   string
+	expiry time.Time
+}
+
+// UISessions holds the dashboard's logins. A browser cannot sign requests, so
+// a login link signed with a trusted key is traded once for a cookie.
+type UISessions struct {
+	mutex  sync.Mutex
+	logins map[string]uiLogin
+	used   map[string]time.Time // login links already followed, until they expire
+}
+
+func NewUISessions() *UISessions {
+	return &UISessions{logins: make(map[string]uiLogin), used: make(map[string]time.Time)}
+}
+
+// login returns the cookie for a verified login link, a link is only
+// accepted once so one left in a browser's history is of no use
+func (ui *UISessions) login(link string, key *common.TrustedKey) (string, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	now := time.Now()
+	for token, login := range ui.logins {
+		if now.After(login.expiry) {
+			delete(ui.logins, token)
+		}
+	}
+	for value, expiry := range ui.used {
+		if now.After(expiry) {
+			delete(ui.used, value)
+		}
+	}
+	if _, ok := ui.used[link]; ok {
+		return "", errors.New("login link was already used")
+	}
+	ui.used[link] = now.Add(2 * common.AUTH_WINDOW)
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	ui.logins[token] = uiLogin{key: key.Key, name: key.Name, expiry: now.Add(UI_SESSION_TTL)}
+	return token, nil
+}
+
+func (ui *UISessions) lookup(token string) (uiLogin, bool) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	login, ok := ui.logins[token]
+	if !ok || time.Now().After(login.expiry) {
+		return uiLogin{}, false
+	}
+	return login, true
+}
+
+func (ui *UISessions) logout(token string) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	delete(ui.logins, token)
+}
+
+type ui_signer_key struct{}
+
+// ui_signer is the name of the trusted key the dashboard was opened with
+func ui_signer(r *http.Request) string {
+	name, _ := r.Context().Value(ui_signer_key{}).(string)
+	return name
+}
+
+func (service *DeployAgentService) register_ui(mux *http.ServeMux) {
+	static, err := fs.Sub(ui_files, "ui")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix(common.UI_PATH, http.FileServer(http.FS(static)))
+	mux.HandleFunc(common.UI_LOGIN_PATH, service.handle_ui_login)
+	mux.HandleFunc(common.UI_PATH, service.ui_authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	}))
+	mux.HandleFunc(UI_OVERVIEW, service.ui_authorized(service.handle_ui_overview))
+	mux.HandleFunc(UI_HISTORY, service.ui_authorized(service.handle_history))
+	mux.HandleFunc(UI_MANIFEST, service.ui_authorized(service.handle_ui_manifest))
+	mux.HandleFunc(UI_ROLLBACK, service.ui_authorized(service.handle_ui_rollback))
+	mux.HandleFunc(UI_LOGOUT, service.ui_authorized(service.handle_ui_logout))
+	mux.HandleFunc(UI_EVENTS, service.ui_authorized(service.handle_ui_events))
+}
+
+func (service *DeployAgentService) handle_ui_login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	trusted, err := common.LoadPublicKeys(service.config.TrustedKeys)
+	if err != nil {
+		err = fmt.Errorf("no trusted keys configured: %v", err)
+	}
+	var key *common.TrustedKey
+	if err == nil {
+		key, err = common.VerifyLogin(r, trusted)
+	}
+	var token string
+	if err == nil {
+		token, err = service.ui_sessions.login(r.URL.Query().Get(common.LOGIN_PARAM), key)
+	}
+	if err != nil {
+		log.Warn("rejected dashboard login", "remote", r.RemoteAddr, "err", err)
+		service.metrics.rejected(AUTH_REQUEST)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	log.Info("dashboard login", "remote", r.RemoteAddr, "signer", key.Name)
+	http.SetCookie(w, &http.Cookie{
+		Name:     UI_COOKIE,
+		Value:    token,
+		Path:     common.UI_PATH,
+		MaxAge:   int(UI_SESSION_TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, common.UI_PATH, http.StatusSeeOther)
+}
+
+// ui_authorized is authorized for the dashboard, it takes the login cookie as
+// well as a signed request. The cookie's key must still be trusted, so
+// revoking a key ends its dashboard sessions too.
+func (service *DeployAgentService) ui_authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trusted, err := common.LoadPublicKeys(service.config.TrustedKeys)
+		if err != nil {
+			err = fmt.Errorf("no trusted keys configured: %v", err)
+		}
+		var name string
+		if cookie, cookie_err := r.Cookie(UI_COOKIE); err == nil && cookie_err == nil {
+			login, ok := service.ui_sessions.lookup(cookie.Value)
+			err = errors.New("dashboard login expired")
+			for _, key := range trusted {
+				if ok && key.Key.Equal(login.key) {
+					name, err = key.Name, nil
+				}
+			}
+		} else if err == nil && len(r.Header.Get(common.AUTH_HEADER)) > 0 {
+			var key *common.TrustedKey
+			if key, err = common.VerifyRequest(r, trusted); err == nil {
+				name = key.Name
+			}
+		} else if err == nil {
+			err = errors.New("not logged in, open a login link made by the client's ui command")
+		}
+		if err != nil {
+			service.metrics.rejected(AUTH_REQUEST)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), ui_signer_key{}, name)))
+	}
+}
+
+// UIOverview is everything the dashboard's front page shows
+type UIOverview struct {
+	Agent   common.AgentInfo      `json:"agent"`
+	User    string                `json:"user"`
+	Active  []string              `json:"active"`
+	Waiting int                   `json:"waiting"`
+	Deploys []SessionInfo         `json:"deploys"` // in progress or just finished
+	Current []common.HistoryEntry `json:"current"` // the release of each destination
+	Recent  []common.HistoryEntry `json:"recent"`
+}
+
+func (service *DeployAgentService) handle_ui_overview(w http.ResponseWriter, r *http.Request) {
+	current, err := service.history.Current()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recent, err := service.history.Query("", UI_RECENT)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	active, waiting := service.queue.Status()
+	write_json(w, UIOverview{
+		Agent:   agent_info(),
+		User:    ui_signer(r),
+		Active:  active,
+		Waiting: waiting,
+		Deploys: service.sessions.list(),
+		Current: current,
+		Recent:  recent,
+	})
+}
+
+// current_release finds the release a destination is on now
+func (service *DeployAgentService) current_release(destination string) (*common.HistoryEntry, error) {
+	current, err := service.history.Current()
+	if err != nil {
+		return nil, err
+	}
+	key := destination_key(destination)
+	for i := range current {
+		if destination_key(current[i].Destination) == key {
+			return &current[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no release of %s in the history", destination)
+}
+
+type UIManifest struct {
+	Release  common.HistoryEntry `json:"release"`
+	Manifest *common.Manifest    `json:"manifest"`
+}
+
+// handle_ui_manifest lists the files of a destination's current release,
+// read from the package staged for rollbacks
+func (service *DeployAgentService) handle_ui_manifest(w http.ResponseWriter, r *http.Request) {
+	release, err := service.current_release(r.URL.Query().Get("dst"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(service.staged_path(release.Digest))
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("package %s is not staged on this agent", release.Digest), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	manifest, err := common.ReadManifest(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	write_json(w, UIManifest{Release: *release, Manifest: manifest})
+}
+
+type UIRollback struct {
+	Destination string `json:"destination"`
+	Digest      string `json:"digest"`
+}
+
+// handle_ui_rollback deploys a package a destination had before again. The
+// package was verified when it was first deployed, so the dashboard login
+// stands in for the signature a client would send.
+func (service *DeployAgentService) handle_ui_rollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("X-Requested-With") != UI_REQUESTED_WITH {
+		http.Error(w, "rollbacks are POSTed by the dashboard", http.StatusMethodNotAllowed)
+		return
+	}
+	var request UIRollback
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid rollback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := service.history.Query(request.Destination, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var release *common.HistoryEntry
+	for i := range entries {
+		if entries[i].Status == "ok" && entries[i].Digest == request.Digest {
+			release = &entries[i]
+			break
+		}
+	}
+	if release == nil || len(request.Destination) == 0 {
+		http.Error(w, fmt.Sprintf("%s was never deployed to %s", request.Digest, request.Destination), http.StatusNotFound)
+		return
+	}
+	// a rollback goes back to an older release on purpose
+	meta := common.DeployMeta{ID: common.NewDeployID(), Destinations: []string{release.Destination}, Digest: release.Digest, Size: release.Size, Count: release.Items, Release: release.Release, Vars: release.Vars, Force: true}
+	release_locks, err := service.queue.Acquire(meta.Destinations, false, func(int) error { return nil })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	session, err := service.sessions.open(nil, meta, nil, release_locks)
+	if err != nil {
+		release_locks()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session.set_status(common.STATE_DEPLOYING)
+	signer := ui_signer(r)
+	session.log.Info("rollback started from the dashboard", "destination", release.Destination, "digest", release.Digest, "signer", signer, "remote", r.RemoteAddr)
+	go func() {
+		file, kind, err := service.fetch_package(session, meta)
+		if err != nil {
+			session.log.Warn("failed to fetch package", "digest", meta.Digest, "err", err)
+			service.sessions.finish(session, nil, kind, err)
+			_ = session.WriteMessage(websocket.TextMessage, []byte(common.FormatError(kind, err)))
+			return
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			meta.Size = int(info.Size())
+		}
+		service.complete_deploy(session, file, meta, common.DEPLOY_ROLLBACK, signer)
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{"deploy": session.id})
+}
+
+func (service *DeployAgentService) handle_ui_logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("X-Requested-With") != UI_REQUESTED_WITH {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(UI_COOKIE); err == nil {
+		service.ui_sessions.logout(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: UI_COOKIE, Path: common.UI_PATH, MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handle_ui_events streams deploy events to the dashboard over the same
+// WebSocket machinery deploys use, so a dashboard left open is pinged and
+// closed like any other idle connection
+func (service *DeployAgentService) handle_ui_events(w http.ResponseWriter, r *http.Request) {
+	c, err := service.accept(w, r)
+	if err != nil {
+		log.Error("failed to upgrade to a WebSocket", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	defer c.Close()
+	events := service.events.subscribe()
+	defer service.events.unsubscribe(events)
+
+	// reading handles the pongs and notices the dashboard closing
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,252 @@
+"use strict";
+
+// the dashboard of a deploy agent, every request carries the login cookie and
+// every value from the agent is shown with textContent
+const API = "api/";
+const RECONNECT_DELAY = 5000;
+
+// the last message of each deploy in progress, from the events stream
+const progress = new Map();
+let selected = null;
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+function cell(row, text, className) {
+	const td = row.insertCell();
+	td.textContent = text === undefined || text === null ? "" : String(text);
+	if (className) {
+		td.className = className;
+	}
+	return td;
+}
+
+function empty(tbody, columns, text) {
+	const row = tbody.insertRow();
+	const td = cell(row, text, "empty");
+	td.colSpan = columns;
+}
+
+function button(td, text, onclick) {
+	const b = document.createElement("button");
+	b.type = "button";
+	b.textContent = text;
+	b.addEventListener("click", onclick);
+	td.appendChild(b);
+	return b;
+}
+
+function short(digest) {
+	return digest ? digest.slice(0, 12) : "";
+}
+
+// release names a history entry by its label when the deploy carried one
+function release(entry) {
+	return entry.release ? entry.release + " (" + short(entry.digest) + ")" : short(entry.digest);
+}
+
+function when(time) {
+	return time ? new Date(time).toLocaleString() : "";
+}
+
+function bytes(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function showError(err) {
+	$("error").hidden = !err;
+	$("error").textContent = err ? String(err.message || err) : "";
+}
+
+async function request(path, options) {
+	const response = await fetch(path, options);
+	if (response.status === 401) {
+		document.body.textContent = "Your dashboard login has expired, run the client's ui command for a new link.";
+		throw new Error("not logged in");
+	}
+	if (!response.ok) {
+		throw new Error((await response.text()).trim() || response.statusText);
+	}
+	return response.status === 204 ? null : response.json();
+}
+
+async function refresh() {
+	try {
+		const overview = await request(API + "overview");
+		renderOverview(overview);
+		if (selected) {
+			await showDestination(selected);
+		}
+		showError(null);
+	} catch (err) {
+		showError(err);
+	}
+}
+
+function renderOverview(overview) {
+	const agent = overview.agent;
+	$("agent").textContent = agent.hostname + " · " + agent.version + " · " + agent.os;
+	$("user").textContent = "signed in as " + overview.user;
+	const active = overview.active || [];
+	$("queue").textContent = active.length ? "Deploying to " + active.join(", ") : "Idle";
+	if (overview.waiting) {
+		$("queue").textContent += ", " + overview.waiting + " waiting";
+	}
+
+	const deploys = $("deploys").tBodies[0];
+	deploys.replaceChildren();
+	for (const deploy of (overview.deploys || []).slice().reverse()) {
+		const row = deploys.insertRow();
+		row.id = "deploy-" + deploy.id;
+		cell(row, deploy.id);
+		cell(row, (deploy.destinations || []).join(", "));
+		cell(row, deploy.status + (deploy.error ? ": " + deploy.error : ""), deploy.status);
+		cell(row, progress.get(deploy.id) || (deploy.received ? bytes(deploy.received) + " received" : ""));
+		cell(row, when(deploy.opened));
+	}
+	if (!deploys.rows.length) {
+		empty(deploys, 5, "No deploys in progress");
+	}
+
+	const current = $("current").tBodies[0];
+	current.replaceChildren();
+	for (const entry of overview.current || []) {
+		const row = current.insertRow();
+		cell(row, entry.destination);
+		cell(row, release(entry));
+		cell(row, entry.kind);
+		cell(row, entry.signer);
+		cell(row, when(entry.time));
+		button(cell(row), "Details", () => showDestination(entry.destination).catch(showError));
+	}
+	if (!current.rows.length) {
+		empty(current, 6, "Nothing has been deployed yet");
+	}
+
+	const recent = $("recent").tBodies[0];
+	recent.replaceChildren();
+	for (const entry of overview.recent || []) {
+		const row = recent.insertRow();
+		cell(row, when(entry.time));
+		cell(row, entry.destination);
+		cell(row, release(entry));
+		cell(row, entry.kind);
+		cell(row, entry.status + (entry.error ? ": " + entry.error : ""), entry.status);
+		cell(row, entry.signer);
+	}
+	if (!recent.rows.length) {
+		empty(recent, 6, "No deploys recorded");
+	}
+}
+
+// showDestination lists the releases of a destination, with a rollback to
+// each it had before, and the files of the current one
+async function showDestination(destination) {
+	selected = destination;
+	const query = "?dst=" + encodeURIComponent(destination);
+	const entries = await request(API + "history" + query);
+	$("detail").hidden = false;
+	$("detail-title").textContent = destination;
+
+	const current = entries.find((entry) => entry.status === "ok");
+	const releases = $("releases").tBodies[0];
+	releases.replaceChildren();
+	for (const entry of entries) {
+		const row = releases.insertRow();
+		cell(row, release(entry));
+		cell(row, entry.kind);
+		cell(row, entry.status, entry.status);
+		cell(row, entry.signer);
+		cell(row, when(entry.time));
+		const td = cell(row);
+		if (entry.status === "ok" && current && entry.digest !== current.digest) {
+			button(td, "Roll back", () => rollback(destination, entry.digest));
+		} else if (entry === current) {
+			td.textContent = "current";
+		}
+	}
+
+	const manifest = $("manifest").tBodies[0];
+	manifest.replaceChildren();
+	try {
+		const result = await request(API + "manifest" + query);
+		const files = result.manifest.files || [];
+		$("manifest-summary").textContent = short(result.release.digest) + ": " + result.manifest.items + " items, " + bytes(result.manifest.bytes);
+		for (const file of files) {
+			const row = manifest.insertRow();
+			cell(row, file.path + (file.dir ? "/" : ""));
+			cell(row, file.dir ? "" : bytes(file.size));
+			cell(row, file.sha256 || "").className = "digest";
+		}
+	} catch (err) {
+		$("manifest-summary").textContent = err.message;
+	}
+	$("detail").scrollIntoView({ behavior: "smooth" });
+}
+
+async function rollback(destination, digest) {
+	if (!confirm("Deploy " + short(digest) + " to " + destination + " again?")) {
+		return;
+	}
+	try {
+		await request(API + "rollback", {
+			method: "POST",
+			headers: { "Content-Type": "application/json", "X-Requested-With": "deploy-ui" },
+			body: JSON.stringify({ destination: destination, digest: digest }),
+		});
+		showError(null);
+		await refresh();
+	} catch (err) {
+		showError(err);
+	}
+}
+
+// listen follows the agent's deploy events, reconnecting when the agent
+// restarts or the connection idles out
+function listen() {
+	const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+	const socket = new WebSocket(scheme + "//" + location.host + location.pathname.replace(/[^/]*$/, "") + "events");
+	socket.addEventListener("open", () => {
+		$("live").textContent = "live";
+		$("live").className = "online";
+		refresh();
+	});
+	socket.addEventListener("message", (message) => {
+		const event = JSON.parse(message.data);
+		if (event.type === "message") {
+			progress.set(event.deploy, event.text);
+			const row = $("deploy-" + event.deploy);
+			if (row) {
+				row.cells[3].textContent = event.text;
+			}
+			return;
+		}
+		if (event.type === "finished") {
+			progress.delete(event.deploy);
+		}
+		refresh();
+	});
+	socket.addEventListener("close", () => {
+		$("live").textContent = "offline";
+		$("live").className = "offline";
+		setTimeout(listen, RECONNECT_DELAY);
+	});
+}
+
+$("logout").addEventListener("click", async () => {
+	try {
+		await request(API + "logout", { method: "POST", headers: { "X-Requested-With": "deploy-ui" } });
+	} finally {
+		document.body.textContent = "Logged out.";
+	}
+});
+
+refresh();
+listen();
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// kinds of dashboard event
+const (
+	UI_STARTED  = "started"
+	UI_MESSAGE  = "message"
+	UI_FINISHED = "finished"
+)
+
+// UI_EVENT_BUFFER is how many events a slow dashboard may fall behind by
+// before events are dropped for it
+const UI_EVENT_BUFFER = 256
+
+// UIEvent is sent to the dashboard as JSON, a message is anything a deploy
+// sent its client such as PROGRESS or PROG DONE
+type UIEvent struct {
+	Type         string    `json:"type"`
+	Deploy       string    `json:"deploy"`
+	Time         time.Time `json:"time"`
+	Destinations []string  `json:"destinations,omitempty"`
+	Text         string    `json:"text,omitempty"`
+	Status       string    `json:"status,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// UIEvents fans deploy events out to the open dashboards, publishing never
+// blocks a deploy on a slow browser
+type UIEvents struct {
+	mutex       sync.Mutex
+	subscribers map[chan UIEvent]bool
+}
+
+func NewUIEvents() *UIEvents {
+	return &UIEvents{subscribers: make(map[chan UIEvent]bool)}
+}
+
+func (events *UIEvents) subscribe() chan UIEvent {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	ch := make(chan UIEvent, UI_EVENT_BUFFER)
+	events.subscribers[ch] = true
+	return ch
+}
+
+func (events *UIEvents) unsubscribe(ch chan UIEvent) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	delete(events.subscribers, ch)
+}
+
+func (events *UIEvents) publish(event UIEvent) {
+	event.Time = time.Now().UTC()
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	for ch := range events.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"remote_deploy/common"
+
+	"remote_deploy/winsvc"
+)
+
+// UPDATE_FILE records the agent's last update of itself, next to the
+// executable. The new executable marks it healthy once it is listening, which
+// is what the update helper waits for.
+const UPDATE_FILE = "agent_update.json"
+
+// UPDATE_COMMAND runs the previous executable as the helper that starts the
+// new one and restores the previous one if the new one does not become
+// healthy
+const UPDATE_COMMAND = "finish-update"
+
+// VERSION_COMMAND prints the agent's version, an update runs the new
+// executable with it to check it works on this machine
+const VERSION_COMMAND = "version"
+
+// UPDATE_EXIT_DELAY lets the answer to an update reach the client before the
+// agent stops
+const UPDATE_EXIT_DELAY = time.Second
+
+// staged_exe_path names the executables of an update next to the running
+// one, agent.new.exe for the one being installed and agent.old.exe for the
+// one it replaces
+func staged_exe_path(exe string, stage string) string {
+	ext := filepath.Ext(exe)
+	return strings.TrimSuffix(exe, ext) + "." + stage + ext
+}
+
+func update_path(exe string) string {
+	return filepath.Join(filepath.Dir(exe), UPDATE_FILE)
+}
+
+func read_update(path string) (*common.AgentUpdate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	update := new(common.AgentUpdate)
+	if err := json.Unmarshal(data, update); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return update, nil
+}
+
+func write_update(path string, update *common.AgentUpdate) error {
+	data, err := json.MarshalIndent(update, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// handle_update takes a new executable in the body of a PUT, signed with the
+// SIGNATURE_HEADER by one of the update keys. It is staged next to the
+// running executable, checked to run, swapped in, and the agent then stops
+// for the update helper to start it.
+func (service *DeployAgentService) handle_update(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "an update is sent with PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	// the lock is kept by an update that goes ahead, the agent stops
+	if !service.update_lock.TryLock() {
+		http.Error(w, "the agent is already updating", http.StatusConflict)
+		return
+	}
+	update, status, err := service.stage_update(r)
+	if err != nil {
+		service.update_lock.Unlock()
+		log.Warn("rejected agent update", "remote", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Info("updating the agent", "from", update.From, "to", update.To, "digest", update.Digest, "signer", update.Signer)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(update)
+	go func() {
+		time.Sleep(UPDATE_EXIT_DELAY)
+		service.updating = true
+		service.exit()
+	}()
+}
+
+// stage_update receives, verifies and swaps in a new executable, returning
+// the HTTP status to answer with when it fails
+func (service *DeployAgentService) stage_update(r *http.Request) (*common.AgentUpdate, int, error) {
+	if active, _ := service.queue.Status(); len(active) > 0 {
+		return nil, http.StatusConflict, fmt.Errorf("deploying to %s, update once the deploys finish", strings.Join(active, ", "))
+	}
+	update_keys, err := common.LoadPublicKeys(service.config.UpdateKeys)
+	if err != nil {
+		return nil, http.StatusForbidden, fmt.Errorf("updates are disabled, no update keys: %v", err)
+	}
+	signer, signature, err := common.ParseSignature(r.Header.Get(common.SIGNATURE_HEADER))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	exe, err := winsvc.ExePath()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	staged := staged_exe_path(exe, "new")
+	digest, err := receive_exe(r.Body, staged, service.config.max_payload_bytes)
+	if err == errTooLarge {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("executable is larger than the limit of %s", common.FormatBytes(service.config.max_payload_bytes))
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	key, err := common.VerifyDigest(update_keys, signer, digest, signature)
+	if err != nil {
+		os.Remove(staged)
+		service.metrics.rejected(AUTH_SIGNATURE)
+		return nil, http.StatusForbidden, err
+	}
+	version, err := exe_version(staged)
+	if err != nil {
+		os.Remove(staged)
+		return nil, http.StatusBadRequest, fmt.Errorf("the new executable does not run on this agent: %v", err)
+	}
+
+	update := &common.AgentUpdate{
+		From:    common.VERSION,
+		To:      version,
+		Digest:  hex.EncodeToString(digest),
+		Signer:  key.Name,
+		Started: time.Now().UTC(),
+		Status:  common.UPDATE_PENDING,
+	}
+	if err := write_update(update_path(exe), update); err != nil {
+		os.Remove(staged)
+		return nil, http.StatusInternalServerError, err
+	}
+	// a running executable can be renamed but not replaced
+	if err := os.Rename(exe, staged_exe_path(exe, "old")); err != nil {
+		os.Remove(staged)
+		os.Remove(update_path(exe))
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		_ = os.Rename(staged_exe_path(exe, "old"), exe)
+		os.Remove(update_path(exe))
+		return nil, http.StatusInternalServerError, err
+	}
+	return update, 0, nil
+}
+
+var errTooLarge = errors.New("executable is too large")
+
+// receive_exe writes an executable to path while hashing it
+func receive_exe(src io.Reader, path string, max_size int) ([]byte, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(src, int64(max_size)+1))
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil && size > int64(max_size) {
+		err = errTooLarge
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// exe_version runs an executable with VERSION_COMMAND and returns what it
+// prints
+func exe_version(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, VERSION_COMMAND).Output()
+	if err != nil {
+		return "", err
+	}
+	version := strings.TrimSpace(string(out))
+	if len(version) == 0 || strings.ContainsAny(version, " \n") {
+		return "", fmt.Errorf("unexpected version %q", version)
+	}
+	return version, nil
+}
+
+// start_update_helper runs the previous executable as the update helper once
+// an update has stopped the agent
+func start_update_helper(as_service bool, timeout time.Duration) error {
+	exe, err := winsvc.ExePath()
+	if err != nil {
+		return err
+	}
+	args := []string{UPDATE_COMMAND, "-exe", exe, "-timeout", timeout.String()}
+	if as_service {
+		args = append(args, "-service")
+	}
+	helper := exec.Command(staged_exe_path(exe, "old"), args...)
+	helper.Stdin, helper.Stdout, helper.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return helper.Start()
+}
+
+// confirm_update is the health report of a new executable, it marks the
+// pending update healthy once the agent is listening. An agent started at
+// another version was restored by the helper and logs why.
+func confirm_update() {
+	path := agent_path(UPDATE_FILE)
+	update, err := read_update(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Warn("failed to read the last agent update", "err", err)
+		return
+	}
+	if update.Finished != nil {
+		return
+	}
+	switch {
+	case update.Status == common.UPDATE_PENDING && update.To == common.VERSION:
+		update.Status = common.UPDATE_HEALTHY
+		log.Info("agent updated", "from", update.From, "to", update.To, "digest", update.Digest, "signer", update.Signer)
+	case update.Status == common.UPDATE_PENDING:
+		// the helper did not finish, but this is not the new executable
+		update.Status = common.UPDATE_FAILED
+		update.Error = fmt.Sprintf("the agent started at version %s instead of %s", common.VERSION, update.To)
+		log.Warn("agent update failed", "to", update.To, "err", update.Error)
+	default:
+		log.Warn("agent update failed, the previous executable was restored", "to", update.To, "digest", update.Digest, "err", update.Error)
+	}
+	finished := time.Now().UTC()
+	update.Finished = &finished
+	if err := write_update(path, update); err != nil {
+		log.Error("failed to record the agent update", "err", err)
+	}
+}
+
+// finish_update is the update helper, run from the previous executable once
+// the agent has stopped. It starts the new executable and waits for it to
+// report healthy, and otherwise stops it, records why and starts the
+// previous executable again.
+func finish_update(args []string) {
+	flags := flag.NewFlagSet(UPDATE_COMMAND, flag.ExitOnError)
+	exe := flags.String("exe", "", "the agent executable, the new one by now")
+	timeout := flags.Duration("timeout", time.Minute, "how long the new executable has to report healthy")
+	as_service := flags.Bool("service", false, "the agent runs as a service")
+	flags.Parse(args)
+	if len(*exe) == 0 {
+		fmt.Fprintln(os.Stderr, "exe is required")
+		os.Exit(2)
+	}
+	agent := &updated_agent{exe: *exe, as_service: *as_service}
+	path := update_path(*exe)
+
+	err := agent.start()
+	if err == nil {
+		err = agent.wait_healthy(path, *timeout)
+	}
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: update failed, restoring the previous executable: %v\n", SERVICE_NAME, err)
+	agent.stop()
+	if update, read_err := read_update(path); read_err == nil {
+		update.Status = common.UPDATE_FAILED
+		update.Error = err.Error()
+		_ = write_update(path, update)
+	}
+	// the new executable may be locked for a moment after it stops
+	restore := retry_for(10*time.Second, func() error { return os.Rename(staged_exe_path(*exe, "old"), *exe) })
+	if restore != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed to restore the previous executable: %v\n", SERVICE_NAME, restore)
+		os.Exit(1)
+	}
+	if err := agent.start(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed to start the previous executable: %v\n", SERVICE_NAME, err)
+		os.Exit(1)
+	}
+}
+
+// updated_agent starts and stops the agent for the update helper, through the
+// service control manager or as a child process when the agent runs from a
+// console
+type updated_agent struct {
+	exe        string
+	as_service bool
+	process    *exec.Cmd
+	exited     chan error
+}
+
+func (agent *updated_agent) start() error {
+	if agent.as_service {
+		// the service may take a moment to report that it stopped
+		return retry_for(30*time.Second, func() error { return winsvc.StartService(SERVICE_NAME) })
+	}
+	agent.process = exec.Command(agent.exe)
+	agent.process.Stdin, agent.process.Stdout, agent.process.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := agent.process.Start(); err != nil {
+		return err
+	}
+	agent.exited = make(chan error, 1)
+	go func() { agent.exited <- agent.process.Wait() }()
+	return nil
+}
+
+func (agent *updated_agent) stop() {
+	if agent.as_service {
+		_ = winsvc.StopService(SERVICE_NAME)
+		return
+	}
+	if agent.process != nil {
+		_ = agent.process.Process.Kill()
+		<-agent.exited
+	}
+}
+
+// wait_healthy waits for the new executable to mark the update healthy
+func (agent *updated_agent) wait_healthy(path string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-agent.exited:
+			agent.exited <- err
+			return fmt.Errorf("the new agent exited: %v", err)
+		case <-deadline:
+			return fmt.Errorf("the new agent did not report healthy within %s", timeout)
+		case <-ticker.C:
+			if update, err := read_update(path); err == nil && update.Status == common.UPDATE_HEALTHY {
+				return nil
+			}
+		}
+	}
+}
+
+// retry_for calls attempt until it succeeds or the time is up
+func retry_for(limit time.Duration, attempt func() error) error {
+	deadline := time.Now().Add(limit)
+	for {
+		err := attempt()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -2,4 +2,4 @@ module remote_deploy/winsvc/v0.1.0
 
 go 1.18
 
-require golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+require golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
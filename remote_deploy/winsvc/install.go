@@ -17,7 +17,9 @@ import (
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
-func exePath() (string, error) {
+// ExePath is the path of the running executable, the one the service is
+// installed with
+func ExePath() (string, error) {
 	prog := os.Args[0]
 	p, err := filepath.Abs(prog)
 	var fi fs.FileInfo
@@ -45,7 +47,7 @@ func exePath() (string, error) {
 }
 
 func installService(name, desc string) error {
-	exepath, err := exePath()
+	exepath, err := ExePath()
 	if err != nil {
 		return err
 	}
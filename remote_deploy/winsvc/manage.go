@@ -61,3 +61,13 @@ func controlService(name string, c svc.Cmd, to svc.State) error {
 	}
 	return nil
 }
+
+// StartService and StopService control the installed service from another
+// process, such as the helper that swaps in a new executable
+func StartService(name string) error {
+	return startService(name)
+}
+
+func StopService(name string) error {
+	return controlService(name, svc.Stop, svc.Stopped)
+}
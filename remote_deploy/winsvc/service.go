@@ -10,6 +10,7 @@ package winsvc
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
@@ -24,9 +25,12 @@ type Service interface {
 }
 
 type ServiceManager struct {
-	Name    string
-	Desc    string
-	Service Service
+	Name       string
+	Desc       string
+	Service    Service
+	is_service bool
+	exit       chan struct{}
+	exit_once  sync.Once
 }
 
 func (mgr *ServiceManager) Run() {
@@ -37,6 +41,9 @@ func (mgr *ServiceManager) Run() {
 		os.Exit(1)
 	}
 
+	mgr.is_service = running_as_service
+	mgr.exit = make(chan struct{})
+
 	// determine the correct runner based on running in interactive mode or not
 	run := svc.Run
 	if !running_as_service {
@@ -95,15 +102,21 @@ func (mgr *ServiceManager) Execute(args []string, r <-chan svc.ChangeRequest, ch
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 
 loop:
-	for c := range r {
-		switch c.Cmd {
-		case svc.Interrogate:
-			changes <- c.CurrentStatus
-		case svc.Stop, svc.Shutdown:
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				mgr.Service.Stop()
+				break loop
+			default:
+				log.Error(1, fmt.Sprintf("%s: unexpected control request #%d", mgr.Name, c))
+			}
+		case <-mgr.exit:
 			mgr.Service.Stop()
 			break loop
-		default:
-			log.Error(1, fmt.Sprintf("%s: unexpected control request #%d", mgr.Name, c))
 		}
 	}
 
@@ -111,6 +124,18 @@ loop:
 	return
 }
 
+// IsService reports whether Run was started by the service control manager
+// rather than from a console
+func (mgr *ServiceManager) IsService() bool {
+	return mgr.is_service
+}
+
+// Exit stops the service and returns from Run as a stop request would, the
+// process can then exit and hand over to another
+func (mgr *ServiceManager) Exit() {
+	mgr.exit_once.Do(func() { close(mgr.exit) })
+}
+
 func usage(errmsg string) {
 	fmt.Fprintf(os.Stderr,
 		"%s\n\n"+